@@ -1,8 +1,10 @@
 package proxypool
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -24,11 +26,54 @@ func (h State) String() string {
 		return "UNAVAILABLE"
 	case Closed:
 		return "CLOSED"
+	case Probation:
+		return "PROBATION"
+	case Paused:
+		return "PAUSED"
+	case Expired:
+		return "EXPIRED"
+	case AuthFailed:
+		return "AUTH FAILED"
 	default:
 		return "UNDEFINED"
 	}
 }
 
+func ParseState(s string) (State, error) {
+	name := strings.ToUpper(strings.NewReplacer("_", " ", "-", " ").Replace(strings.TrimSpace(s)))
+	for h := Unknown; h <= maxState; h++ {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	return Unknown, fmt.Errorf("unknown state %q", s)
+}
+
+func (h State) MarshalJSON() ([]byte, error) {
+	if h < Unknown || h > maxState {
+		return json.Marshal(int(h))
+	}
+	return json.Marshal(strings.ReplaceAll(h.String(), " ", "_"))
+}
+
+func (h *State) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		*h = State(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("state must be a name or a number: %w", err)
+	}
+	state, err := ParseState(s)
+	if err != nil {
+		return err
+	}
+	*h = state
+	return nil
+}
+
 const (
 	Unknown State = iota
 	Ok
@@ -37,27 +82,67 @@ const (
 	OutOfDate
 	Unavailable
 	Closed
+	Probation
+	Paused
+	Expired
+	AuthFailed
+
+	maxState = AuthFailed
 )
 
+func States() []State {
+	r := make([]State, 0, maxState+1)
+	for h := Unknown; h <= maxState; h++ {
+		r = append(r, h)
+	}
+	return r
+}
+
 type Info struct {
-	Name                 string `json:"name"`
-	State                string `json:"state"`
-	LastRequestTimestamp string `json:"last_request_timestamp"`
-	Requests             int    `json:"requests"`
+	Name                 string      `json:"name"`
+	Scheme               string      `json:"scheme,omitempty"`
+	URL                  string      `json:"url,omitempty"`
+	State                string      `json:"state"`
+	LastRequestTimestamp string      `json:"last_request_timestamp"`
+	Report               StateReport `json:"report"`
+	Tokens               *float64    `json:"tokens,omitempty"`
+	LastRequestTime      time.Time   `json:"last_request_time"`
+	Requests             int         `json:"requests"`
+	InFlight             int         `json:"in_flight"`
+	AvgLatencyMs         float64     `json:"avg_latency_ms"`
+	LastLatencyMs        float64     `json:"last_latency_ms"`
+	TTLRemaining         string      `json:"ttl_remaining,omitempty"`
+	NextTokenIn          string      `json:"next_token_in,omitempty"`
+	NextTokenInSeconds   float64     `json:"next_token_in_seconds"`
+	Throughput           float64     `json:"throughput_bytes_per_second"`
+	LatencyEWMA          string      `json:"latency_ewma"`
+	LatencyP50           string      `json:"latency_p50"`
+	LatencyP95           string      `json:"latency_p95"`
+	LatencyP99           string      `json:"latency_p99"`
+	LatencySamples       int         `json:"latency_samples"`
+	Tags                 []string    `json:"tags,omitempty"`
+	BytesSent            int64       `json:"bytes_sent"`
+	BytesReceived        int64       `json:"bytes_received"`
+	SuccessRate1m        float64     `json:"success_rate_1m"`
+	SuccessRate10m       float64     `json:"success_rate_10m"`
 }
 
 var ErrAgentClosed = fmt.Errorf("agent is closed")
 
 type StateReport struct {
-	State     State
-	Message   string
-	Timestamp time.Time
+	State     State     `json:"state"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
 }
 
 func (h StateReport) String() string {
 	return fmt.Sprintf("%s: %s (%s ago)", h.State, h.Message, time.Since(h.Timestamp).Truncate(time.Second))
 }
 
+type StateNotifier interface {
+	NotifyStateChange(fn func(StateReport))
+}
+
 type Agent interface {
 	Info() Info
 	SetState(State, string)
@@ -0,0 +1,81 @@
+package proxypool_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestStateJSONRoundTrip(t *testing.T) {
+	states := append(proxypool.States(), proxypool.State(42))
+	for _, s := range states {
+		t.Run(s.String(), func(t *testing.T) {
+			data, err := json.Marshal(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := `"` + strings.ReplaceAll(s.String(), " ", "_") + `"`
+			if s == 42 {
+				want = "42"
+			}
+			if string(data) != want {
+				t.Errorf("Marshal = %s, want %s", data, want)
+			}
+			var got proxypool.State
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != s {
+				t.Errorf("round trip = %d, want %d", got, s)
+			}
+		})
+	}
+}
+
+func TestStateUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want proxypool.State
+		err  bool
+	}{
+		{`3`, proxypool.Banned, false},
+		{`"BANNED"`, proxypool.Banned, false},
+		{`"out of date"`, proxypool.OutOfDate, false},
+		{`"auth-failed"`, proxypool.AuthFailed, false},
+		{`"MAYBE"`, proxypool.Unknown, true},
+		{`true`, proxypool.Unknown, true},
+	}
+	for _, tt := range tests {
+		var got proxypool.State
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("Unmarshal(%s) = %s, %v; want %s, error %v", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestStateReportJSON(t *testing.T) {
+	r := proxypool.StateReport{
+		State:     proxypool.OutOfDate,
+		Message:   "stale",
+		Timestamp: time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC),
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"state":"OUT_OF_DATE","message":"stale","timestamp":"2023-04-05T06:07:08Z"}`
+	if string(data) != want {
+		t.Errorf("Marshal = %s, want %s", data, want)
+	}
+	var got proxypool.StateReport
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.State != r.State || got.Message != r.Message || !got.Timestamp.Equal(r.Timestamp) {
+		t.Errorf("round trip = %+v, want %+v", got, r)
+	}
+}
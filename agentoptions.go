@@ -0,0 +1,234 @@
+package proxypool
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type AgentOption func(*ProxyAgentWithLimiter)
+
+func WithMaxInFlight(n int) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.maxInFlight = n
+	}
+}
+
+func WithBlockingLimiter() AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.blockingLimiter = true
+	}
+}
+
+func WithStaleAfter(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.staleAfter = d
+	}
+}
+
+func WithStaleAfterFor(h State, d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		if a.staleAfterState == nil {
+			a.staleAfterState = make(map[State]time.Duration)
+		}
+		a.staleAfterState[h] = d
+	}
+}
+
+// WithOkStaleAfter makes an Ok state degrade to OutOfDate once neither the
+// state nor a request through the agent is more recent than d, so that the
+// agent is re-verified before it is trusted again. Zero, the default, keeps
+// Ok states fresh indefinitely.
+func WithOkStaleAfter(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.okStaleAfter = d
+	}
+}
+
+func WithBanCooldown(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.banCooldown = d
+	}
+}
+
+func WithDialTimeout(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.dialTimeout = d
+	}
+}
+
+func WithKeepAlive(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.keepAlive = d
+	}
+}
+
+func WithTLSHandshakeTimeout(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.tlsHandshakeTimeout = d
+	}
+}
+
+func WithIdleConns(max, maxPerHost int, timeout time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.maxIdleConns = max
+		a.transport.maxIdleConnsPerHost = maxPerHost
+		a.transport.idleConnTimeout = timeout
+	}
+}
+
+func WithClientTimeout(d time.Duration) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.clientTimeout = d
+	}
+}
+
+func WithTransport(rt http.RoundTripper) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.roundTripper = rt
+	}
+}
+
+func WithTLSConfig(cfg *tls.Config) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.tlsConfig = cfg.Clone()
+	}
+}
+
+func WithInsecureSkipVerify() AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		if a.transport.tlsConfig == nil {
+			a.transport.tlsConfig = &tls.Config{}
+		}
+		a.transport.tlsConfig.InsecureSkipVerify = true
+	}
+}
+
+func WithRefundOnConnectionError() AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.refundOnConnError = true
+	}
+}
+
+// WithChargeOnSuccess keeps the token of each request pending until
+// ReportOutcome is called, and refunds it on failure. The pool reports
+// outcomes itself; callers using the agent directly must call ReportOutcome
+// once per successful Do. At most 256 reservations are kept, older ones stay
+// charged.
+func WithChargeOnSuccess() AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.chargeOnSuccess = true
+	}
+}
+
+func WithLimiter(l *rate.Limiter) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.limiter = l
+	}
+}
+
+func WithProxyTLSConfig(cfg *tls.Config) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.proxyTLSConfig = cfg.Clone()
+	}
+}
+
+// WithCredentialSource reads proxy credentials from fn on every dial. The
+// agent's UpdateCredentials returns ErrCredentialSource when this is set.
+func WithCredentialSource(fn func() (user, pass string)) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.credentials = fn
+	}
+}
+
+func WithDefaultHeaders(h http.Header) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		if a.defaultHeaders == nil {
+			a.defaultHeaders = make(http.Header)
+		}
+		for k, v := range h {
+			a.defaultHeaders[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+}
+
+func WithCookieJar(jar http.CookieJar) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.jar = newAgentJar(jar)
+	}
+}
+
+func WithUserAgentProvider(fn func() string) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.userAgent = fn
+	}
+}
+
+func WithRedirectPolicy(fn func(req *http.Request, via []*http.Request) error) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.checkRedirect = fn
+	}
+}
+
+func WithNoRedirects() AgentOption {
+	return WithRedirectPolicy(func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	})
+}
+
+func WithHTTP2(enabled bool) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.http2 = enabled
+	}
+}
+
+func WithLocalDNS() AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.localDNS = true
+	}
+}
+
+func WithDialContext(fn func(ctx context.Context, network, addr string) (net.Conn, error)) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.transport.dialContext = fn
+	}
+}
+
+func WithHealthCheckConsumingTokens() AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.checkConsumes = true
+	}
+}
+
+// WithBandwidthLimit caps the combined request and response body throughput
+// of the agent at bytesPerSec.
+func WithBandwidthLimit(bytesPerSec int64) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		if bytesPerSec > 0 {
+			a.bandwidth = newBandwidthLimiter(bytesPerSec)
+		}
+	}
+}
+
+// WithPerHostLimiter limits requests per target host in addition to the
+// agent's own limiter. newLimiter is called the first time a host is seen and
+// may return nil to leave that host unlimited. Requests over a host's limit
+// fail immediately with ErrHostRateLimited, or wait for the host's token with
+// WithBlockingLimiter. The pool skips an agent that returns
+// ErrHostRateLimited without counting a failure against it.
+func WithPerHostLimiter(newLimiter func(host string) *rate.Limiter) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.hostLimiters = newHostLimiters(newLimiter)
+	}
+}
+
+func WithTTL(d time.Duration, fromFirstUse bool) AgentOption {
+	return func(a *ProxyAgentWithLimiter) {
+		a.ttl = d
+		a.ttlFromFirstUse = fromFirstUse
+	}
+}
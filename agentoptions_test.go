@@ -0,0 +1,431 @@
+package proxypool_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestPerAgentTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	cfg := &tls.Config{RootCAs: roots}
+
+	// An empty proxy URL connects directly, which keeps the test to TLS.
+	tests := []struct {
+		name string
+		opts []proxypool.AgentOption
+		ok   bool
+	}{
+		{"default verification", nil, false},
+		{"private CA", []proxypool.AgentOption{proxypool.WithTLSConfig(cfg)}, true},
+		{"insecure", []proxypool.AgentOption{proxypool.WithInsecureSkipVerify()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := proxypool.NewProxyAgent(url.URL{}, tt.opts...)
+			defer agent.Close()
+			res, err := agent.Do(newRequest(t, http.MethodGet, srv.URL, nil))
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Do: %v", err)
+				}
+				res.Body.Close()
+			} else if err == nil {
+				res.Body.Close()
+				t.Fatal("Do succeeded against a self-signed certificate")
+			}
+		})
+	}
+}
+
+func TestTLSConfigIsNotShared(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	cfg := &tls.Config{RootCAs: roots}
+
+	insecure := proxypool.NewProxyAgent(url.URL{}, proxypool.WithTLSConfig(cfg), proxypool.WithInsecureSkipVerify())
+	defer insecure.Close()
+	if cfg.InsecureSkipVerify {
+		t.Fatal("WithInsecureSkipVerify modified the caller's config")
+	}
+	verified := proxypool.NewProxyAgent(url.URL{}, proxypool.WithTLSConfig(cfg))
+	defer verified.Close()
+
+	// Changing the caller's config afterwards affects neither agent.
+	cfg.RootCAs = x509.NewCertPool()
+	for _, a := range []*proxypool.ProxyAgentWithLimiter{insecure, verified} {
+		res, err := a.Do(newRequest(t, http.MethodGet, srv.URL, nil))
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		res.Body.Close()
+	}
+}
+
+func TestHTTPSProxyConnectOverTLS(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("via tls proxy"))
+	}))
+	defer target.Close()
+	proxy := &connectProxy{}
+	proxySrv := httptest.NewTLSServer(proxy)
+	defer proxySrv.Close()
+	proxyURL, err := url.Parse(proxySrv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// httptest servers share one certificate, so one pool trusts both.
+	roots := x509.NewCertPool()
+	roots.AddCert(proxySrv.Certificate())
+
+	agent := proxypool.NewProxyAgent(*proxyURL,
+		proxypool.WithProxyTLSConfig(&tls.Config{RootCAs: roots}),
+		proxypool.WithTLSConfig(&tls.Config{RootCAs: roots}),
+	)
+	defer agent.Close()
+	res, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil))
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if body := readBody(t, res); body != "via tls proxy" {
+		t.Errorf("body = %q", body)
+	}
+	if targets, _ := proxy.seen(); len(targets) != 1 || targets[0] != target.Listener.Addr().String() {
+		t.Errorf("proxy tunnelled to %v, want the target", targets)
+	}
+
+	untrusted := proxypool.NewProxyAgent(*proxyURL,
+		proxypool.WithProxyTLSConfig(&tls.Config{}),
+		proxypool.WithTLSConfig(&tls.Config{RootCAs: roots}),
+	)
+	defer untrusted.Close()
+	if _, err := untrusted.Do(newRequest(t, http.MethodGet, target.URL, nil)); err == nil {
+		t.Error("Do succeeded although the proxy certificate is not trusted")
+	}
+}
+
+func TestDefaultHeaders(t *testing.T) {
+	var got []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Clone())
+	}))
+	defer srv.Close()
+	agents := []*proxypool.ProxyAgentWithLimiter{
+		proxypool.NewProxyAgent(url.URL{}, proxypool.WithDefaultHeaders(http.Header{
+			"User-Agent":      {"profile-1"},
+			"accept-language": {"en-US"},
+		})),
+		proxypool.NewProxyAgent(url.URL{}, proxypool.WithDefaultHeaders(http.Header{
+			"User-Agent":      {"profile-2"},
+			"Accept-Language": {"de-DE"},
+		})),
+	}
+
+	req := newRequest(t, http.MethodGet, srv.URL, nil)
+	req.Header.Set("Accept-Language", "fr-FR")
+	for _, a := range agents {
+		defer a.Close()
+		res, err := a.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	for i, want := range []string{"profile-1", "profile-2"} {
+		if ua := got[i].Get("User-Agent"); ua != want {
+			t.Errorf("agent %d sent User-Agent %q, want %q", i, ua, want)
+		}
+		if lang := got[i].Get("Accept-Language"); lang != "fr-FR" {
+			t.Errorf("agent %d sent Accept-Language %q, want the caller's fr-FR", i, lang)
+		}
+	}
+	if len(req.Header) != 1 {
+		t.Errorf("caller's request was modified: %v", req.Header)
+	}
+}
+
+func TestCookieJarPerAgent(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/challenge" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "solved", Path: "/"})
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "solved" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+	status := func(a proxypool.Agent, path string) int {
+		t.Helper()
+		res, err := a.Do(newRequest(t, http.MethodGet, srv.URL+path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	proxy2 := proxypool.NewProxyAgent(url.URL{}, proxypool.WithCookieJar(nil))
+	defer proxy2.Close()
+	proxy3 := proxypool.NewProxyAgent(url.URL{}, proxypool.WithCookieJar(nil))
+	defer proxy3.Close()
+	proxy2.SetState(proxypool.Ok, "")
+
+	// The challenge goes through the pool, which buffers the body; the
+	// cookie must still land in the agent's jar.
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy2", proxy2)
+	res, err := p.Do(newRequest(t, http.MethodGet, srv.URL+"/challenge", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if got := status(proxy2, "/page"); got != http.StatusOK {
+		t.Errorf("proxy2 status = %d, want 200 with its session cookie", got)
+	}
+	if got := status(proxy3, "/page"); got != http.StatusForbidden {
+		t.Errorf("proxy3 status = %d, want 403 without proxy2's cookie", got)
+	}
+	u, _ := url.Parse(srv.URL)
+	if cookies := proxy2.CookieJar().Cookies(u); len(cookies) != 1 || cookies[0].Value != "solved" {
+		t.Errorf("proxy2 jar = %v, want the session cookie", cookies)
+	}
+
+	proxy2.ClearCookies()
+	if got := status(proxy2, "/page"); got != http.StatusForbidden {
+		t.Errorf("status after ClearCookies = %d, want 403", got)
+	}
+	plain := proxypool.NewProxyAgent(url.URL{})
+	defer plain.Close()
+	if jar := plain.CookieJar(); jar != nil {
+		t.Errorf("agent without WithCookieJar has jar %v", jar)
+	}
+}
+
+func TestUserAgentRotation(t *testing.T) {
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.UserAgent())
+	}))
+	defer srv.Close()
+	uas := []string{"ua-a", "ua-b", "ua-c"}
+	const n = 300
+
+	tests := []struct {
+		name     string
+		provider func() string
+		min, max int
+	}{
+		{"round robin", proxypool.RoundRobinUserAgents(uas...), n / 3, n / 3},
+		{"random", proxypool.RandomUserAgents(uas...), n / 6, n / 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = nil
+			agent := proxypool.NewProxyAgent(url.URL{}, proxypool.WithUserAgentProvider(tt.provider))
+			defer agent.Close()
+			for i := 0; i < n; i++ {
+				res, err := agent.Do(newRequest(t, http.MethodGet, srv.URL, nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+			}
+			counts := map[string]int{}
+			for _, ua := range got {
+				counts[ua]++
+			}
+			if len(counts) != len(uas) {
+				t.Fatalf("user agents sent = %v, want only %v", counts, uas)
+			}
+			for _, ua := range uas {
+				if c := counts[ua]; c < tt.min || c > tt.max {
+					t.Errorf("%s sent %d times, want between %d and %d", ua, c, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestUserAgentProviderKeepsCallerUA(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer srv.Close()
+	agent := proxypool.NewProxyAgent(url.URL{}, proxypool.WithUserAgentProvider(proxypool.RoundRobinUserAgents("rotated")))
+	defer agent.Close()
+
+	req := newRequest(t, http.MethodGet, srv.URL, nil)
+	req.Header.Set("User-Agent", "caller/1.0")
+	res, err := agent.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got != "caller/1.0" {
+		t.Errorf("User-Agent = %q, want the caller's", got)
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/same":
+			http.Redirect(w, r, "/done", http.StatusFound)
+		case "/cross":
+			http.Redirect(w, r, other.URL+"/done", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	sameHost := proxypool.WithRedirectPolicy(func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host != via[0].URL.Host {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	})
+
+	tests := []struct {
+		name     string
+		opt      proxypool.AgentOption
+		path     string
+		status   int
+		location string
+	}{
+		{"default follows", nil, "/cross", http.StatusOK, ""},
+		{"no redirects", proxypool.WithNoRedirects(), "/same", http.StatusFound, "/done"},
+		{"policy follows same host", sameHost, "/same", http.StatusOK, ""},
+		{"policy stops cross host", sameHost, "/cross", http.StatusFound, other.URL + "/done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []proxypool.AgentOption
+			if tt.opt != nil {
+				opts = append(opts, tt.opt)
+			}
+			agent := proxypool.NewProxyAgent(url.URL{}, opts...)
+			agent.SetState(proxypool.Ok, "")
+			var status int
+			var location string
+			p := newTestPool(t, func(c *proxypool.Context) {
+				if c.Response != nil {
+					status, location = c.StatusCode, c.Header.Get("Location")
+				}
+			})
+			addAgent(t, p, "proxy1", agent)
+			res, err := p.Do(newRequest(t, http.MethodGet, srv.URL+tt.path, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if status != tt.status || location != tt.location {
+				t.Errorf("middleware saw %d Location %q, want %d %q", status, location, tt.status, tt.location)
+			}
+		})
+	}
+}
+
+func TestHTTP2Negotiation(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	_, tunnel := newConnectProxy(t)
+
+	tests := []struct {
+		name  string
+		proxy url.URL
+		h2    bool
+		want  string
+	}{
+		{"default", url.URL{}, false, "HTTP/1.1"},
+		{"enabled", url.URL{}, true, "HTTP/2.0"},
+		{"enabled over CONNECT", tunnel, true, "HTTP/2.0"},
+		{"disabled over CONNECT", tunnel, false, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []proxypool.AgentOption{proxypool.WithTLSConfig(&tls.Config{RootCAs: roots})}
+			if tt.h2 {
+				opts = append(opts, proxypool.WithHTTP2(true))
+			}
+			agent := proxypool.NewProxyAgent(tt.proxy, opts...)
+			agent.SetState(proxypool.Ok, "")
+			p := newTestPool(t, nil)
+			addAgent(t, p, "proxy1", agent)
+
+			res, err := p.Do(newRequest(t, http.MethodGet, srv.URL, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get("X-Proto"); got != tt.want {
+				t.Errorf("server saw %s, want %s", got, tt.want)
+			}
+			// The pool rebuilds the response; it must keep the protocol.
+			major, minor, _ := http.ParseHTTPVersion(tt.want)
+			if res.Proto != tt.want || res.ProtoMajor != major || res.ProtoMinor != minor {
+				t.Errorf("response proto = %s (%d.%d), want %s", res.Proto, res.ProtoMajor, res.ProtoMinor, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialContextDialsProxy(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	proxy, real := newConnectProxy(t)
+
+	var mu sync.Mutex
+	var dialed []string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		var d net.Dialer
+		return d.DialContext(ctx, network, real.Host)
+	}
+	agent := proxypool.NewProxyAgent(url.URL{Scheme: "http", Host: "proxy.invalid:3128"},
+		proxypool.WithDialContext(dial),
+		proxypool.WithTLSConfig(&tls.Config{RootCAs: roots}),
+	)
+	defer agent.Close()
+	res, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil))
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	res.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "proxy.invalid:3128" {
+		t.Errorf("dialer called for %v, want only the proxy address", dialed)
+	}
+	targetHost := strings.TrimPrefix(target.URL, "https://")
+	if targets, _ := proxy.seen(); len(targets) != 1 || targets[0] != targetHost {
+		t.Errorf("proxy received CONNECT %v, want %s", targets, targetHost)
+	}
+}
@@ -0,0 +1,56 @@
+package proxypool
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultRetryBackoffBase = 100 * time.Millisecond
+	DefaultRetryBackoffMax  = 2 * time.Second
+)
+
+// WithRetryBackoff sets the delay before each retry. Pools use
+// ExponentialBackoff(DefaultRetryBackoffBase, DefaultRetryBackoffMax) unless
+// configured otherwise; nil retries immediately.
+func WithRetryBackoff(fn func(attempt int) time.Duration) Option {
+	return func(p *Pool) {
+		p.backoff = fn
+	}
+}
+
+const DefaultMinRetryBudget = 100 * time.Millisecond
+
+func WithMinRetryBudget(d time.Duration) Option {
+	return func(p *Pool) {
+		p.minRetryBudget = d
+	}
+}
+
+func ExponentialBackoff(base, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := max
+		if attempt >= 0 && attempt < 62 && base <= max>>uint(attempt) {
+			d = base << uint(attempt)
+		}
+		if d <= 0 {
+			return 0
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
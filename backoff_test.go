@@ -0,0 +1,77 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestExponentialBackoffBounds(t *testing.T) {
+	base, max := 100*time.Millisecond, 2*time.Second
+	backoff := proxypool.ExponentialBackoff(base, max)
+	for attempt := 0; attempt < 100; attempt++ {
+		ceiling := max
+		if attempt < 5 {
+			ceiling = base << attempt
+		}
+		for i := 0; i < 20; i++ {
+			d := backoff(attempt)
+			if d < ceiling/2 || d > ceiling {
+				t.Fatalf("backoff(%d) = %s, want within [%s, %s]", attempt, d, ceiling/2, ceiling)
+			}
+		}
+	}
+}
+
+func TestRetryBackoffBetweenAttempts(t *testing.T) {
+	var calls []int
+	p := newTestPool(t, retryOnFailure, proxypool.WithRetryBackoff(func(attempt int) time.Duration {
+		calls = append(calls, attempt)
+		return time.Millisecond
+	}))
+	addAgents(t, p, 3, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if len(calls) != 2 || calls[0] != 1 || calls[1] != 2 {
+		t.Errorf("backoff called with %v, want [1 2]", calls)
+	}
+}
+
+func TestRetryBackoffInterruptedByCancel(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithRetryBackoff(func(int) time.Duration { return time.Hour }))
+	agents := addAgents(t, p, 2, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancel took %s to interrupt the backoff", elapsed)
+	}
+	if got := totalCalls(agents); got != 1 {
+		t.Errorf("calls = %d, want 1", got)
+	}
+}
+
+func TestDefaultRetryBackoff(t *testing.T) {
+	p := proxypool.New(retryOnFailure, proxypool.WithLogger(proxypool.NopLogger()))
+	defer p.Close()
+	addAgents(t, p, 2, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	start := time.Now()
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if elapsed := time.Since(start); elapsed < proxypool.DefaultRetryBackoffBase/2 {
+		t.Errorf("retry after %s, want the default backoff of at least %s", elapsed, proxypool.DefaultRetryBackoffBase/2)
+	}
+}
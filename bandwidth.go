@@ -0,0 +1,105 @@
+package proxypool
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// newBandwidthLimiter returns a byte rate limiter whose burst covers a tenth
+// of a second, so a throttled transfer never runs far ahead of the cap.
+func newBandwidthLimiter(bytesPerSec int64) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSec), int(max(bytesPerSec/10, 1)))
+}
+
+type bandwidthMeter struct {
+	mu    sync.Mutex
+	start time.Time
+	bytes int64
+	rate  float64
+	last  time.Time
+}
+
+func (m *bandwidthMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.bytes += int64(n)
+	m.last = now
+	if elapsed := now.Sub(m.start); elapsed >= time.Second {
+		m.rate = float64(m.bytes) / elapsed.Seconds()
+		m.start, m.bytes = now, 0
+	}
+}
+
+// current returns the throughput measured over the last full second, or
+// zero once the agent has been idle for longer than that.
+func (m *bandwidthMeter) current() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.last) > 2*time.Second {
+		return 0
+	}
+	return m.rate
+}
+
+func (m *bandwidthMeter) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.start, m.bytes, m.rate, m.last = time.Time{}, 0, 0, time.Time{}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *rate.Limiter
+	meter   *bandwidthMeter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if r.limiter != nil && len(p) > r.limiter.Burst() {
+		p = p[:r.limiter.Burst()]
+	}
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.meter.add(n)
+		if r.limiter != nil {
+			if werr := r.limiter.WaitN(r.ctx, n); werr != nil && err == nil {
+				err = werr
+			}
+		}
+	}
+	return n, err
+}
+
+func (a *ProxyAgentWithLimiter) throttle(ctx context.Context, body io.ReadCloser) io.ReadCloser {
+	return &throttledReader{ReadCloser: body, ctx: ctx, limiter: a.bandwidth, meter: &a.throughput}
+}
+
+// throttleRequest wraps the request body when a bandwidth limit is set. The
+// caller's request is left untouched.
+func (a *ProxyAgentWithLimiter) throttleRequest(req *http.Request) *http.Request {
+	if a.bandwidth == nil || req.Body == nil || req.Body == http.NoBody {
+		return req
+	}
+	ctx := req.Context()
+	req = req.Clone(ctx)
+	req.Body = a.throttle(ctx, req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return a.throttle(ctx, body), nil
+		}
+	}
+	return req
+}
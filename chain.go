@@ -0,0 +1,156 @@
+package proxypool
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+type HopError struct {
+	Hop   int
+	Proxy string
+	Err   error
+}
+
+func (e *HopError) Error() string {
+	return fmt.Sprintf("proxy chain hop %d (%s): %v", e.Hop, e.Proxy, e.Err)
+}
+
+func (e *HopError) Unwrap() error {
+	return e.Err
+}
+
+func NewChainedAgent(hops []url.URL, opts ...AgentOption) (*ProxyAgentWithLimiter, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("proxy chain needs at least one hop")
+	}
+	// Build the chain once here so bad hops are reported by the constructor;
+	// the transport builds it again on top of its configured dialer.
+	if _, err := chainDialer(hops, &net.Dialer{}); err != nil {
+		return nil, err
+	}
+	opts = append([]AgentOption{func(a *ProxyAgentWithLimiter) {
+		a.transport.tunnel = func(first dialFunc) dialFunc {
+			dial, _ := chainDialer(hops, first)
+			return dial
+		}
+	}}, opts...)
+	return NewProxyAgentWithLimiter(hops[len(hops)-1], nil, opts...), nil
+}
+
+// chainDialer tunnels through hops in order, reaching the first one with
+// first.
+func chainDialer(hops []url.URL, first proxy.ContextDialer) (dialFunc, error) {
+	d := first
+	for i := range hops {
+		hop := hops[i]
+		switch hop.Scheme {
+		case "http", "https":
+			d = &hopDialer{hop: i, host: hop.Host, forward: &connectDialer{proxy: hop, forward: d}}
+		case "socks5", "socks5h":
+			var auth *proxy.Auth
+			if hop.User != nil {
+				password, _ := hop.User.Password()
+				auth = &proxy.Auth{User: hop.User.Username(), Password: password}
+			}
+			s, err := proxy.SOCKS5("tcp", hop.Host, auth, contextDialer{d})
+			if err != nil {
+				return nil, &HopError{Hop: i, Proxy: hop.Host, Err: err}
+			}
+			cd, ok := s.(proxy.ContextDialer)
+			if !ok {
+				return nil, &HopError{Hop: i, Proxy: hop.Host, Err: errors.New("socks dialer does not support contexts")}
+			}
+			d = &hopDialer{hop: i, host: hop.Host, forward: cd}
+		default:
+			return nil, &HopError{Hop: i, Proxy: hop.Host, Err: fmt.Errorf("unsupported proxy scheme %q", hop.Scheme)}
+		}
+	}
+	return d.DialContext, nil
+}
+
+type contextDialer struct {
+	proxy.ContextDialer
+}
+
+func (d contextDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+type hopDialer struct {
+	hop     int
+	host    string
+	forward proxy.ContextDialer
+}
+
+func (d *hopDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, network, addr)
+	var hopErr *HopError
+	if err != nil && !errors.As(err, &hopErr) {
+		err = &HopError{Hop: d.hop, Proxy: d.host, Err: err}
+	}
+	return conn, err
+}
+
+type connectDialer struct {
+	proxy   url.URL
+	forward proxy.ContextDialer
+}
+
+func (d *connectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if d.proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: d.proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		password, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		err := fmt.Errorf("CONNECT %s: %s", addr, strings.TrimSpace(res.Status))
+		if res.StatusCode == http.StatusProxyAuthRequired {
+			err = fmt.Errorf("%w: %v", ErrProxyAuth, err)
+		}
+		return nil, &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+	}
+	return conn, nil
+}
@@ -0,0 +1,139 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestChainedAgentThroughTwoProxies(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chained"))
+	}))
+	defer target.Close()
+	first, firstURL := newConnectProxy(t)
+	second, secondURL := newConnectProxy(t)
+
+	agent, err := proxypool.NewChainedAgent([]url.URL{firstURL, secondURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	res, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil))
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if body := readBody(t, res); body != "chained" {
+		t.Errorf("body = %q", body)
+	}
+	targetHost := target.Listener.Addr().String()
+	if got, _ := first.seen(); len(got) != 1 || got[0] != secondURL.Host {
+		t.Errorf("first hop connected to %v, want the second hop %s", got, secondURL.Host)
+	}
+	if got, _ := second.seen(); len(got) != 1 || got[0] != targetHost {
+		t.Errorf("second hop connected to %v, want the target %s", got, targetHost)
+	}
+	if info := agent.Info(); info.Name != secondURL.Host {
+		t.Errorf("Info name = %q, want the last hop", info.Name)
+	}
+}
+
+func TestChainedAgentReportsFailingHop(t *testing.T) {
+	_, firstURL := newConnectProxy(t)
+	second, secondURL := newConnectProxy(t)
+	second.mu.Lock()
+	second.reject = http.StatusForbidden
+	second.mu.Unlock()
+
+	agent, err := proxypool.NewChainedAgent([]url.URL{firstURL, secondURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	_, err = agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	var hopErr *proxypool.HopError
+	if !errors.As(err, &hopErr) {
+		t.Fatalf("err = %v, want a *HopError", err)
+	}
+	if hopErr.Hop != 1 || hopErr.Proxy != secondURL.Host {
+		t.Errorf("failing hop = %d (%s), want 1 (%s)", hopErr.Hop, hopErr.Proxy, secondURL.Host)
+	}
+}
+
+func TestChainedAgentRejectsBadHops(t *testing.T) {
+	if _, err := proxypool.NewChainedAgent(nil); err == nil {
+		t.Error("NewChainedAgent accepted an empty chain")
+	}
+	_, err := proxypool.NewChainedAgent([]url.URL{{Scheme: "ftp", Host: "proxy.invalid:21"}})
+	var hopErr *proxypool.HopError
+	if !errors.As(err, &hopErr) || hopErr.Hop != 0 {
+		t.Errorf("err = %v, want a *HopError for hop 0", err)
+	}
+}
+
+func TestChainedAgentHonoursDialOptions(t *testing.T) {
+	t.Run("dial timeout", func(t *testing.T) {
+		_, secondURL := newConnectProxy(t)
+		agent, err := proxypool.NewChainedAgent(
+			[]url.URL{{Scheme: "http", Host: hangingListener(t)}, secondURL},
+			proxypool.WithDialTimeout(50*time.Millisecond),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer agent.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		_, err = agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+		if err == nil {
+			t.Fatal("Do succeeded through a hop that never answers")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Do took %s, want the 50ms dial timeout to end it", elapsed)
+		}
+		if ctx.Err() != nil {
+			t.Errorf("err = %v, want the dial timeout rather than the request deadline", err)
+		}
+	})
+	t.Run("dial context", func(t *testing.T) {
+		target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		defer target.Close()
+		_, firstURL := newConnectProxy(t)
+		var mu sync.Mutex
+		var dialed []string
+		dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, network, firstURL.Host)
+		}
+		agent, err := proxypool.NewChainedAgent(
+			[]url.URL{{Scheme: "http", Host: "proxy.invalid:3128"}},
+			proxypool.WithDialContext(dial),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer agent.Close()
+		res, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil))
+		if err != nil {
+			t.Fatalf("Do: %v", err)
+		}
+		res.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		if len(dialed) != 1 || dialed[0] != "proxy.invalid:3128" {
+			t.Errorf("dialer called for %v, want only the first hop", dialed)
+		}
+	})
+}
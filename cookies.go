@@ -0,0 +1,58 @@
+package proxypool
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"sync"
+)
+
+type agentJar struct {
+	mu  sync.RWMutex
+	jar http.CookieJar
+}
+
+func newAgentJar(jar http.CookieJar) *agentJar {
+	if jar == nil {
+		jar, _ = cookiejar.New(nil)
+	}
+	return &agentJar{jar: jar}
+}
+
+func (j *agentJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	j.jar.SetCookies(u, cookies)
+}
+
+func (j *agentJar) Cookies(u *url.URL) []*http.Cookie {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.jar.Cookies(u)
+}
+
+func (j *agentJar) current() http.CookieJar {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.jar
+}
+
+func (j *agentJar) clear() {
+	jar, _ := cookiejar.New(nil)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.jar = jar
+}
+
+func (a *ProxyAgentWithLimiter) CookieJar() http.CookieJar {
+	if a.transport.jar == nil {
+		return nil
+	}
+	return a.transport.jar.current()
+}
+
+func (a *ProxyAgentWithLimiter) ClearCookies() {
+	if a.transport.jar != nil {
+		a.transport.jar.clear()
+	}
+}
@@ -0,0 +1,69 @@
+package proxypool
+
+import (
+	"fmt"
+	"time"
+)
+
+// Byte counters cover request and response bodies only. Headers, TLS and
+// proxy handshakes are not counted, and streamed responses (see
+// StreamResponse) are not counted on the receiving side since the pool never
+// reads their body.
+func (m *member) countBytes(sent, received int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesSent += sent
+	m.bytesReceived += received
+}
+
+func (m *member) Bytes() (sent, received int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.bytesSent, m.bytesReceived
+}
+
+func (m *member) ResetCounters() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesSent = 0
+	m.bytesReceived = 0
+}
+
+func (p *Pool) ResetCounters(name string) error {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	m.ResetCounters()
+	return nil
+}
+
+type StatsResetter interface {
+	ResetStats()
+}
+
+func (m *member) ResetStats() {
+	if r, ok := agentAs[StatsResetter](m.Agent); ok {
+		r.ResetStats()
+	}
+	m.stats.reset()
+	m.mu.Lock()
+	m.bytesSent = 0
+	m.bytesReceived = 0
+	m.latencyEWMA = 0
+	m.latency = latencySamples{}
+	m.recentErrors = errorRing{}
+	m.timeInState = nil
+	m.stateSince = time.Now()
+	m.failures = 0
+	m.mu.Unlock()
+	m.pool.emit(Event{Type: EventStatsReset, Agent: m.Name()})
+}
+
+func (p *Pool) ResetStats() {
+	for _, m := range p.members() {
+		m.ResetStats()
+	}
+}
@@ -0,0 +1,109 @@
+package proxypool_test
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestResetStatsRacingRequests(t *testing.T) {
+	p := newTestPool(t, nil)
+	agents := []*proxypool.ProxyAgentWithLimiter{newTransportAgent(), newTransportAgent()}
+	for i, a := range agents {
+		a.SetState(proxypool.Ok, "")
+		addAgent(t, p, []string{"a", "b"}[i], a)
+	}
+	do := func(n int) {
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				readBody(t, res)
+			}()
+		}
+		wg.Wait()
+	}
+	stop := make(chan struct{})
+	resetting := make(chan struct{})
+	go func() {
+		defer close(resetting)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				p.ResetStats()
+			}
+		}
+	}()
+	do(200)
+	close(stop)
+	<-resetting
+
+	events, unsubscribe := p.Subscribe()
+	defer unsubscribe()
+	p.ResetStats()
+	resets := map[string]bool{}
+	for len(resets) < len(agents) {
+		select {
+		case e := <-events:
+			if e.Type == proxypool.EventStatsReset {
+				resets[e.Agent] = true
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stats reset events = %v, want one per agent", resets)
+		}
+	}
+	for _, info := range p.Status() {
+		if info.Requests != 0 || info.BytesSent != 0 || info.BytesReceived != 0 {
+			t.Errorf("%s counters after reset = %d requests, %d/%d bytes", info.Name, info.Requests, info.BytesSent, info.BytesReceived)
+		}
+		if info.AvgLatencyMs != 0 || info.LastLatencyMs != 0 || info.LatencySamples != 0 ||
+			info.LatencyEWMA != "0s" || info.LatencyP50 != "0s" || info.LatencyP95 != "0s" || info.LatencyP99 != "0s" {
+			t.Errorf("%s latency after reset = %+v", info.Name, info)
+		}
+		if info.Throughput != 0 {
+			t.Errorf("%s throughput after reset = %v", info.Name, info.Throughput)
+		}
+		if info.SuccessRate1m != 1 || info.SuccessRate10m != 1 {
+			t.Errorf("%s success rates after reset = %v/%v, want 1 for an empty window", info.Name, info.SuccessRate1m, info.SuccessRate10m)
+		}
+	}
+	for _, a := range agents {
+		if !a.LastCompletedTime().IsZero() {
+			t.Errorf("last completed time after reset = %s", a.LastCompletedTime())
+		}
+	}
+
+	const n = 50
+	do(n)
+	var requests int
+	var received int64
+	for _, info := range p.Status() {
+		requests += info.Requests
+		received += info.BytesReceived
+		if info.InFlight != 0 {
+			t.Errorf("%s in flight = %d after all requests finished", info.Name, info.InFlight)
+		}
+	}
+	if requests != n {
+		t.Errorf("requests after reset = %d, want %d", requests, n)
+	}
+	if received != n*int64(len("ok")) {
+		t.Errorf("bytes received after reset = %d, want %d", received, n*len("ok"))
+	}
+	for _, a := range agents {
+		if s := a.State().State; s != proxypool.Ok {
+			t.Errorf("state after reset = %s, want it untouched", s)
+		}
+	}
+}
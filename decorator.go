@@ -0,0 +1,99 @@
+package proxypool
+
+import (
+	"net/http"
+	"time"
+)
+
+// decorator delegates every Agent method to the wrapped agent, along with the
+// optional interfaces the pool relies on for bookkeeping. Info, and therefore
+// Info.Name, is passed through unchanged. Other optional capabilities such as
+// Pauser or RateSetter are found through Unwrap by agentAs.
+type decorator struct {
+	Agent
+}
+
+func (d decorator) Unwrap() Agent {
+	return d.Agent
+}
+
+func (d decorator) InFlight() int {
+	if f, ok := d.Agent.(interface{ InFlight() int }); ok {
+		return f.InFlight()
+	}
+	return 0
+}
+
+func (d decorator) Limited() bool {
+	return limited(d.Agent)
+}
+
+func (d decorator) ReportOutcome(success bool) {
+	reportOutcome(d.Agent, success)
+}
+
+func (d decorator) NotifyStateChange(fn func(StateReport)) {
+	if n, ok := d.Agent.(StateNotifier); ok {
+		n.NotifyStateChange(fn)
+	}
+}
+
+func (d decorator) SuspendUntil(t time.Time, msg string) {
+	if s, ok := d.Agent.(Suspender); ok {
+		s.SuspendUntil(t, msg)
+		return
+	}
+	d.Agent.SetState(Unavailable, msg)
+}
+
+type loggingAgent struct {
+	decorator
+	logger Logger
+}
+
+func WrapWithLogging(a Agent, logger Logger) Agent {
+	if logger == nil {
+		logger = NopLogger()
+	}
+	return &loggingAgent{decorator: decorator{a}, logger: logger}
+}
+
+func (a *loggingAgent) Do(req *http.Request) (*http.Response, error) {
+	name := AgentName(a.Agent)
+	a.logger.Debugf("agent %s: %s %s", name, req.Method, req.URL.Redacted())
+	start := time.Now()
+	res, err := a.Agent.Do(req)
+	latency := time.Since(start).Truncate(time.Millisecond)
+	if err != nil {
+		a.logger.Warnf("agent %s: %s %s failed after %s: %v", name, req.Method, req.URL.Redacted(), latency, err)
+		return res, err
+	}
+	a.logger.Debugf("agent %s: %s %s -> %d in %s", name, req.Method, req.URL.Redacted(), res.StatusCode, latency)
+	return res, err
+}
+
+type metricsAgent struct {
+	decorator
+	recorder Recorder
+}
+
+func WrapWithMetrics(a Agent, recorder Recorder) Agent {
+	return &metricsAgent{decorator: decorator{a}, recorder: recorder}
+}
+
+func (a *metricsAgent) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := a.Agent.Do(req)
+	record := AttemptRecord{Agent: AgentName(a.Agent), Latency: time.Since(start), Err: err}
+	if req.ContentLength > 0 {
+		record.BytesSent = req.ContentLength
+	}
+	if res != nil {
+		record.StatusCode = res.StatusCode
+		if res.ContentLength > 0 {
+			record.BytesReceived = res.ContentLength
+		}
+	}
+	a.recorder.RecordAttempt(record)
+	return res, err
+}
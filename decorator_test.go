@@ -0,0 +1,163 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// trace collects events from the stacked decorators in the order they
+// happen.
+type trace struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (t *trace) add(s string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, s)
+}
+
+func (t *trace) Debugf(format string, args ...any) { t.add("log " + fmt.Sprintf(format, args...)) }
+func (t *trace) Infof(format string, args ...any)  { t.add("log " + fmt.Sprintf(format, args...)) }
+func (t *trace) Warnf(format string, args ...any)  { t.add("warn " + fmt.Sprintf(format, args...)) }
+
+func (t *trace) RecordAttempt(r proxypool.AttemptRecord) {
+	t.add(fmt.Sprintf("metrics %s %d err=%v", r.Agent, r.StatusCode, r.Err != nil))
+}
+
+func (t *trace) RecordRetry(agent string) {}
+
+func TestDecoratorsStackedOverMockAgent(t *testing.T) {
+	tr := &trace{}
+	mock := testutil.NewMockAgent("proxy1").
+		EnqueueError(io.ErrUnexpectedEOF).
+		HandleFunc(func(*http.Request) (*http.Response, error) {
+			tr.add("agent")
+			return testutil.NewResponse(http.StatusOK, "ok"), nil
+		})
+	wrapped := proxypool.WrapWithMetrics(proxypool.WrapWithLogging(mock, tr), tr)
+
+	if _, err := wrapped.Do(newRequest(t, http.MethodGet, "http://example.com/a", nil)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want the agent's error passed through", err)
+	}
+	res, err := wrapped.Do(newRequest(t, http.MethodGet, "http://example.com/b", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, res); body != "ok" {
+		t.Errorf("body = %q", body)
+	}
+	want := []string{
+		"log agent proxy1: GET http://example.com/a",
+		"warn agent proxy1: GET http://example.com/a failed",
+		"metrics proxy1 0 err=true",
+		"log agent proxy1: GET http://example.com/b",
+		"agent",
+		"log agent proxy1: GET http://example.com/b -> 200",
+		"metrics proxy1 200 err=false",
+	}
+	if len(tr.events) != len(want) {
+		t.Fatalf("events = %q, want %d", tr.events, len(want))
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(tr.events[i], prefix) {
+			t.Errorf("event %d = %q, want prefix %q", i, tr.events[i], prefix)
+		}
+	}
+
+	// Everything but Do reaches the mock untouched.
+	if info := wrapped.Info(); info.Name != "proxy1" || info.Requests != 2 {
+		t.Errorf("Info = %s with %d requests, want the mock's", info.Name, info.Requests)
+	}
+	if !wrapped.LastRequestTime().Equal(mock.LastRequestTime()) {
+		t.Error("LastRequestTime is not the mock's")
+	}
+	var notified []proxypool.State
+	wrapped.(proxypool.StateNotifier).NotifyStateChange(func(r proxypool.StateReport) {
+		notified = append(notified, r.State)
+	})
+	wrapped.SetState(proxypool.Banned, "403")
+	if mock.State().State != proxypool.Banned || fmt.Sprint(notified) != "[BANNED]" {
+		t.Errorf("mock state = %s, notified %v; want BANNED through the wrappers", mock.State().State, notified)
+	}
+	wrapped.Close()
+	if !mock.Closed() {
+		t.Error("Close did not reach the mock")
+	}
+}
+
+func TestDecoratedAgentInPool(t *testing.T) {
+	mock := statusAgent("proxy1", http.StatusOK)
+	logger := &captureLogger{}
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", proxypool.WrapWithLogging(mock, logger))
+
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if mock.Calls() != 1 || !logger.contains("-> 200") {
+		t.Errorf("calls = %d, logs %q", mock.Calls(), logger.msgs)
+	}
+	if status := p.Status(); len(status) != 1 || status[0].Name != "proxy1" || status[0].Requests != 1 {
+		t.Errorf("status = %+v, want proxy1 with one request", status)
+	}
+}
+
+func TestDecoratedProxyAgentCapabilities(t *testing.T) {
+	var probes atomic.Int64
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	limiter.Allow()
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter)
+	agent.SetState(proxypool.Ok, "")
+	tr := &trace{}
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", proxypool.WrapWithMetrics(proxypool.WrapWithLogging(agent, tr), tr))
+
+	if err := p.Pause("proxy1"); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if s := agent.State().State; s != proxypool.Paused {
+		t.Errorf("state after Pause = %s, want PAUSED", s)
+	}
+	if err := p.Resume("proxy1"); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	// Health checks probe past the limiter, whose only token is spent.
+	if _, err := p.CheckAgent(context.Background(), "proxy1", "http://example.com/health"); err != nil {
+		t.Fatalf("CheckAgent: %v", err)
+	}
+	if s := agent.StoredState(); s.State != proxypool.Ok || probes.Load() != 1 {
+		t.Errorf("health check = %s %q after %d probes, want OK from one probe", s.State, s.Message, probes.Load())
+	}
+
+	if err := p.SetRate("proxy1", rate.Every(time.Millisecond), 3); err != nil {
+		t.Fatalf("SetRate: %v", err)
+	}
+	if b := limiter.Burst(); b != 3 {
+		t.Errorf("burst = %d, want 3", b)
+	}
+	status := p.Status()
+	if len(status) != 1 || status[0].Tokens == nil {
+		t.Errorf("status = %+v, want the wrapped agent's tokens", status)
+	}
+}
@@ -0,0 +1,24 @@
+package proxypool
+
+import "net/url"
+
+var _ Agent = (*DirectAgent)(nil)
+
+type DirectAgent struct {
+	*ProxyAgentWithLimiter
+}
+
+func NewDirectAgent(opts ...AgentOption) *DirectAgent {
+	return &DirectAgent{NewProxyAgentWithLimiter(url.URL{}, nil, opts...)}
+}
+
+func (a *DirectAgent) Info() Info {
+	info := a.ProxyAgentWithLimiter.Info()
+	info.Name = "direct"
+	info.Scheme = "direct"
+	return info
+}
+
+func (a *DirectAgent) Fallback() bool {
+	return true
+}
@@ -0,0 +1,54 @@
+package proxypool_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestDirectAgentIsLastResort(t *testing.T) {
+	var directHits, proxyHits int64
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&directHits, 1)
+	}))
+	defer target.Close()
+
+	p := newTestPool(t, nil)
+	for _, name := range []string{"a", "b"} {
+		proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&proxyHits, 1)
+		})
+		agent := proxypool.NewProxyAgentWithLimiter(proxy, rate.NewLimiter(rate.Every(time.Hour), 1))
+		agent.SetState(proxypool.Ok, "")
+		addAgent(t, p, name, agent)
+	}
+	direct := proxypool.NewDirectAgent()
+	direct.SetState(proxypool.Ok, "")
+	addAgent(t, p, "direct", direct)
+
+	for i := 1; i <= 4; i++ {
+		res, err := p.Do(newRequest(t, http.MethodGet, target.URL, nil))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		res.Body.Close()
+		wantProxy, wantDirect := int64(i), int64(0)
+		if i > 2 {
+			wantProxy, wantDirect = 2, int64(i-2)
+		}
+		if proxyHits != wantProxy || directHits != wantDirect {
+			t.Fatalf("after request %d: proxy=%d direct=%d, want %d and %d", i, proxyHits, directHits, wantProxy, wantDirect)
+		}
+	}
+
+	info := direct.Info()
+	if info.Name != "direct" || info.Scheme != "direct" {
+		t.Errorf("Info name/scheme = %q/%q, want direct", info.Name, info.Scheme)
+	}
+}
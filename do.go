@@ -0,0 +1,482 @@
+package proxypool
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoHealthyAgents   = fmt.Errorf("no healthy agents")
+	ErrPinnedAgentFailed = fmt.Errorf("pinned agent failed")
+)
+
+type Context struct {
+	*http.Response
+	Err             error
+	ErrClass        ErrClass
+	Agent           Agent
+	Retry           bool
+	Body            []byte
+	BudgetExhausted bool
+
+	stream     *lockedBody
+	endAttempt func(AttemptEnd)
+	skipped    bool
+}
+
+var ErrBodyTooLarge = errors.New("response body too large")
+
+func WithMaxBodySize(n int64) Option {
+	return func(p *Pool) {
+		p.maxBodySize = n
+	}
+}
+
+func (cl *call) newContext(agent Agent, res *http.Response, err error) (*Context, error) {
+	if err != nil {
+		return &Context{
+			Response: nil,
+			Err:      err,
+			ErrClass: ClassifyError(err),
+			Agent:    agent,
+			Body:     nil,
+		}, nil
+	}
+	if res == nil {
+		return nil, errors.New("response is nil but error is also nil")
+	}
+	if cl.streaming {
+		body := &lockedBody{ReadCloser: res.Body}
+		res.Body = body
+		return &Context{
+			Response: res,
+			Agent:    agent,
+			stream:   body,
+		}, nil
+	}
+	defer res.Body.Close()
+	var body io.Reader = res.Body
+	if limit := cl.pool.maxBodySize; limit > 0 {
+		body = io.LimitReader(res.Body, limit+1)
+	}
+	bodyBytes, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if limit := cl.pool.maxBodySize; limit > 0 && int64(len(bodyBytes)) > limit {
+		return &Context{
+			Response: res,
+			Err:      fmt.Errorf("%w: exceeds %d bytes", ErrBodyTooLarge, limit),
+			ErrClass: ErrClassOther,
+			Agent:    agent,
+		}, nil
+	}
+	return &Context{
+		Response: res,
+		Err:      nil,
+		Agent:    agent,
+		Body:     bodyBytes,
+	}, nil
+}
+
+func (c *Context) attempt(name string) Attempt {
+	a := Attempt{Agent: name, Err: c.Err}
+	if c.Response != nil {
+		a.StatusCode = c.StatusCode
+	}
+	return a
+}
+
+func (c *Context) finishAttempt() {
+	if c.endAttempt == nil {
+		return
+	}
+	e := AttemptEnd{Retry: c.Retry, Err: c.Err, ErrClass: c.ErrClass}
+	if c.Response != nil {
+		e.StatusCode = c.StatusCode
+	}
+	c.endAttempt(e)
+	c.endAttempt = nil
+}
+
+func (c *Context) discard() {
+	if c.stream != nil {
+		c.stream.Close()
+	}
+}
+
+func (c *Context) response() *http.Response {
+	if c.stream != nil {
+		c.stream.unlocked = true
+		return c.Response
+	}
+	res := &http.Response{
+		Status:           c.Status,
+		StatusCode:       c.StatusCode,
+		Proto:            c.Proto,
+		ProtoMajor:       c.ProtoMajor,
+		ProtoMinor:       c.ProtoMinor,
+		Header:           c.Header.Clone(),
+		ContentLength:    c.ContentLength,
+		TransferEncoding: c.TransferEncoding,
+		Close:            false,
+		Uncompressed:     c.Uncompressed,
+		Trailer:          c.Trailer.Clone(),
+		Request:          c.Request,
+	}
+	res.Body = io.NopCloser(bytes.NewReader(c.Body))
+	return res
+}
+
+type call struct {
+	pool         *Pool
+	req          *http.Request
+	bodyBytes    []byte
+	middlewares  []func(c *Context)
+	requestHooks []func(req *http.Request, a Agent)
+	pinned       bool
+	retryable    bool
+	limit        string
+	streaming    bool
+	attempts     []Attempt
+	recorders    []Recorder
+	tries        int
+	agent        string
+}
+
+type Result struct {
+	Agent    string
+	Attempts int
+	Latency  time.Duration
+}
+
+func (p *Pool) Do(req *http.Request) (*http.Response, error) {
+	res, _, err := p.DoResult(req)
+	return res, err
+}
+
+func (p *Pool) DoResult(req *http.Request) (*http.Response, Result, error) {
+	return p.do(req, nil)
+}
+
+func (p *Pool) do(req *http.Request, g *Group) (*http.Response, Result, error) {
+	start := time.Now()
+	cl := &call{
+		pool:         p,
+		req:          req,
+		middlewares:  p.getMiddlewares(),
+		requestHooks: p.getRequestHooks(),
+		recorders:    p.getRecorders(),
+		retryable:    isRetryable(req),
+		limit:        "unlimited",
+		streaming:    p.streaming || isStreaming(req.Context()),
+	}
+	var end func(CallEnd)
+	if t := p.tracer; t != nil {
+		var ctx context.Context
+		ctx, end = t.StartCall(req.Context(), req)
+		cl.req = req.WithContext(ctx)
+	}
+	res, err := cl.run(g)
+	if end != nil {
+		end(CallEnd{Agent: cl.agent, Attempts: cl.tries, Err: err})
+	}
+	return res, Result{Agent: cl.agent, Attempts: cl.tries, Latency: time.Since(start)}, err
+}
+
+func (cl *call) run(g *Group) (*http.Response, error) {
+	p, req := cl.pool, cl.req
+	leave, err := p.enter(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer leave()
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		bodyBytes, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		cl.bodyBytes = bodyBytes
+	}
+	if p.maxRetry > 0 {
+		cl.limit = fmt.Sprint(p.maxRetry)
+	}
+	_, cl.pinned = pinnedAgent(req.Context())
+	if g != nil {
+		cl.middlewares = g.getMiddlewares()
+	}
+	if err := p.acquire(req.Context()); err != nil {
+		return nil, err
+	}
+	agents, err := cl.waitForAgents(g)
+	if err != nil {
+		return nil, err
+	}
+	if p.hedgeDelay > 0 && p.hedgeParallel > 1 && !cl.pinned && !cl.streaming {
+		return cl.hedged(agents)
+	}
+	return cl.sequential(agents)
+}
+
+func (cl *call) newRequest(ctx context.Context) (*http.Request, error) {
+	tmp := cl.req.Clone(ctx)
+	switch {
+	case cl.bodyBytes != nil:
+		tmp.Body = io.NopCloser(bytes.NewReader(cl.bodyBytes))
+		tmp.ContentLength = int64(len(cl.bodyBytes))
+		tmp.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(cl.bodyBytes)), nil
+		}
+	case cl.req.GetBody != nil && cl.req.Body != nil && cl.req.Body != http.NoBody:
+		body, err := cl.req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get request body: %w", err)
+		}
+		tmp.Body = body
+	}
+	return tmp, nil
+}
+
+func (cl *call) exhausted(i int) bool {
+	return cl.pool.maxRetry > 0 && i+1 > cl.pool.maxRetry
+}
+
+func (cl *call) logAttempt(i int, name string) {
+	cl.tries++
+	if i+1 > 1 {
+		cl.pool.logger.Infof("retry #%d/%s for %s with agent %s", i+1, cl.limit, cl.req.URL.Host, name)
+	} else {
+		cl.pool.logger.Debugf("try #%d/%s for %s with agent %s", i+1, cl.limit, cl.req.URL.Host, name)
+	}
+}
+
+func (cl *call) sequential(agents []Agent) (*http.Response, error) {
+	ctx := cl.req.Context()
+	attempt, wait := 0, false
+	for _, selected := range agents {
+		name := AgentName(selected)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if cl.exhausted(attempt) {
+			cl.pool.logger.Warnf("max retry (%s) reached for %s, next agent %s", cl.limit, cl.req.URL.Host, name)
+			break
+		}
+		if wait && cl.pool.backoff != nil {
+			if err := sleepContext(ctx, cl.pool.backoff(attempt)); err != nil {
+				return nil, err
+			}
+		}
+		cl.logAttempt(attempt, name)
+		c, err := cl.roundTrip(ctx, selected)
+		if err != nil {
+			return nil, err
+		}
+		if c.skipped {
+			if err := cl.skip(c, name); err != nil {
+				return nil, err
+			}
+			wait = false
+			continue
+		}
+		attempt++
+		wait = true
+		if res, err, done := cl.verdict(c, selected); done {
+			return res, err
+		}
+	}
+	return cl.failed()
+}
+
+func (cl *call) roundTrip(ctx context.Context, selected Agent) (*Context, error) {
+	a := unwrap(selected)
+	var end func(AttemptEnd)
+	if t := cl.pool.tracer; t != nil {
+		ctx, end = t.StartAttempt(ctx, AgentName(selected), a.Info().Name)
+	}
+	c, err := cl.send(ctx, selected, a)
+	if end != nil {
+		if err != nil {
+			end(AttemptEnd{Err: err, ErrClass: ClassifyError(err)})
+		} else {
+			c.endAttempt = end
+		}
+	}
+	return c, err
+}
+
+func (cl *call) send(ctx context.Context, selected, a Agent) (*Context, error) {
+	r, err := cl.newRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range cl.requestHooks {
+		fn(r, selected)
+	}
+	name := AgentName(selected)
+	atomic.AddUint64(&cl.pool.totalRequests, 1)
+	cl.pool.emit(Event{Type: EventRequestStarted, Agent: name, Detail: r.URL.Host})
+	start := time.Now()
+	res, err := a.Do(r)
+	if declined(err) {
+		atomic.AddUint64(&cl.pool.totalRequests, ^uint64(0))
+		cl.pool.emit(Event{Type: EventRequestFinished, Agent: name, Detail: r.URL.Host, Err: err})
+		return &Context{Err: err, ErrClass: ErrClassOther, Agent: a, skipped: true}, nil
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		if res != nil {
+			res.Body.Close()
+			reportOutcome(a, false)
+		}
+		return nil, ctxErr
+	}
+	if errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	transportErr := err
+	c, err := cl.newContext(a, res, err)
+	if err != nil {
+		if res != nil {
+			reportOutcome(a, false)
+		}
+		return nil, err
+	}
+	latency := time.Since(start)
+	if m, ok := selected.(*member); ok && transportErr == nil {
+		m.observeLatency(latency)
+	}
+	finished := Event{Type: EventRequestFinished, Agent: name, Detail: r.URL.Host, Latency: latency, Err: c.Err}
+	if c.Response != nil {
+		finished.StatusCode = c.StatusCode
+	}
+	cl.pool.emit(finished)
+	record := AttemptRecord{
+		Agent:         name,
+		StatusCode:    finished.StatusCode,
+		Latency:       latency,
+		Err:           c.Err,
+		BytesReceived: int64(len(c.Body)),
+	}
+	if cl.bodyBytes != nil {
+		record.BytesSent = int64(len(cl.bodyBytes))
+	} else if r.ContentLength > 0 {
+		record.BytesSent = r.ContentLength
+	}
+	if m, ok := selected.(*member); ok {
+		m.countBytes(record.BytesSent, record.BytesReceived)
+	}
+	for _, rec := range cl.recorders {
+		rec.RecordAttempt(record)
+	}
+	return c, nil
+}
+
+// declined reports whether the agent turned the request down before sending
+// it. The pool moves on to the next agent without running the middlewares
+// or counting a failed attempt.
+func declined(err error) bool {
+	return errors.Is(err, ErrHostRateLimited) || errors.Is(err, ErrAgentBusy) || errors.Is(err, ErrAgentPaused)
+}
+
+// skip handles an attempt the agent declined. Pinned calls have no other
+// agent to move on to, so they fail with the agent's error.
+func (cl *call) skip(c *Context, name string) error {
+	c.finishAttempt()
+	cl.tries--
+	cl.pool.logger.Debugf("agent %s declined request for %s: %v", name, cl.req.URL.Host, c.Err)
+	if cl.pinned {
+		return fmt.Errorf("pinned agent %s: %w", name, c.Err)
+	}
+	return nil
+}
+
+func (cl *call) budgetExhausted() bool {
+	deadline, ok := cl.req.Context().Deadline()
+	return ok && time.Until(deadline) < cl.pool.minRetryBudget
+}
+
+func (cl *call) verdict(c *Context, selected Agent) (*http.Response, error, bool) {
+	name := AgentName(selected)
+	c.BudgetExhausted = cl.budgetExhausted()
+	cl.agent = name
+	for _, fn := range cl.middlewares {
+		fn(c)
+	}
+	c.finishAttempt()
+	if m, ok := selected.(*member); ok {
+		success := c.Err == nil && !c.Retry
+		m.stats.record(success)
+		if !success {
+			m.recordError(c)
+		}
+		if c.Response != nil {
+			reportOutcome(m.Agent, success)
+		}
+		if !c.BudgetExhausted {
+			cl.pool.recordOutcome(m, success)
+		}
+	}
+	if c.Retry && (cl.pinned || cl.retryable) {
+		c.discard()
+	}
+	if c.Retry && cl.pinned {
+		if c.Err != nil {
+			return nil, fmt.Errorf("pinned agent %s: %w", name, c.Err), true
+		}
+		return nil, fmt.Errorf("%w: %s (%s)", ErrPinnedAgentFailed, name, c.Agent.State()), true
+	}
+	if c.Retry && !cl.retryable {
+		if c.Err != nil {
+			return nil, c.Err, true
+		}
+		return c.response(), nil, true
+	}
+	if c.Retry {
+		cl.attempts = append(cl.attempts, c.attempt(name))
+		atomic.AddUint64(&cl.pool.totalRetries, 1)
+		for _, rec := range cl.recorders {
+			rec.RecordRetry(name)
+		}
+		cl.pool.emit(Event{Type: EventRetry, Agent: name, Detail: cl.req.URL.Host, StatusCode: cl.attempts[len(cl.attempts)-1].StatusCode, Err: c.Err})
+		if c.BudgetExhausted {
+			if c.Err != nil {
+				return nil, c.Err, true
+			}
+			res, err := cl.failed()
+			return res, err, true
+		}
+		return nil, nil, false
+	}
+	if c.Err != nil {
+		c.discard()
+		return nil, c.Err, true
+	}
+	return c.response(), nil, true
+}
+
+func (cl *call) failed() (*http.Response, error) {
+	if len(cl.attempts) > 0 {
+		return nil, &AttemptsError{Attempts: cl.attempts}
+	}
+	return nil, ErrNoHealthyAgents
+}
+
+var _ http.RoundTripper = (*Pool)(nil)
+
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+	res, err := p.Do(req.Clone(req.Context()))
+	if err != nil {
+		return nil, err
+	}
+	res.Request = req
+	return res, nil
+}
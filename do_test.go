@@ -0,0 +1,191 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestMaxRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxRetry int
+		agents   int
+		want     int
+	}{
+		{"default", proxypool.MaxRetry, 6, proxypool.MaxRetry},
+		{"capped", 2, 6, 2},
+		{"unlimited", 0, 6, 6},
+		{"larger than pool", 10, 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(t, retryOnFailure, proxypool.WithMaxRetry(tt.maxRetry))
+			agents := addAgents(t, p, tt.agents, func(name string) *testutil.MockAgent {
+				return statusAgent(name, http.StatusBadGateway)
+			})
+			_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			var attempts *proxypool.AttemptsError
+			if !errors.As(err, &attempts) {
+				t.Fatalf("err = %v, want *AttemptsError", err)
+			}
+			if len(attempts.Attempts) != tt.want {
+				t.Errorf("attempts = %d, want %d", len(attempts.Attempts), tt.want)
+			}
+			if got := totalCalls(agents); got != tt.want {
+				t.Errorf("calls = %d, want %d", got, tt.want)
+			}
+			for _, a := range agents {
+				if a.Calls() > 1 {
+					t.Errorf("agent %s called %d times", a.Info().Name, a.Calls())
+				}
+			}
+		})
+	}
+}
+
+func TestMaxRetryLogsLimit(t *testing.T) {
+	logger := &captureLogger{}
+	p := newTestPool(t, retryOnFailure, proxypool.WithMaxRetry(10), proxypool.WithLogger(logger))
+	addAgents(t, p, 2, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if !logger.contains("retry #2/10") {
+		t.Errorf("retry log does not mention the limit: %q", logger.msgs)
+	}
+}
+
+func TestDoStopsWhenContextExpires(t *testing.T) {
+	var middlewareCalls int
+	markError := func(c *proxypool.Context) {
+		middlewareCalls++
+		if c.Err != nil {
+			c.Agent.SetState(proxypool.Error, c.Err.Error())
+			c.Retry = true
+		}
+	}
+	p := newTestPool(t, markError, proxypool.WithStrategy(proxypool.RoundRobin()))
+	slow := testutil.NewMockAgent("a-slow").HandleFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	next := statusAgent("b-next", http.StatusOK)
+	addAgent(t, p, "a-slow", slow)
+	addAgent(t, p, "b-next", next)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if slow.Calls() != 1 || next.Calls() != 0 {
+		t.Errorf("calls: slow=%d next=%d, want 1 and 0", slow.Calls(), next.Calls())
+	}
+	if middlewareCalls != 0 {
+		t.Errorf("middleware ran %d times after expiry", middlewareCalls)
+	}
+	for _, a := range []*testutil.MockAgent{slow, next} {
+		if s := a.State().State; s != proxypool.Ok {
+			t.Errorf("agent %s state = %s, want OK", a.Info().Name, s)
+		}
+	}
+}
+
+func TestDoStopsWhenContextExpiresDuringBackoff(t *testing.T) {
+	p := newTestPool(t, retryOnFailure,
+		proxypool.WithMinRetryBudget(0),
+		proxypool.WithRetryBackoff(func(int) time.Duration { return time.Second }),
+	)
+	agents := addAgents(t, p, 3, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Do returned after %s, backoff was not interrupted", elapsed)
+	}
+	if got := totalCalls(agents); got != 1 {
+		t.Errorf("calls = %d, want 1", got)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var middlewareErr error
+	p := newTestPool(t, func(c *proxypool.Context) {
+		if middlewareErr == nil {
+			middlewareErr = c.Err
+		}
+		retryOnFailure(c)
+	}, proxypool.WithMaxBodySize(1<<20), proxypool.WithStrategy(proxypool.RoundRobin()))
+	addAgent(t, p, "a", largeBodyAgent("a", 1<<30))
+	addAgent(t, p, "b", largeBodyAgent("b", 1<<10))
+
+	before := totalAlloc()
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readBody(t, res)); n != 1<<10 || result.Agent != "b" {
+		t.Errorf("got %d bytes from %s, want the small body from b", n, result.Agent)
+	}
+	if allocated := totalAlloc() - before; allocated > 32<<20 {
+		t.Errorf("oversized body allocated %d bytes", allocated)
+	}
+	if !errors.Is(middlewareErr, proxypool.ErrBodyTooLarge) {
+		t.Errorf("middleware saw %v, want ErrBodyTooLarge", middlewareErr)
+	}
+}
+
+func TestMaxBodySizeExactLimit(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithMaxBodySize(1<<10))
+	addAgent(t, p, "a", largeBodyAgent("a", 1<<10))
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatalf("body at the limit rejected: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestMaxBodySizeDefaultUnlimited(t *testing.T) {
+	p := newTestPool(t, retryOnFailure)
+	addAgent(t, p, "a", largeBodyAgent("a", 8<<20))
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(readBody(t, res)); n != 8<<20 {
+		t.Errorf("read %d bytes, want the whole body", n)
+	}
+}
+
+func TestDoResultReportsFinalAgent(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()), proxypool.WithMaxRetry(0))
+	addAgent(t, p, "a", statusAgent("a", http.StatusBadGateway))
+	addAgent(t, p, "b", testutil.NewMockAgent("b").EnqueueError(errors.New("connection reset")))
+	addAgent(t, p, "c", delayAgent("c", 5*time.Millisecond))
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, res); body != "c" {
+		t.Fatalf("body = %q", body)
+	}
+	if result.Agent != "c" || result.Attempts != 3 {
+		t.Errorf("result = %+v, want agent c after 3 attempts", result)
+	}
+	if result.Latency < 5*time.Millisecond {
+		t.Errorf("latency = %s, want at least the final agent's delay", result.Latency)
+	}
+}
@@ -0,0 +1,108 @@
+package proxypool
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+type ErrClass int
+
+const (
+	ErrClassNone ErrClass = iota
+	ErrClassTimeout
+	ErrClassConnectionRefused
+	ErrClassProxyHandshakeFailed
+	ErrClassProxyAuthFailed
+	ErrClassDNSFailure
+	ErrClassTLSFailure
+	ErrClassCanceled
+	ErrClassOther
+)
+
+func (c ErrClass) String() string {
+	switch c {
+	case ErrClassNone:
+		return "NONE"
+	case ErrClassTimeout:
+		return "TIMEOUT"
+	case ErrClassConnectionRefused:
+		return "CONNECTION REFUSED"
+	case ErrClassProxyHandshakeFailed:
+		return "PROXY HANDSHAKE FAILED"
+	case ErrClassProxyAuthFailed:
+		return "PROXY AUTH FAILED"
+	case ErrClassDNSFailure:
+		return "DNS FAILURE"
+	case ErrClassTLSFailure:
+		return "TLS FAILURE"
+	case ErrClassCanceled:
+		return "CANCELED"
+	case ErrClassOther:
+		return "OTHER"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+// ClassifyError maps a transport error to an ErrClass by unwrapping the
+// net, tls and proxy dialer errors it wraps.
+func ClassifyError(err error) ErrClass {
+	if err == nil {
+		return ErrClassNone
+	}
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrClassCanceled
+	case errors.As(err, &dnsErr):
+		return ErrClassDNSFailure
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return ErrClassTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrClassConnectionRefused
+	case isTLSError(err):
+		return ErrClassTLSFailure
+	case isProxyAuthError(err):
+		return ErrClassProxyAuthFailed
+	case isProxyHandshakeError(err):
+		return ErrClassProxyHandshakeFailed
+	}
+	return ErrClassOther
+}
+
+func isTLSError(err error) bool {
+	var headerErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var opErr *net.OpError
+	return errors.As(err, &headerErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		errors.As(err, &opErr) && opErr.Op == "remote error" && strings.HasPrefix(opErr.Err.Error(), "tls:")
+}
+
+// isProxyAuthError reports whether the proxy rejected our credentials, either
+// with a 407 to CONNECT or by failing the SOCKS5 authentication sub-negotiation.
+func isProxyAuthError(err error) bool {
+	if errors.Is(err, ErrProxyAuth) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && strings.HasPrefix(opErr.Op, "socks") && opErr.Err != nil &&
+		strings.Contains(opErr.Err.Error(), "authentication failed")
+}
+
+func isProxyHandshakeError(err error) bool {
+	var hopErr *HopError
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks")) {
+		return true
+	}
+	return errors.As(err, &hopErr)
+}
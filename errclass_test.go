@@ -0,0 +1,137 @@
+package proxypool_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+// hangingListener accepts connections and never answers on them.
+func hangingListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// closingListener accepts connections and closes them right away.
+func closingListener(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClassifyErrorFromRealDials(t *testing.T) {
+	tlsTarget := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsTarget.Close()
+	rejecting := func(status int) url.URL {
+		p, u := newConnectProxy(t)
+		p.reject = status
+		return u
+	}
+	short := func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), 50*time.Millisecond)
+	}
+
+	tests := []struct {
+		name   string
+		proxy  url.URL
+		target string
+		ctx    func() (context.Context, context.CancelFunc)
+		want   proxypool.ErrClass
+	}{
+		{"closed proxy port", refusedURL(t), "http://example.com", nil, proxypool.ErrClassConnectionRefused},
+		{"closed target port", url.URL{}, "http://" + refusedURL(t).Host, nil, proxypool.ErrClassConnectionRefused},
+		{"proxy never answers", url.URL{Scheme: "http", Host: hangingListener(t)}, "http://example.com", short, proxypool.ErrClassTimeout},
+		{"unroutable address", url.URL{}, "http://10.255.255.1", short, proxypool.ErrClassTimeout},
+		{"canceled", url.URL{Scheme: "http", Host: hangingListener(t)}, "http://example.com", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return ctx, cancel
+		}, proxypool.ErrClassCanceled},
+		{"unknown host", url.URL{}, "http://proxypool-test.invalid", nil, proxypool.ErrClassDNSFailure},
+		{"untrusted certificate", url.URL{}, tlsTarget.URL, nil, proxypool.ErrClassTLSFailure},
+		{"CONNECT rejected", rejecting(http.StatusBadGateway), tlsTarget.URL, nil, proxypool.ErrClassProxyHandshakeFailed},
+		{"CONNECT needs auth", rejecting(http.StatusProxyAuthRequired), tlsTarget.URL, nil, proxypool.ErrClassProxyAuthFailed},
+		{"connection closed", url.URL{}, "http://" + closingListener(t), nil, proxypool.ErrClassOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := proxypool.NewProxyAgent(tt.proxy)
+			defer agent.Close()
+			req := newRequest(t, http.MethodGet, tt.target, nil)
+			if tt.ctx != nil {
+				ctx, cancel := tt.ctx()
+				defer cancel()
+				req = req.WithContext(ctx)
+			}
+			_, err := agent.Do(req)
+			if err == nil {
+				t.Fatal("Do succeeded")
+			}
+			if tt.name == "unroutable address" && req.Context().Err() == nil {
+				t.Skipf("the network answered for an unroutable address: %v", err)
+			}
+			if got := proxypool.ClassifyError(err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %s, want %s", err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextErrClass(t *testing.T) {
+	var got []proxypool.ErrClass
+	p := newTestPool(t, func(c *proxypool.Context) {
+		got = append(got, c.ErrClass)
+	})
+	agent := proxypool.NewProxyAgent(refusedURL(t))
+	agent.SetState(proxypool.Ok, "")
+	addAgent(t, p, "proxy1", agent)
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if len(got) != 1 || got[0] != proxypool.ErrClassConnectionRefused {
+		t.Errorf("middleware saw %v, want [CONNECTION REFUSED]", got)
+	}
+}
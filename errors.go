@@ -0,0 +1,52 @@
+package proxypool
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	ErrAllAttemptsFailed = fmt.Errorf("all attempts failed")
+	ErrProxyAuth         = errors.New("proxy authentication failed")
+)
+
+type Attempt struct {
+	Agent      string
+	StatusCode int
+	Err        error
+}
+
+func (a Attempt) String() string {
+	if a.Err != nil {
+		return fmt.Sprintf("%s: %v", a.Agent, a.Err)
+	}
+	return fmt.Sprintf("%s: status %d", a.Agent, a.StatusCode)
+}
+
+type AttemptsError struct {
+	Attempts []Attempt
+}
+
+func (e *AttemptsError) Error() string {
+	parts := make([]string, 0, len(e.Attempts))
+	for _, a := range e.Attempts {
+		parts = append(parts, a.String())
+	}
+	return fmt.Sprintf("%s (%d attempts): %s", ErrAllAttemptsFailed, len(e.Attempts), strings.Join(parts, "; "))
+}
+
+// Unwrap matches both ErrAllAttemptsFailed and, for callers written against
+// the earlier contract, ErrNoHealthyAgents.
+func (e *AttemptsError) Unwrap() []error {
+	return []error{ErrAllAttemptsFailed, ErrNoHealthyAgents}
+}
+
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial" || opErr.Op == "proxyconnect" || strings.HasPrefix(opErr.Op, "socks")
+	}
+	return isTLSError(err)
+}
@@ -0,0 +1,107 @@
+package proxypool
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const eventBufferSize = 256
+
+type EventType int
+
+const (
+	EventRequestStarted EventType = iota
+	EventRequestFinished
+	EventRetry
+	EventAgentAdded
+	EventAgentDeleted
+	EventStateChanged
+	EventAgentRenamed
+	EventStatsReset
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRequestStarted:
+		return "REQUEST_STARTED"
+	case EventRequestFinished:
+		return "REQUEST_FINISHED"
+	case EventRetry:
+		return "RETRY"
+	case EventAgentAdded:
+		return "AGENT_ADDED"
+	case EventAgentDeleted:
+		return "AGENT_DELETED"
+	case EventStateChanged:
+		return "STATE_CHANGED"
+	case EventAgentRenamed:
+		return "AGENT_RENAMED"
+	case EventStatsReset:
+		return "STATS_RESET"
+	default:
+		return "UNDEFINED"
+	}
+}
+
+type Event struct {
+	Time       time.Time
+	Type       EventType
+	Agent      string
+	Detail     string
+	StatusCode int
+	Latency    time.Duration
+	Err        error
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("%s %s %s: %s", e.Time.Format(time.RFC3339), e.Type, e.Agent, e.Detail)
+}
+
+type events struct {
+	dropped uint64
+	mu      sync.RWMutex
+	subs    map[chan Event]struct{}
+}
+
+func (p *Pool) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, eventBufferSize)
+	p.events.mu.Lock()
+	if p.events.subs == nil {
+		p.events.subs = make(map[chan Event]struct{})
+	}
+	p.events.subs[ch] = struct{}{}
+	p.events.mu.Unlock()
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			p.events.mu.Lock()
+			delete(p.events.subs, ch)
+			close(ch)
+			p.events.mu.Unlock()
+		})
+	}
+}
+
+func (p *Pool) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&p.events.dropped)
+}
+
+func (p *Pool) emit(e Event) {
+	p.events.mu.RLock()
+	defer p.events.mu.RUnlock()
+	if len(p.events.subs) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for ch := range p.events.subs {
+		select {
+		case ch <- e:
+		default:
+			atomic.AddUint64(&p.events.dropped, 1)
+		}
+	}
+}
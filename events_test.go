@@ -0,0 +1,119 @@
+package proxypool_test
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	p := newTestPool(t, nil)
+	addAgents(t, p, 10, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	events, unsubscribe := p.Subscribe()
+	received := make(map[proxypool.EventType]int)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for e := range events {
+			received[e.Type]++
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+
+	const requests = 1000
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("slow subscriber stalled Do: %s for %d requests", elapsed, requests)
+	}
+	unsubscribe()
+	<-done
+
+	total := uint64(received[proxypool.EventRequestStarted] + received[proxypool.EventRequestFinished])
+	if total+p.DroppedEvents() != 2*requests {
+		t.Errorf("received %d + dropped %d events, want %d", total, p.DroppedEvents(), 2*requests)
+	}
+	if p.DroppedEvents() == 0 {
+		t.Log("no events were dropped; subscriber kept up")
+	}
+}
+
+func TestUnsubscribeWithPendingEvents(t *testing.T) {
+	p := newTestPool(t, nil)
+	events, unsubscribe := p.Subscribe()
+	for i := 0; i < 1000; i++ {
+		addAgent(t, p, fmt.Sprint(i), statusAgent("x", http.StatusOK))
+	}
+	unsubscribe()
+	unsubscribe()
+	n := 0
+	for range events {
+		n++
+	}
+	if n == 0 {
+		t.Error("buffered events were lost on unsubscribe")
+	}
+	addAgent(t, p, "after", statusAgent("after", http.StatusOK))
+}
+
+func TestSubscribeEventTypes(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	events, unsubscribe := p.Subscribe()
+	a := statusAgent("a", http.StatusBadGateway)
+	addAgent(t, p, "a", a)
+	addAgent(t, p, "b", statusAgent("b", http.StatusOK))
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	a.SetState(proxypool.Banned, "")
+	p.Delete("b")
+
+	unsubscribe()
+	var got []proxypool.EventType
+	banned := false
+	for e := range events {
+		if e.Type == proxypool.EventStateChanged {
+			banned = banned || (e.Agent == "a" && strings.HasSuffix(e.Detail, "-> BANNED"))
+			continue
+		}
+		if e.Type == proxypool.EventRequestFinished && e.Agent == "b" && e.StatusCode != http.StatusOK {
+			t.Errorf("finished event status = %d", e.StatusCode)
+		}
+		got = append(got, e.Type)
+	}
+	want := []proxypool.EventType{
+		proxypool.EventAgentAdded, proxypool.EventAgentAdded,
+		proxypool.EventRequestStarted, proxypool.EventRequestFinished, proxypool.EventRetry,
+		proxypool.EventRequestStarted, proxypool.EventRequestFinished,
+		proxypool.EventAgentDeleted,
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+	if !banned {
+		t.Error("no state change event for the ban")
+	}
+}
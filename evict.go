@@ -0,0 +1,46 @@
+package proxypool
+
+func WithEvictAfter(n int) Option {
+	return func(p *Pool) {
+		p.evictAfter = n
+	}
+}
+
+func WithOnEvict(fn func(name string, a Agent)) Option {
+	return func(p *Pool) {
+		p.onEvict = fn
+	}
+}
+
+func (p *Pool) recordOutcome(m *member, success bool) {
+	m.mu.Lock()
+	if success {
+		m.failures = 0
+	} else {
+		m.failures++
+	}
+	failures := m.failures
+	m.mu.Unlock()
+	if !success && p.evictAfter > 0 && failures >= p.evictAfter {
+		p.evict(m, failures)
+	}
+}
+
+func (p *Pool) evict(m *member, failures int) {
+	p.mu.Lock()
+	if p.agents[m.Name()] != m {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.agents, m.Name())
+	for _, g := range p.groups {
+		g.Remove(m.Name())
+	}
+	p.mu.Unlock()
+	p.logger.Warnf("evicting agent %s after %d consecutive failures", m.Name(), failures)
+	p.emit(Event{Type: EventAgentDeleted, Agent: m.Name(), Detail: "evicted"})
+	if p.onEvict != nil {
+		p.onEvict(m.Name(), m.Agent)
+	}
+	go m.Close()
+}
@@ -0,0 +1,86 @@
+package proxypool_test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestEvictAfterConsecutiveFailures(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		evicted []string
+	)
+	p := newTestPool(t, retryOnFailure,
+		proxypool.WithEvictAfter(3),
+		proxypool.WithOnEvict(func(name string, a proxypool.Agent) {
+			mu.Lock()
+			defer mu.Unlock()
+			evicted = append(evicted, name)
+		}),
+	)
+	dead := statusAgent("dead", http.StatusBadGateway)
+	addAgent(t, p, "dead", dead)
+
+	for i := 0; i < 3; i++ {
+		p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	}
+	if _, ok := p.Get("dead"); ok {
+		t.Fatal("agent still in the pool after 3 consecutive failures")
+	}
+	mu.Lock()
+	if len(evicted) != 1 || evicted[0] != "dead" {
+		t.Errorf("OnEvict calls = %v, want [dead]", evicted)
+	}
+	mu.Unlock()
+	if !waitFor(t, time.Second, dead.Closed) {
+		t.Error("evicted agent was not closed")
+	}
+	if dead.Calls() != 3 {
+		t.Errorf("calls = %d, want 3", dead.Calls())
+	}
+}
+
+func TestEvictCounterResetsOnSuccess(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithEvictAfter(3))
+	flaky := testutil.NewMockAgent("flaky").
+		EnqueueStatus(http.StatusBadGateway, "").
+		EnqueueStatus(http.StatusBadGateway, "").
+		EnqueueStatus(http.StatusOK, "").
+		EnqueueStatus(http.StatusBadGateway, "").
+		EnqueueStatus(http.StatusBadGateway, "")
+	addAgent(t, p, "flaky", flaky)
+
+	for i := 0; i < 5; i++ {
+		p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	}
+	if _, ok := p.Get("flaky"); !ok {
+		t.Error("agent evicted although a success reset its failure count")
+	}
+}
+
+func TestEvictIgnoresCancelledRequests(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithEvictAfter(2))
+	slow := testutil.NewMockAgent("slow").HandleFunc(func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	})
+	addAgent(t, p, "slow", slow)
+
+	for i := 0; i < 4; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+		cancel()
+	}
+	if _, ok := p.Get("slow"); !ok {
+		t.Error("agent evicted for failures caused by request cancellation")
+	}
+	if slow.Closed() {
+		t.Error("agent closed for failures caused by request cancellation")
+	}
+}
@@ -23,7 +23,9 @@ var (
 func main() {
 	ap := proxypool.New(func(c *proxypool.Context) {
 		if c.Err != nil {
-			c.Agent.SetState(proxypool.Error, c.Err.Error())
+			if c.ErrClass != proxypool.ErrClassProxyAuthFailed {
+				c.Agent.SetState(proxypool.Error, c.Err.Error())
+			}
 			c.Retry = true
 			return
 		}
@@ -37,7 +39,9 @@ func main() {
 	})
 
 	for k, v := range proxyMap {
-		ap.Add(k, proxypool.NewProxyAgentWithLimiter(v, rate.NewLimiter(rate.Every(180*time.Second), 10)))
+		if err := ap.Add(k, proxypool.NewProxyAgentWithLimiter(v, rate.NewLimiter(rate.Every(180*time.Second), 10))); err != nil {
+			log.Printf("error adding agent: %v", err)
+		}
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
@@ -63,6 +67,9 @@ func main() {
 		resp.Body.Close()
 	}
 
+	for _, info := range ap.StatusSorted() {
+		log.Printf("%s: %s (%d requests, last at %s)", info.Name, info.Report.State, info.Requests, info.LastRequestTime.Format(time.RFC3339))
+	}
 }
 
 func mustUrlMarse(s string) url.URL {
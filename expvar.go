@@ -0,0 +1,52 @@
+package proxypool
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+var expvarMu sync.Mutex
+
+// lazyMap is an expvar.Var that builds its map only when it is read.
+type lazyMap func() *expvar.Map
+
+func (f lazyMap) String() string {
+	return f().String()
+}
+
+// PublishExpvar publishes the pool's counters as an expvar.Map named prefix.
+// Values are computed when /debug/vars is read. Publishing a prefix that is
+// already taken is a no-op.
+func (p *Pool) PublishExpvar(prefix string) {
+	expvarMu.Lock()
+	defer expvarMu.Unlock()
+	if expvar.Get(prefix) != nil {
+		return
+	}
+	vars := new(expvar.Map)
+	vars.Set("requests", expvar.Func(func() any {
+		return atomic.LoadUint64(&p.totalRequests)
+	}))
+	vars.Set("retries", expvar.Func(func() any {
+		return atomic.LoadUint64(&p.totalRetries)
+	}))
+	vars.Set("healthy_agents", expvar.Func(func() any {
+		return p.CountByState()[Ok]
+	}))
+	vars.Set("agents", lazyMap(func() *expvar.Map {
+		agents := new(expvar.Map)
+		for _, m := range p.members() {
+			agent := new(expvar.Map)
+			requests := new(expvar.Int)
+			requests.Set(int64(m.Info().Requests))
+			state := new(expvar.String)
+			state.Set(m.State().State.String())
+			agent.Set("requests", requests)
+			agent.Set("state", state)
+			agents.Set(m.Name(), agent)
+		}
+		return agents
+	}))
+	expvar.Publish(prefix, vars)
+}
@@ -0,0 +1,93 @@
+package proxypool_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+var expvarSeq uint64
+
+// expvarName returns a name no other test run has published, since expvar
+// names cannot be unpublished.
+func expvarName(t *testing.T) string {
+	return fmt.Sprintf("proxypool_test_%s_%d", t.Name(), atomic.AddUint64(&expvarSeq, 1))
+}
+
+type expvarSnapshot struct {
+	Requests      uint64 `json:"requests"`
+	Retries       uint64 `json:"retries"`
+	HealthyAgents int    `json:"healthy_agents"`
+	Agents        map[string]struct {
+		Requests int    `json:"requests"`
+		State    string `json:"state"`
+	} `json:"agents"`
+}
+
+func readExpvar(t *testing.T, name string) expvarSnapshot {
+	t.Helper()
+	v := expvar.Get(name)
+	if v == nil {
+		t.Fatalf("%s not published", name)
+	}
+	var snap expvarSnapshot
+	if err := json.Unmarshal([]byte(v.String()), &snap); err != nil {
+		t.Fatalf("decode %s: %v", v.String(), err)
+	}
+	return snap
+}
+
+func TestPublishExpvar(t *testing.T) {
+	p := newTestPool(t, retryOnFailure)
+	addAgent(t, p, "good", statusAgent("good", http.StatusOK))
+	name := expvarName(t)
+	p.PublishExpvar(name)
+
+	snap := readExpvar(t, name)
+	if snap.Requests != 0 || snap.HealthyAgents != 1 || snap.Agents["good"].State != "OK" {
+		t.Fatalf("initial snapshot = %+v", snap)
+	}
+
+	// Values are read when the var is, not when it was published.
+	bad := statusAgent("bad", http.StatusBadGateway)
+	addAgent(t, p, "bad", bad)
+	for i := 0; i < 3; i++ {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	bad.SetState(proxypool.Banned, "403")
+
+	snap = readExpvar(t, name)
+	good := snap.Agents["good"]
+	if snap.Requests != uint64(good.Requests+snap.Agents["bad"].Requests) || good.Requests != 3 || good.State != "OK" {
+		t.Errorf("snapshot after requests = %+v", snap)
+	}
+	if got := snap.Agents["bad"]; got.State != "BANNED" || snap.HealthyAgents != 1 {
+		t.Errorf("bad agent = %+v, healthy = %d", got, snap.HealthyAgents)
+	}
+	if snap.Retries != uint64(snap.Agents["bad"].Requests) {
+		t.Errorf("retries = %d, want one per attempt on bad (%d)", snap.Retries, snap.Agents["bad"].Requests)
+	}
+}
+
+func TestPublishExpvarTakenName(t *testing.T) {
+	name := expvarName(t)
+	first := newTestPool(t, nil)
+	addAgent(t, first, "first", statusAgent("first", http.StatusOK))
+	first.PublishExpvar(name)
+
+	second := newTestPool(t, nil)
+	second.PublishExpvar(name) // must not panic
+
+	if _, ok := readExpvar(t, name).Agents["first"]; !ok {
+		t.Error("second publish replaced the first pool's vars")
+	}
+}
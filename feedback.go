@@ -0,0 +1,17 @@
+package proxypool
+
+// AgentFeedback is implemented by agents that want to learn the middleware
+// verdict for their responses. The pool calls ReportOutcome exactly once for
+// every non-nil response returned by Do, including responses that are
+// discarded because a hedged sibling won or the request context ended.
+// Each attempt is a separate call to Do, so a retry on another agent never
+// reports back to the agent that failed.
+type AgentFeedback interface {
+	ReportOutcome(success bool)
+}
+
+func reportOutcome(a Agent, success bool) {
+	if fb, ok := agentAs[AgentFeedback](a); ok {
+		fb.ReportOutcome(success)
+	}
+}
@@ -0,0 +1,143 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+)
+
+type FileEntry struct {
+	URL   url.URL
+	Rate  rate.Limit
+	Burst int
+}
+
+type FileProvider struct {
+	path   string
+	logger Logger
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	entries map[string]FileEntry
+}
+
+var (
+	_ Provider      = (*FileProvider)(nil)
+	_ LimitProvider = (*FileProvider)(nil)
+)
+
+func NewFileProvider(path string, logger Logger) *FileProvider {
+	if logger == nil {
+		logger = StdLogger()
+	}
+	return &FileProvider{path: path, logger: logger}
+}
+
+func (f *FileProvider) Proxies(ctx context.Context) (map[string]url.URL, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.entries == nil || !info.ModTime().Equal(f.modTime) || info.Size() != f.size {
+		entries, err := f.load()
+		if err != nil {
+			return nil, err
+		}
+		f.entries, f.modTime, f.size = entries, info.ModTime(), info.Size()
+	}
+	r := make(map[string]url.URL, len(f.entries))
+	for name, e := range f.entries {
+		r[name] = e.URL
+	}
+	return r, nil
+}
+
+func (f *FileProvider) Entry(name string) (FileEntry, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[name]
+	return e, ok
+}
+
+func (f *FileProvider) Limits(name string) (rate.Limit, int, bool) {
+	e, ok := f.Entry(name)
+	return e.Rate, e.Burst, ok
+}
+
+func (f *FileProvider) Factory(limit rate.Limit, burst int, opts ...AgentOption) AgentFactory {
+	return func(name string, u url.URL) (Agent, error) {
+		l, b := limit, burst
+		if e, ok := f.Entry(name); ok {
+			if e.Rate > 0 {
+				l = e.Rate
+			}
+			if e.Burst > 0 {
+				b = e.Burst
+			}
+		}
+		return NewProxyAgentWithLimiter(u, rate.NewLimiter(l, b), opts...), nil
+	}
+}
+
+func (f *FileProvider) load() (map[string]FileEntry, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("%s: %w", f.path, err)
+	}
+	entries := make(map[string]FileEntry)
+	if len(root.Content) == 0 {
+		return entries, nil
+	}
+	doc := root.Content[0]
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expected a mapping of name to proxy", f.path)
+	}
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		k, v := doc.Content[i], doc.Content[i+1]
+		e, err := parseFileEntry(v)
+		if err != nil {
+			f.logger.Warnf("%s:%d: skipping proxy %q: %v", f.path, k.Line, k.Value, err)
+			continue
+		}
+		entries[k.Value] = e
+	}
+	return entries, nil
+}
+
+func parseFileEntry(n *yaml.Node) (FileEntry, error) {
+	var raw struct {
+		URL   string  `yaml:"url"`
+		Rate  float64 `yaml:"rate"`
+		Burst int     `yaml:"burst"`
+	}
+	switch n.Kind {
+	case yaml.ScalarNode:
+		raw.URL = n.Value
+	case yaml.MappingNode:
+		if err := n.Decode(&raw); err != nil {
+			return FileEntry{}, errors.New("malformed entry")
+		}
+	default:
+		return FileEntry{}, errors.New("expected a URL or an object")
+	}
+	u, err := url.Parse(raw.URL)
+	if err != nil || u.Host == "" {
+		// url.Parse errors echo the input, which may carry credentials.
+		return FileEntry{}, errors.New("invalid proxy URL")
+	}
+	return FileEntry{URL: *u, Rate: rate.Limit(raw.Rate), Burst: raw.Burst}, nil
+}
@@ -0,0 +1,76 @@
+package proxypool_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+func writeProxyFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// Make the change visible even on filesystems with coarse mtimes.
+	mtime := time.Now().Add(time.Duration(len(content)) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileProviderHotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.yaml")
+	writeProxyFile(t, path, `
+a: http://a.invalid:8080
+b: {url: "http://b.invalid:8080", rate: 1, burst: 1}
+bad: "://missing-scheme"
+`)
+	logger := &captureLogger{}
+	provider := proxypool.NewFileProvider(path, logger)
+	p := newTestPool(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Sync(ctx, provider, 5*time.Millisecond, provider.Factory(10, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, time.Second, func() bool { return p.Len() == 2 }) {
+		t.Fatalf("pool = %v, want [a b]", sortedList(p))
+	}
+	if !logger.contains(`skipping proxy "bad"`) {
+		t.Errorf("invalid entry was not logged: %q", logger.msgs)
+	}
+	b, _ := p.Get("b")
+	if tokens := b.(*proxypool.ProxyAgentWithLimiter).Tokens(); tokens > 1 {
+		t.Errorf("tokens of b = %.2f, want the per-entry burst of 1", tokens)
+	}
+
+	writeProxyFile(t, path, `
+b: {url: "http://b.invalid:8080", rate: 1000, burst: 5}
+c: http://c.invalid:8080
+`)
+	if !waitFor(t, time.Second, func() bool {
+		_, hasA := p.Get("a")
+		_, hasC := p.Get("c")
+		return !hasA && hasC
+	}) {
+		t.Fatalf("pool = %v after reload, want [b c]", sortedList(p))
+	}
+	got, _ := p.Get("b")
+	if got != b {
+		t.Fatal("agent b was replaced although only its rate changed")
+	}
+	if !waitFor(t, time.Second, func() bool { return b.(*proxypool.ProxyAgentWithLimiter).Tokens() > 4 }) {
+		t.Errorf("tokens of b = %.2f, want the new burst of 5", b.(*proxypool.ProxyAgentWithLimiter).Tokens())
+	}
+}
+
+func TestFileProviderMissingFile(t *testing.T) {
+	provider := proxypool.NewFileProvider(filepath.Join(t.TempDir(), "missing.yaml"), proxypool.NopLogger())
+	if _, err := provider.Proxies(context.Background()); err == nil {
+		t.Error("Proxies succeeded for a missing file")
+	}
+}
@@ -0,0 +1,113 @@
+package proxypool
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+type Group struct {
+	pool        *Pool
+	name        string
+	mu          sync.RWMutex
+	members     map[string]struct{}
+	middlewares []func(c *Context)
+}
+
+func (p *Pool) Group(name string) *Group {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	g, ok := p.groups[name]
+	if !ok {
+		g = &Group{
+			pool:    p,
+			name:    name,
+			members: make(map[string]struct{}),
+		}
+		p.groups[name] = g
+	}
+	return g
+}
+
+func (g *Group) Name() string {
+	return g.name
+}
+
+func (g *Group) SetMiddleware(fns ...func(c *Context)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.middlewares = append([]func(c *Context){}, fns...)
+}
+
+func (g *Group) Use(fns ...func(c *Context)) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.middlewares = append(g.middlewares, fns...)
+}
+
+func (g *Group) getMiddlewares() []func(c *Context) {
+	g.mu.RLock()
+	middlewares := g.middlewares[:len(g.middlewares):len(g.middlewares)]
+	g.mu.RUnlock()
+	if len(middlewares) == 0 {
+		return g.pool.getMiddlewares()
+	}
+	return middlewares
+}
+
+func (g *Group) Add(names ...string) error {
+	for _, name := range names {
+		if _, ok := g.pool.Get(name); !ok {
+			return fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+		}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range names {
+		g.members[name] = struct{}{}
+	}
+	return nil
+}
+
+func (g *Group) Remove(names ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, name := range names {
+		delete(g.members, name)
+	}
+}
+
+func (g *Group) rename(old, new string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.members[old]; ok {
+		delete(g.members, old)
+		g.members[new] = struct{}{}
+	}
+}
+
+func (g *Group) Has(name string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	_, ok := g.members[name]
+	return ok
+}
+
+func (g *Group) List() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	result := make([]string, 0, len(g.members))
+	for name := range g.members {
+		result = append(result, name)
+	}
+	return result
+}
+
+func (g *Group) Do(req *http.Request) (*http.Response, error) {
+	res, _, err := g.pool.do(req, g)
+	return res, err
+}
+
+func (g *Group) DoResult(req *http.Request) (*http.Response, Result, error) {
+	return g.pool.do(req, g)
+}
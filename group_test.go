@@ -0,0 +1,111 @@
+package proxypool_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+func retryOnForbidden(c *proxypool.Context) {
+	c.Retry = c.Err != nil || c.StatusCode == http.StatusForbidden
+}
+
+func TestGroupSelectsOnlyMembers(t *testing.T) {
+	p := newTestPool(t, nil)
+	a, b := statusAgent("a", http.StatusOK), statusAgent("b", http.StatusOK)
+	addAgent(t, p, "a", a)
+	addAgent(t, p, "b", b)
+	g := p.Group("siteA")
+	if err := g.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Add("missing"); !errors.Is(err, proxypool.ErrAgentNotFound) {
+		t.Errorf("Add(missing) = %v, want ErrAgentNotFound", err)
+	}
+	for i := 0; i < 5; i++ {
+		res, err := g.Do(newRequest(t, http.MethodGet, "http://a.example", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if a.Calls() != 5 || b.Calls() != 0 {
+		t.Errorf("calls a=%d b=%d, want 5 and 0", a.Calls(), b.Calls())
+	}
+	if p.Group("siteA") != g {
+		t.Error("Group returned a new group for an existing name")
+	}
+}
+
+func TestGroupMiddlewareIsolation(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.RoundRobin()))
+	shared := statusAgent("shared", http.StatusForbidden)
+	spare := statusAgent("spare", http.StatusOK)
+	addAgent(t, p, "shared", shared)
+	addAgent(t, p, "spare", spare)
+
+	siteA := p.Group("siteA")
+	siteA.Add("shared", "spare")
+	siteA.SetMiddleware(retryOnForbidden)
+	siteB := p.Group("siteB")
+	siteB.Add("shared")
+	siteB.SetMiddleware(func(c *proxypool.Context) {})
+
+	res, result, err := siteA.DoResult(newRequest(t, http.MethodGet, "http://a.example", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "spare" {
+		t.Fatalf("siteA served by %s, want spare after shared was rejected", result.Agent)
+	}
+
+	res, result, err = siteB.DoResult(newRequest(t, http.MethodGet, "http://b.example", nil))
+	if err != nil {
+		t.Fatalf("siteB lost the agent rejected by siteA: %v", err)
+	}
+	res.Body.Close()
+	if result.Agent != "shared" || res.StatusCode != http.StatusForbidden {
+		t.Errorf("siteB served by %s with %d", result.Agent, res.StatusCode)
+	}
+}
+
+func TestGroupSeesUnderlyingStateChanges(t *testing.T) {
+	p := newTestPool(t, nil)
+	shared := statusAgent("shared", http.StatusForbidden)
+	addAgent(t, p, "shared", shared)
+	siteA := p.Group("siteA")
+	siteA.Add("shared")
+	siteA.SetMiddleware(func(c *proxypool.Context) {
+		if c.StatusCode == http.StatusForbidden {
+			c.Agent.SetState(proxypool.Banned, "forbidden")
+			c.Retry = true
+		}
+	})
+	siteB := p.Group("siteB")
+	siteB.Add("shared")
+
+	siteA.Do(newRequest(t, http.MethodGet, "http://a.example", nil))
+	if _, err := siteB.Do(newRequest(t, http.MethodGet, "http://b.example", nil)); !errors.Is(err, proxypool.ErrNoHealthyAgents) {
+		t.Errorf("siteB err = %v, want ErrNoHealthyAgents once the agent is banned", err)
+	}
+	if got := p.CountByState()[proxypool.Banned]; got != 1 {
+		t.Errorf("pool reports %d banned agents, want 1", got)
+	}
+}
+
+func TestPoolCloseClosesGroupAgents(t *testing.T) {
+	p := newTestPool(t, nil)
+	a := statusAgent("a", http.StatusOK)
+	addAgent(t, p, "a", a)
+	p.Group("siteA").Add("a")
+	p.Close()
+	if !a.Closed() {
+		t.Error("pool Close did not close a group member")
+	}
+	if len(p.Group("siteA").List()) != 1 || len(p.Status()) != 1 {
+		t.Error("group membership or status lost on close")
+	}
+}
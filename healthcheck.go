@@ -0,0 +1,187 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type HealthCheckConfig struct {
+	URL           string
+	Interval      time.Duration
+	Timeout       time.Duration
+	Concurrency   int
+	All           bool
+	ConsumeTokens bool
+	Verdict       func(res *http.Response, err error) (State, string)
+}
+
+type Prober interface {
+	Probe(req *http.Request) (*http.Response, error)
+}
+
+func DefaultVerdict(res *http.Response, err error) (State, string) {
+	if isProxyAuthError(err) {
+		return AuthFailed, err.Error()
+	}
+	if err != nil {
+		return Error, err.Error()
+	}
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return Ok, ""
+	}
+	return Error, res.Status
+}
+
+func (cfg *HealthCheckConfig) validate() error {
+	if cfg.URL == "" {
+		return errors.New("health check URL is required")
+	}
+	if _, err := http.NewRequest(http.MethodGet, cfg.URL, nil); err != nil {
+		return fmt.Errorf("invalid health check URL: %w", err)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 4
+	}
+	if cfg.Verdict == nil {
+		cfg.Verdict = DefaultVerdict
+	}
+	return nil
+}
+
+func (p *Pool) StartHealthCheck(ctx context.Context, cfg HealthCheckConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			p.checkHealth(ctx, cfg)
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *Pool) checkHealth(ctx context.Context, cfg HealthCheckConfig) {
+	sem := make(chan struct{}, cfg.Concurrency)
+	var wg sync.WaitGroup
+	for _, m := range p.members() {
+		state := m.State().State
+		if state == Closed || state == Paused || state == Expired || (!cfg.All && state == Ok) {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		}
+		wg.Add(1)
+		go func(m *member) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			state, msg := probe(ctx, m.Agent, cfg)
+			if ctx.Err() != nil {
+				return
+			}
+			p.logger.Debugf("health check for agent %s: %s %s", m.Name(), state, msg)
+			m.SetState(state, msg)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func probe(ctx context.Context, a Agent, cfg HealthCheckConfig) (State, string) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.URL, nil)
+	if err != nil {
+		return cfg.Verdict(nil, err)
+	}
+	var res *http.Response
+	if pr, ok := agentAs[Prober](a); ok && !cfg.ConsumeTokens {
+		res, err = pr.Probe(req)
+	} else {
+		res, err = a.Do(req)
+	}
+	if err != nil {
+		return cfg.Verdict(nil, err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<16))
+	return cfg.Verdict(res, nil)
+}
+
+var ErrValidationFailed = fmt.Errorf("agent validation failed")
+
+func (p *Pool) AddValidated(ctx context.Context, name string, agent Agent, cfg HealthCheckConfig, opts ...AddOption) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	if _, ok := p.Get(name); ok {
+		return fmt.Errorf("%w: %s", ErrAgentExists, name)
+	}
+	state, msg := probe(ctx, agent, cfg)
+	if err := ctx.Err(); err != nil {
+		agent.Close()
+		return err
+	}
+	if state != Ok {
+		agent.Close()
+		return fmt.Errorf("%w: %s: %s %s", ErrValidationFailed, name, state, msg)
+	}
+	agent.SetState(Ok, "validated")
+	if err := p.Add(name, agent, opts...); err != nil {
+		agent.Close()
+		return err
+	}
+	return nil
+}
+
+type HealthChecker interface {
+	CheckHealth(ctx context.Context, probeURL string) StateReport
+}
+
+func BanAwareVerdict(res *http.Response, err error) (State, string) {
+	if err == nil && res.StatusCode == http.StatusForbidden {
+		return Banned, res.Status
+	}
+	return DefaultVerdict(res, err)
+}
+
+func (p *Pool) CheckAgent(ctx context.Context, name, probeURL string) (StateReport, error) {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return StateReport{}, fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	if hc, ok := agentAs[HealthChecker](m.Agent); ok {
+		return hc.CheckHealth(ctx, probeURL), nil
+	}
+	cfg := HealthCheckConfig{URL: probeURL, Verdict: BanAwareVerdict}
+	if err := cfg.validate(); err != nil {
+		return StateReport{}, err
+	}
+	state, msg := probe(ctx, m.Agent, cfg)
+	m.SetState(state, msg)
+	return m.State(), nil
+}
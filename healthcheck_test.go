@@ -0,0 +1,238 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestHealthCheckRecoversAgent(t *testing.T) {
+	var status, probes int64 = http.StatusForbidden, 0
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&probes, 1)
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+	})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter)
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", agent)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := p.StartHealthCheck(ctx, proxypool.HealthCheckConfig{
+		URL:      "http://example.com/health",
+		Interval: 10 * time.Millisecond,
+		Verdict:  proxypool.BanAwareVerdict,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, time.Second, func() bool { return agent.State().State == proxypool.Banned }) {
+		t.Fatalf("state = %s, want BANNED while the proxy answers 403", agent.State().State)
+	}
+	atomic.StoreInt64(&status, http.StatusOK)
+	if !waitFor(t, time.Second, func() bool { return agent.State().State == proxypool.Ok }) {
+		t.Fatalf("state = %s, want OK after the proxy recovered", agent.State().State)
+	}
+	if tokens := limiter.Tokens(); tokens < 0.99 {
+		t.Errorf("limiter tokens = %.2f, probes consumed caller tokens", tokens)
+	}
+
+	// Ok agents are skipped unless All is set.
+	seen := atomic.LoadInt64(&probes)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt64(&probes); got != seen {
+		t.Errorf("healthy agent probed %d more times", got-seen)
+	}
+}
+
+func TestHealthCheckStopsWithContext(t *testing.T) {
+	var probes int64
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&probes, 1)
+	})
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", proxypool.NewProxyAgent(proxy))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := p.StartHealthCheck(ctx, proxypool.HealthCheckConfig{
+		URL:      "http://example.com/health",
+		Interval: 10 * time.Millisecond,
+		All:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(t, time.Second, func() bool { return atomic.LoadInt64(&probes) >= 2 }) {
+		t.Fatal("health check did not run")
+	}
+	cancel()
+	time.Sleep(30 * time.Millisecond)
+	seen := atomic.LoadInt64(&probes)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt64(&probes); got != seen {
+		t.Errorf("%d probes after cancellation", got-seen)
+	}
+}
+
+func TestHealthCheckRequiresURL(t *testing.T) {
+	p := newTestPool(t, nil)
+	if err := p.StartHealthCheck(context.Background(), proxypool.HealthCheckConfig{}); err == nil {
+		t.Error("StartHealthCheck accepted an empty URL")
+	}
+}
+
+func TestAddValidated(t *testing.T) {
+	working := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	hanging := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	cfg := proxypool.HealthCheckConfig{URL: "http://example.com/health"}
+
+	t.Run("working", func(t *testing.T) {
+		p := newTestPool(t, nil)
+		agent := proxypool.NewProxyAgent(working)
+		if err := p.AddValidated(context.Background(), "proxy1", agent, cfg); err != nil {
+			t.Fatalf("AddValidated: %v", err)
+		}
+		if s := agent.State().State; s != proxypool.Ok {
+			t.Errorf("state = %s, want OK", s)
+		}
+		if _, ok := p.Get("proxy1"); !ok {
+			t.Error("agent was not added")
+		}
+	})
+	t.Run("refusing", func(t *testing.T) {
+		p := newTestPool(t, nil)
+		agent := proxypool.NewProxyAgent(refusedURL(t))
+		err := p.AddValidated(context.Background(), "proxy1", agent, cfg)
+		if !errors.Is(err, proxypool.ErrValidationFailed) {
+			t.Fatalf("err = %v, want ErrValidationFailed", err)
+		}
+		if p.Len() != 0 {
+			t.Error("agent was added although its probe failed")
+		}
+		if s := agent.State().State; s != proxypool.Closed {
+			t.Errorf("state = %s, want the rejected agent closed", s)
+		}
+	})
+	t.Run("context bounds the probe", func(t *testing.T) {
+		p := newTestPool(t, nil)
+		agent := proxypool.NewProxyAgent(hanging)
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := p.AddValidated(ctx, "proxy1", agent, cfg)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want context.DeadlineExceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("AddValidated blocked for %s", elapsed)
+		}
+		if p.Len() != 0 {
+			t.Error("agent was added although validation timed out")
+		}
+	})
+	t.Run("name taken during the probe", func(t *testing.T) {
+		p := newTestPool(t, nil)
+		other := testutil.NewMockAgent("other")
+		racing := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+			p.Add("proxy1", other)
+		})
+		agent := proxypool.NewProxyAgent(racing)
+		err := p.AddValidated(context.Background(), "proxy1", agent, cfg)
+		if !errors.Is(err, proxypool.ErrAgentExists) {
+			t.Fatalf("err = %v, want ErrAgentExists", err)
+		}
+		if s := agent.State().State; s != proxypool.Closed {
+			t.Errorf("state = %s, want the rejected agent closed", s)
+		}
+		if a, _ := p.Get("proxy1"); a != other {
+			t.Error("the agent that won the name was replaced")
+		}
+	})
+}
+
+func TestAddValidatedLimiter(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	newAgent := func() *proxypool.ProxyAgentWithLimiter {
+		limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+		limiter.Allow()
+		return proxypool.NewProxyAgentWithLimiter(proxy, limiter)
+	}
+	p := newTestPool(t, nil)
+	cfg := proxypool.HealthCheckConfig{URL: "http://example.com/health"}
+	if err := p.AddValidated(context.Background(), "bypass", newAgent(), cfg); err != nil {
+		t.Errorf("probe bypassing the limiter failed: %v", err)
+	}
+	cfg.ConsumeTokens = true
+	if err := p.AddValidated(context.Background(), "consume", newAgent(), cfg); err == nil {
+		t.Error("probe charged to an exhausted limiter succeeded")
+	}
+}
+
+func TestCheckHealthFlappyServer(t *testing.T) {
+	statuses := []int{http.StatusOK, http.StatusForbidden, http.StatusInternalServerError, http.StatusOK}
+	var n int64
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[atomic.AddInt64(&n, 1)-1])
+	})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter)
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", agent)
+
+	for i, want := range []proxypool.State{proxypool.Ok, proxypool.Banned, proxypool.Error, proxypool.Ok} {
+		report, err := p.CheckAgent(context.Background(), "proxy1", "http://example.com/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.State != want {
+			t.Errorf("probe %d: state = %s, want %s", i, report.State, want)
+		}
+		if stored := agent.StoredState().State; stored != want {
+			t.Errorf("probe %d: stored state = %s, want %s", i, stored, want)
+		}
+	}
+	if tokens := limiter.Tokens(); tokens < 0.99 {
+		t.Errorf("tokens = %.2f, probes consumed the limiter", tokens)
+	}
+	if _, err := p.CheckAgent(context.Background(), "missing", "http://example.com/health"); !errors.Is(err, proxypool.ErrAgentNotFound) {
+		t.Errorf("err = %v, want ErrAgentNotFound", err)
+	}
+}
+
+func TestCheckHealthConsumingTokens(t *testing.T) {
+	var probes int64
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&probes, 1)
+	})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter, proxypool.WithHealthCheckConsumingTokens())
+	defer agent.Close()
+
+	// The returned report is the effective state, which is Unavailable
+	// once the probe took the only token; the stored verdict is OK.
+	agent.CheckHealth(context.Background(), "http://example.com/health")
+	if stored := agent.StoredState().State; stored != proxypool.Ok {
+		t.Fatalf("first probe stored state = %s, want OK", stored)
+	}
+	if tokens := limiter.Tokens(); tokens > 0.01 {
+		t.Errorf("tokens = %.2f after a consuming probe, want 0", tokens)
+	}
+	agent.CheckHealth(context.Background(), "http://example.com/health")
+	if stored := agent.StoredState().State; stored != proxypool.Error {
+		t.Errorf("second probe stored state = %s, want ERROR without a token", stored)
+	}
+	if probes != 1 {
+		t.Errorf("probes reaching the proxy = %d, want 1", probes)
+	}
+}
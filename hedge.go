@@ -0,0 +1,105 @@
+package proxypool
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+func WithHedging(delay time.Duration, maxParallel int) Option {
+	return func(p *Pool) {
+		p.hedgeDelay = delay
+		p.hedgeParallel = maxParallel
+	}
+}
+
+type hedgeResult struct {
+	selected Agent
+	c        *Context
+	err      error
+}
+
+func (cl *call) hedged(agents []Agent) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(cl.req.Context())
+	defer cancel()
+	results := make(chan hedgeResult, len(agents))
+	next, inflight, skipped := 0, 0, 0
+	launch := func() bool {
+		if next >= len(agents) {
+			return false
+		}
+		if cl.exhausted(next - skipped) {
+			cl.pool.logger.Warnf("max retry (%s) reached for %s, next agent %s", cl.limit, cl.req.URL.Host, AgentName(agents[next]))
+			return false
+		}
+		selected := agents[next]
+		name := AgentName(selected)
+		cl.logAttempt(next-skipped, name)
+		next++
+		inflight++
+		go func() {
+			c, err := cl.roundTrip(ctx, selected)
+			results <- hedgeResult{selected: selected, c: c, err: err}
+		}()
+		return true
+	}
+	if !launch() {
+		return cl.failed()
+	}
+	defer func() {
+		go drainHedged(results, inflight)
+	}()
+	timer := time.NewTimer(cl.pool.hedgeDelay)
+	defer timer.Stop()
+	for inflight > 0 {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err != nil {
+				if ctxErr := cl.req.Context().Err(); ctxErr != nil {
+					return nil, ctxErr
+				}
+				return nil, r.err
+			}
+			if r.c.skipped {
+				skipped++
+				cl.skip(r.c, AgentName(r.selected))
+				if inflight == 0 {
+					launch()
+				}
+				continue
+			}
+			if res, err, done := cl.verdict(r.c, r.selected); done {
+				return res, err
+			}
+			if inflight == 0 {
+				if cl.pool.backoff != nil {
+					if err := sleepContext(ctx, cl.pool.backoff(next-skipped)); err != nil {
+						return nil, err
+					}
+				}
+				launch()
+			}
+		case <-timer.C:
+			if inflight < cl.pool.hedgeParallel {
+				launch()
+			}
+			timer.Reset(cl.pool.hedgeDelay)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return cl.failed()
+}
+
+func drainHedged(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if r := <-results; r.c != nil {
+			r.c.finishAttempt()
+			r.c.discard()
+			if r.c.Response != nil {
+				reportOutcome(r.c.Agent, false)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package proxypool_test
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func hedgingPool(t *testing.T, fn func(c *proxypool.Context)) *proxypool.Pool {
+	return newTestPool(t, fn,
+		proxypool.WithStrategy(proxypool.RoundRobin()),
+		proxypool.WithHedging(20*time.Millisecond, 2),
+	)
+}
+
+func TestHedgingTakesFirstResponse(t *testing.T) {
+	var middlewareAgents []string
+	p := hedgingPool(t, func(c *proxypool.Context) {
+		middlewareAgents = append(middlewareAgents, c.Agent.Info().Name)
+	})
+	var canceled atomic.Bool
+	slow := testutil.NewMockAgent("a-slow").HandleFunc(func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			canceled.Store(true)
+			return nil, req.Context().Err()
+		case <-time.After(2 * time.Second):
+			return testutil.NewResponse(http.StatusOK, "slow"), nil
+		}
+	})
+	fast := statusAgent("b-fast", http.StatusOK)
+	addAgent(t, p, "a-slow", slow)
+	addAgent(t, p, "b-fast", fast)
+
+	start := time.Now()
+	res, result, err := p.DoResult(newRequest(t, http.MethodPut, "http://example.com", strings.NewReader("payload")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, res); body != "b-fast" || result.Agent != "b-fast" {
+		t.Fatalf("served %q by %s, want the fast agent", body, result.Agent)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("hedged request took %s", elapsed)
+	}
+	for _, a := range []*testutil.MockAgent{slow, fast} {
+		if reqs := a.Requests(); len(reqs) != 1 || string(reqs[0].Body) != "payload" {
+			t.Errorf("agent %s received %d requests, want one with the full body", a.Info().Name, len(reqs))
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for !canceled.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !canceled.Load() {
+		t.Error("losing attempt was not canceled")
+	}
+	if len(middlewareAgents) != 1 || middlewareAgents[0] != "b-fast" {
+		t.Errorf("middleware ran for %v, want only the winner", middlewareAgents)
+	}
+}
+
+type closeTracker struct {
+	*strings.Reader
+	closed atomic.Bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestHedgingClosesLosingBody(t *testing.T) {
+	p := hedgingPool(t, nil)
+	body := &closeTracker{Reader: strings.NewReader("late")}
+	slow := testutil.NewMockAgent("a-slow").HandleFunc(func(req *http.Request) (*http.Response, error) {
+		time.Sleep(100 * time.Millisecond)
+		res := testutil.NewResponse(http.StatusOK, "")
+		res.Body = body
+		return res, nil
+	})
+	addAgent(t, p, "a-slow", slow)
+	addAgent(t, p, "b-fast", statusAgent("b-fast", http.StatusOK))
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	deadline := time.Now().Add(time.Second)
+	for !body.closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !body.closed.Load() {
+		t.Error("losing response body was not closed")
+	}
+}
+
+func TestHedgingWaitsForDelay(t *testing.T) {
+	p := hedgingPool(t, nil)
+	first := statusAgent("a", http.StatusOK)
+	second := statusAgent("b", http.StatusOK)
+	addAgent(t, p, "a", first)
+	addAgent(t, p, "b", second)
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	time.Sleep(40 * time.Millisecond)
+	if first.Calls()+second.Calls() != 1 {
+		t.Errorf("calls a=%d b=%d, want a single attempt when the first agent is fast", first.Calls(), second.Calls())
+	}
+}
+
+func TestHedgingRetriesAfterFailure(t *testing.T) {
+	p := hedgingPool(t, retryOnFailure)
+	addAgent(t, p, "a", statusAgent("a", http.StatusBadGateway))
+	addAgent(t, p, "b", statusAgent("b", http.StatusOK))
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "b" || result.Attempts != 2 {
+		t.Errorf("served by %s after %d attempts", result.Agent, result.Attempts)
+	}
+}
@@ -0,0 +1,190 @@
+package proxypool_test
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// newTestPool returns a pool that logs nothing and retries without backoff,
+// closed when the test ends.
+func newTestPool(t testing.TB, fn func(c *proxypool.Context), opts ...proxypool.Option) *proxypool.Pool {
+	t.Helper()
+	opts = append([]proxypool.Option{
+		proxypool.WithLogger(proxypool.NopLogger()),
+		proxypool.WithRetryBackoff(nil),
+	}, opts...)
+	p := proxypool.New(fn, opts...)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// waitFor polls cond until it holds or the timeout elapses.
+func waitFor(t testing.TB, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
+func retryOnFailure(c *proxypool.Context) {
+	c.Retry = c.Err != nil || c.StatusCode >= 500
+}
+
+func newRequest(t testing.TB, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func statusAgent(name string, code int) *testutil.MockAgent {
+	return testutil.NewMockAgent(name).HandleFunc(func(*http.Request) (*http.Response, error) {
+		return testutil.NewResponse(code, name), nil
+	})
+}
+
+func addAgent(t testing.TB, p *proxypool.Pool, name string, a proxypool.Agent, opts ...proxypool.AddOption) {
+	t.Helper()
+	if err := p.Add(name, a, opts...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addAgents(t testing.TB, p *proxypool.Pool, n int, newAgent func(name string) *testutil.MockAgent) []*testutil.MockAgent {
+	t.Helper()
+	agents := make([]*testutil.MockAgent, n)
+	for i := range agents {
+		name := fmt.Sprintf("agent%02d", i)
+		agents[i] = newAgent(name)
+		addAgent(t, p, name, agents[i])
+	}
+	return agents
+}
+
+func totalCalls(agents []*testutil.MockAgent) int {
+	n := 0
+	for _, a := range agents {
+		n += a.Calls()
+	}
+	return n
+}
+
+func readBody(t testing.TB, res *http.Response) string {
+	t.Helper()
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// captureLogger records every formatted message.
+type captureLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *captureLogger) Debugf(format string, args ...any) { l.add(format, args) }
+func (l *captureLogger) Infof(format string, args ...any)  { l.add(format, args) }
+func (l *captureLogger) Warnf(format string, args ...any)  { l.add(format, args) }
+
+func (l *captureLogger) add(format string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// connectProxy is a minimal HTTP proxy that tunnels CONNECT requests and
+// records the targets and Proxy-Authorization headers it saw.
+type connectProxy struct {
+	mu      sync.Mutex
+	targets []string
+	auth    []string
+	reject  int
+}
+
+func (p *connectProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	p.targets = append(p.targets, r.Host)
+	p.auth = append(p.auth, r.Header.Get("Proxy-Authorization"))
+	reject := p.reject
+	p.mu.Unlock()
+	if reject != 0 {
+		w.WriteHeader(reject)
+		return
+	}
+	if r.Method != http.MethodConnect {
+		http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+		return
+	}
+	upstream, err := net.Dial("tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		upstream.Close()
+		conn.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, buf)
+		upstream.Close()
+	}()
+	io.Copy(conn, upstream)
+	conn.Close()
+}
+
+func (p *connectProxy) seen() (targets, auth []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...), append([]string(nil), p.auth...)
+}
+
+// newConnectProxy starts a connectProxy and returns its URL.
+func newConnectProxy(t testing.TB) (*connectProxy, url.URL) {
+	t.Helper()
+	p := &connectProxy{}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, *u
+}
@@ -0,0 +1,104 @@
+package proxypool
+
+import (
+	"fmt"
+	"time"
+)
+
+const DefaultStateHistory = 100
+
+// WithStateHistory caps the number of state transitions kept per agent.
+// Zero or less disables the history; time spent in each state is still
+// tracked.
+func WithStateHistory(n int) Option {
+	return func(p *Pool) {
+		p.stateHistory = n
+	}
+}
+
+type Transition struct {
+	From    State     `json:"from"`
+	To      State     `json:"to"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// recordState adds r to the history if it differs from the last recorded
+// state. Agents that are StateNotifiers record only what they announce, so
+// states derived at poll time, such as running out of tokens, stay out of
+// the history. Callers must hold m.mu.
+func (m *member) recordState(r StateReport) {
+	old := m.recordedState
+	if old.State == r.State {
+		return
+	}
+	m.recordedState = r
+	m.recordTransition(old, r)
+}
+
+func (m *member) recordTransition(old, r StateReport) {
+	now := time.Now()
+	if m.timeInState == nil {
+		m.timeInState = make(map[State]time.Duration)
+	}
+	m.timeInState[old.State] += now.Sub(m.stateSince)
+	m.stateSince = now
+	limit := m.pool.stateHistory
+	if limit <= 0 {
+		return
+	}
+	m.history = append(m.history, Transition{From: old.State, To: r.State, Message: r.Message, Time: now})
+	if n := len(m.history); n > limit {
+		copy(m.history, m.history[n-limit:])
+		m.history = m.history[:limit]
+	}
+}
+
+// History returns the agent's recorded state transitions, oldest first.
+func (m *member) History() []Transition {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]Transition(nil), m.history...)
+}
+
+// TimeInState returns the total time the agent has spent in each state since
+// it was added, including the time spent so far in its current state.
+func (m *member) TimeInState() map[State]time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	r := make(map[State]time.Duration, len(m.timeInState)+1)
+	for s, d := range m.timeInState {
+		r[s] = d
+	}
+	r[m.recordedState.State] += time.Since(m.stateSince)
+	return r
+}
+
+// storedState returns the state a was explicitly given, ignoring anything
+// derived when it is polled.
+func storedState(a Agent) StateReport {
+	if r, ok := agentAs[Restorer](a); ok {
+		return r.StoredState()
+	}
+	return a.State()
+}
+
+func (p *Pool) History(name string) ([]Transition, error) {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	return m.History(), nil
+}
+
+func (p *Pool) TimeInState(name string) (map[State]time.Duration, error) {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	return m.TimeInState(), nil
+}
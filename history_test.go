@@ -0,0 +1,100 @@
+package proxypool_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+)
+
+func transitions(t *testing.T, p *proxypool.Pool, name string) string {
+	t.Helper()
+	history, err := p.History(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	for _, tr := range history {
+		s += fmt.Sprintf("%s->%s ", tr.From, tr.To)
+	}
+	return s
+}
+
+func TestHistoryRecordsSetState(t *testing.T) {
+	p := newTestPool(t, nil)
+	a := newTransportAgent(proxypool.WithLimiter(rate.NewLimiter(rate.Every(time.Hour), 1)))
+	addAgent(t, p, "a", a)
+	a.SetState(proxypool.Ok, "")
+
+	// Spending the only token makes polls report UNAVAILABLE, which is
+	// derived from the limiter and not a transition of its own.
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for i := 0; i < 3; i++ {
+		if n := p.CountByState()[proxypool.Unavailable]; n != 1 {
+			t.Fatalf("polls found %d UNAVAILABLE agents, want 1", n)
+		}
+	}
+	a.SetState(proxypool.Banned, "403")
+
+	if got, want := transitions(t, p, "a"), "UNKNOWN->OK OK->BANNED "; got != want {
+		t.Errorf("history = %q, want %q", got, want)
+	}
+	if _, err := p.History("missing"); err == nil {
+		t.Error("History of a missing agent succeeded")
+	}
+}
+
+func TestHistoryEviction(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStateHistory(2))
+	a := newTransportAgent()
+	addAgent(t, p, "a", a)
+	for _, s := range []proxypool.State{proxypool.Ok, proxypool.Banned, proxypool.Probation, proxypool.Ok} {
+		a.SetState(s, "")
+	}
+	if got, want := transitions(t, p, "a"), "BANNED->PROBATION PROBATION->OK "; got != want {
+		t.Errorf("history = %q, want the last two transitions %q", got, want)
+	}
+
+	off := newTestPool(t, nil, proxypool.WithStateHistory(0))
+	b := newTransportAgent()
+	addAgent(t, off, "b", b)
+	b.SetState(proxypool.Ok, "")
+	if got := transitions(t, off, "b"); got != "" {
+		t.Errorf("history = %q with history disabled", got)
+	}
+}
+
+func TestTimeInState(t *testing.T) {
+	p := newTestPool(t, nil)
+	a := newTransportAgent()
+	addAgent(t, p, "a", a)
+	a.SetState(proxypool.Ok, "")
+	time.Sleep(40 * time.Millisecond)
+	a.SetState(proxypool.Banned, "")
+	for i := 0; i < 3; i++ {
+		p.CountByState()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spent, err := p.TimeInState("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent[proxypool.Ok] < 40*time.Millisecond || spent[proxypool.Ok] > time.Second {
+		t.Errorf("time OK = %s, want about 40ms", spent[proxypool.Ok])
+	}
+	if spent[proxypool.Banned] < 30*time.Millisecond {
+		t.Errorf("time BANNED = %s, want it counted from SetState, not from the polls", spent[proxypool.Banned])
+	}
+	if spent[proxypool.Unknown] > 20*time.Millisecond {
+		t.Errorf("time UNKNOWN = %s, want only the moment before SetState", spent[proxypool.Unknown])
+	}
+}
@@ -0,0 +1,69 @@
+package proxypool
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const maxHostLimiters = 1024
+
+var ErrHostRateLimited = errors.New("per-host rate limit exceeded")
+
+// hostLimiters lazily creates a limiter per target host and keeps at most
+// maxHostLimiters of them, dropping the least recently used.
+type hostLimiters struct {
+	mu         sync.Mutex
+	newLimiter func(host string) *rate.Limiter
+	order      *list.List
+	limiters   map[string]*list.Element
+}
+
+type hostLimiter struct {
+	host    string
+	limiter *rate.Limiter
+}
+
+func newHostLimiters(fn func(host string) *rate.Limiter) *hostLimiters {
+	return &hostLimiters{newLimiter: fn, order: list.New(), limiters: make(map[string]*list.Element)}
+}
+
+func (h *hostLimiters) get(host string) *rate.Limiter {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e, ok := h.limiters[host]; ok {
+		h.order.MoveToFront(e)
+		return e.Value.(*hostLimiter).limiter
+	}
+	l := h.newLimiter(host)
+	h.limiters[host] = h.order.PushFront(&hostLimiter{host: host, limiter: l})
+	if h.order.Len() > maxHostLimiters {
+		oldest := h.order.Back()
+		h.order.Remove(oldest)
+		delete(h.limiters, oldest.Value.(*hostLimiter).host)
+	}
+	return l
+}
+
+// reserveHost takes a token from the request host's limiter. Unless wait is
+// set, a token that is not available right away fails with
+// ErrHostRateLimited. A nil reservation means the agent has no per-host
+// limits or the host is unlimited.
+func (a *ProxyAgentWithLimiter) reserveHost(req *http.Request, wait bool) (*reservation, error) {
+	if a.hostLimiters == nil {
+		return nil, nil
+	}
+	l := a.hostLimiters.get(req.URL.Hostname())
+	if l == nil {
+		return nil, nil
+	}
+	r := reserveAt(l)
+	if !r.OK() || (!wait && r.Delay() > 0) {
+		r.Cancel()
+		return nil, ErrHostRateLimited
+	}
+	return &r, nil
+}
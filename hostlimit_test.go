@@ -0,0 +1,98 @@
+package proxypool_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+)
+
+// twoHosts starts one server and returns URLs for it under two host names.
+func twoHosts(t *testing.T) (a, b string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(srv.Close)
+	return srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+}
+
+func perHostAgent(limiter *rate.Limiter) *proxypool.ProxyAgentWithLimiter {
+	a := proxypool.NewProxyAgentWithLimiter(url.URL{}, limiter, proxypool.WithPerHostLimiter(func(host string) *rate.Limiter {
+		return rate.NewLimiter(rate.Every(10*time.Second), 1)
+	}))
+	a.SetState(proxypool.Ok, "")
+	return a
+}
+
+func TestPerHostLimiterInterleaved(t *testing.T) {
+	hostA, hostB := twoHosts(t)
+	global := rate.NewLimiter(rate.Every(time.Hour), 10)
+	agent := perHostAgent(global)
+	defer agent.Close()
+
+	for i, tt := range []struct {
+		url string
+		err error
+	}{
+		{hostA, nil},
+		{hostB, nil},
+		{hostA, proxypool.ErrHostRateLimited},
+		{hostB, proxypool.ErrHostRateLimited},
+	} {
+		res, err := agent.Do(newRequest(t, http.MethodGet, tt.url, nil))
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("request %d to %s: err = %v, want %v", i, tt.url, err, tt.err)
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+	}
+	if tokens := global.Tokens(); tokens < 7.99 || tokens > 8.01 {
+		t.Errorf("global tokens = %.2f, want 8: rejected requests must not use the agent limiter", tokens)
+	}
+}
+
+func TestPerHostLimiterPoolSkipsDeclinedAgent(t *testing.T) {
+	hostA, hostB := twoHosts(t)
+	p := newTestPool(t, nil)
+	agents := map[string]*proxypool.ProxyAgentWithLimiter{
+		"p1": perHostAgent(nil),
+		"p2": perHostAgent(nil),
+	}
+	for name, a := range agents {
+		addAgent(t, p, name, a)
+	}
+
+	served := map[string][]string{}
+	for _, u := range []string{hostA, hostB, hostA, hostB} {
+		res, result, err := p.DoResult(newRequest(t, http.MethodGet, u, nil))
+		if err != nil {
+			t.Fatalf("request to %s: %v", u, err)
+		}
+		res.Body.Close()
+		served[u] = append(served[u], result.Agent)
+	}
+	for u, names := range served {
+		if len(names) != 2 || names[0] == names[1] {
+			t.Errorf("%s served by %v, want each agent once", u, names)
+		}
+	}
+
+	if _, err := p.Do(newRequest(t, http.MethodGet, hostA, nil)); err == nil {
+		t.Error("request succeeded with both agents over the host limit")
+	}
+	for name, a := range agents {
+		if s := a.State().State; s != proxypool.Ok {
+			t.Errorf("%s state = %s, want OK", name, s)
+		}
+		if records, _ := p.RecentErrors(name); len(records) != 0 {
+			t.Errorf("%s recorded failures %v for declined requests", name, records)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package proxypool
+
+import (
+	"sort"
+	"time"
+)
+
+const latencySampleSize = 512
+
+type latencySamples struct {
+	samples [latencySampleSize]time.Duration
+	next    int
+	count   int
+}
+
+func (s *latencySamples) add(d time.Duration) {
+	s.samples[s.next] = d
+	s.next = (s.next + 1) % latencySampleSize
+	s.count++
+}
+
+func (s *latencySamples) percentiles(ps ...float64) []time.Duration {
+	n := min(s.count, latencySampleSize)
+	r := make([]time.Duration, len(ps))
+	if n == 0 {
+		return r
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, s.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	for i, p := range ps {
+		r[i] = sorted[min(int(p*float64(n)), n-1)]
+	}
+	return r
+}
+
+type LatencyPercentiles struct {
+	P50     time.Duration
+	P95     time.Duration
+	P99     time.Duration
+	Samples int
+}
+
+func (m *member) LatencyPercentiles() LatencyPercentiles {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ps := m.latency.percentiles(0.50, 0.95, 0.99)
+	return LatencyPercentiles{P50: ps[0], P95: ps[1], P99: ps[2], Samples: m.latency.count}
+}
@@ -0,0 +1,44 @@
+package proxypool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyPercentiles(t *testing.T) {
+	m := &member{}
+	for i := 1; i <= 100; i++ {
+		m.observeLatency(time.Duration(i) * time.Millisecond)
+	}
+	got := m.LatencyPercentiles()
+	want := LatencyPercentiles{P50: 51 * time.Millisecond, P95: 96 * time.Millisecond, P99: 100 * time.Millisecond, Samples: 100}
+	if got != want {
+		t.Errorf("percentiles = %+v, want %+v", got, want)
+	}
+}
+
+func TestLatencySamplesStayBounded(t *testing.T) {
+	var s latencySamples
+	for i := 0; i < 3*latencySampleSize; i++ {
+		d := time.Second
+		if i >= 2*latencySampleSize {
+			d = time.Millisecond
+		}
+		s.add(d)
+	}
+	// Only the most recent window is kept, so the old slow samples are gone.
+	if ps := s.percentiles(0.99); ps[0] != time.Millisecond {
+		t.Errorf("p99 = %s, want 1ms from the latest samples", ps[0])
+	}
+	if s.count != 3*latencySampleSize {
+		t.Errorf("count = %d, want %d", s.count, 3*latencySampleSize)
+	}
+}
+
+func BenchmarkObserveLatency(b *testing.B) {
+	m := &member{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.observeLatency(time.Duration(i%1000) * time.Microsecond)
+	}
+}
@@ -0,0 +1,127 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrPoolRateLimited = errors.New("pool rate limit exceeded")
+	ErrPoolBusy        = errors.New("pool is at its concurrency limit")
+)
+
+func WithPoolLimiter(l *rate.Limiter, wait bool) Option {
+	return func(p *Pool) {
+		p.limiter = l
+		p.limiterWait = wait
+	}
+}
+
+func WithMaxConcurrent(n int, wait bool) Option {
+	return func(p *Pool) {
+		if n > 0 {
+			p.slots = make(chan struct{}, n)
+		}
+		p.slotsWait = wait
+	}
+}
+
+func (p *Pool) InFlight() int {
+	return int(atomic.LoadInt64(&p.inFlight))
+}
+
+func (p *Pool) enter(ctx context.Context) (func(), error) {
+	if p.slots != nil {
+		if p.slotsWait {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else {
+			select {
+			case p.slots <- struct{}{}:
+			default:
+				return nil, ErrPoolBusy
+			}
+		}
+	}
+	atomic.AddInt64(&p.inFlight, 1)
+	return func() {
+		atomic.AddInt64(&p.inFlight, -1)
+		if p.slots != nil {
+			<-p.slots
+		}
+	}, nil
+}
+
+func WithWaitForCapacity() Option {
+	return func(p *Pool) {
+		p.waitForCapacity = true
+	}
+}
+
+type tokenWaiter interface {
+	NextTokenIn() time.Duration
+}
+
+func (p *Pool) nextCapacity(req *http.Request, g *Group) (time.Duration, bool) {
+	excluded := excludedAgents(req.Context())
+	var (
+		earliest time.Duration
+		found    bool
+	)
+	for _, m := range p.members() {
+		if !p.inScope(m, req, g) || contains(excluded, m.Name()) {
+			continue
+		}
+		w, ok := agentAs[tokenWaiter](m.Agent)
+		if !ok || m.State().State != Unavailable {
+			continue
+		}
+		d := w.NextTokenIn()
+		if d <= 0 || d == rate.InfDuration {
+			continue
+		}
+		if !found || d < earliest {
+			earliest, found = d, true
+		}
+	}
+	return earliest, found
+}
+
+func (cl *call) waitForAgents(g *Group) ([]Agent, error) {
+	ctx := cl.req.Context()
+	for {
+		agents, err := cl.pool.getOkAgents(cl.req, g)
+		if err != nil || len(agents) > 0 || !cl.pool.waitForCapacity {
+			return agents, err
+		}
+		d, ok := cl.pool.nextCapacity(cl.req, g)
+		if !ok {
+			return agents, nil
+		}
+		cl.pool.logger.Debugf("no capacity for %s, waiting %s", cl.req.URL.Host, d)
+		if err := sleepContext(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *Pool) acquire(ctx context.Context) error {
+	if p.limiter == nil {
+		return nil
+	}
+	if p.limiterWait {
+		return p.limiter.Wait(ctx)
+	}
+	if !p.limiter.Allow() {
+		return ErrPoolRateLimited
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package proxypool_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestPoolLimiterNonBlocking(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	p := newTestPool(t, nil, proxypool.WithPoolLimiter(limiter, false))
+	agent := statusAgent("proxy1", http.StatusOK)
+	addAgent(t, p, "proxy1", agent)
+
+	if _, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if !errors.Is(err, proxypool.ErrPoolRateLimited) {
+		t.Fatalf("err = %v, want ErrPoolRateLimited", err)
+	}
+	if agent.Calls() != 1 {
+		t.Errorf("calls = %d, want 1", agent.Calls())
+	}
+}
+
+func TestPoolLimiterBlocking(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(100*time.Millisecond), 1)
+	p := newTestPool(t, nil, proxypool.WithPoolLimiter(limiter, true))
+	agent := statusAgent("proxy1", http.StatusOK)
+	addAgent(t, p, "proxy1", agent)
+
+	if _, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	start := time.Now()
+	if _, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err != nil {
+		t.Fatalf("second request: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("second request returned after %s, want it to wait for a token", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx)); err == nil {
+		t.Fatal("request succeeded although its context expired before a token was available")
+	}
+	if agent.Calls() != 2 {
+		t.Errorf("calls = %d, want 2", agent.Calls())
+	}
+}
+
+func TestPoolLimiterChargedOncePerRequest(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	p := newTestPool(t, retryOnFailure,
+		proxypool.WithPoolLimiter(limiter, false),
+		proxypool.WithStrategy(proxypool.RoundRobin()),
+	)
+	failing := []*testutil.MockAgent{
+		statusAgent("a", http.StatusBadGateway),
+		statusAgent("b", http.StatusBadGateway),
+	}
+	ok := statusAgent("c", http.StatusOK)
+	addAgent(t, p, "a", failing[0])
+	addAgent(t, p, "b", failing[1])
+	addAgent(t, p, "c", ok)
+
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	res.Body.Close()
+	if got := totalCalls(failing) + ok.Calls(); got != 3 {
+		t.Errorf("calls = %d, want 3", got)
+	}
+	if tokens := limiter.Tokens(); tokens < -0.01 {
+		t.Errorf("limiter tokens = %.2f, retries consumed pool tokens", tokens)
+	}
+}
+
+// concurrencyProbe records the highest number of overlapping calls.
+type concurrencyProbe struct {
+	current, max int64
+}
+
+func (c *concurrencyProbe) handle(d time.Duration) func(*http.Request) (*http.Response, error) {
+	return func(*http.Request) (*http.Response, error) {
+		n := atomic.AddInt64(&c.current, 1)
+		for {
+			m := atomic.LoadInt64(&c.max)
+			if n <= m || atomic.CompareAndSwapInt64(&c.max, m, n) {
+				break
+			}
+		}
+		time.Sleep(d)
+		atomic.AddInt64(&c.current, -1)
+		return testutil.NewResponse(http.StatusOK, ""), nil
+	}
+}
+
+func TestMaxConcurrentBlocks(t *testing.T) {
+	const n = 3
+	probe := &concurrencyProbe{}
+	p := newTestPool(t, nil, proxypool.WithMaxConcurrent(n, true))
+	addAgents(t, p, 2*n, func(name string) *testutil.MockAgent {
+		return testutil.NewMockAgent(name).HandleFunc(probe.handle(20 * time.Millisecond))
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < 2*n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if err != nil {
+				errs <- err
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Do: %v", err)
+	}
+	if got := atomic.LoadInt64(&probe.max); got > n {
+		t.Errorf("max concurrent executions = %d, want at most %d", got, n)
+	}
+	if got := p.InFlight(); got != 0 {
+		t.Errorf("InFlight = %d after all requests finished", got)
+	}
+}
+
+func TestMaxConcurrentNonBlocking(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p := newTestPool(t, nil, proxypool.WithMaxConcurrent(1, false))
+	addAgent(t, p, "proxy1", testutil.NewMockAgent("proxy1").HandleFunc(func(*http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return testutil.NewResponse(http.StatusOK, ""), nil
+	}))
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	<-started
+	if got := p.InFlight(); got != 1 {
+		t.Errorf("InFlight = %d, want 1", got)
+	}
+
+	rec := httptest.NewRecorder()
+	p.StatusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var status struct {
+		InFlight int `json:"in_flight"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.InFlight != 1 {
+		t.Errorf("status handler in_flight = %d, want 1", status.InFlight)
+	}
+
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if !errors.Is(err, proxypool.ErrPoolBusy) {
+		t.Errorf("err = %v, want ErrPoolBusy", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+}
+
+func TestMaxConcurrentRespectsContext(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	p := newTestPool(t, nil, proxypool.WithMaxConcurrent(1, true))
+	addAgent(t, p, "proxy1", testutil.NewMockAgent("proxy1").HandleFunc(func(*http.Request) (*http.Response, error) {
+		close(started)
+		<-release
+		return testutil.NewResponse(http.StatusOK, ""), nil
+	}))
+	go p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	<-started
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func limitedAgent(t testing.TB, hits *int64, every time.Duration) *proxypool.ProxyAgentWithLimiter {
+	t.Helper()
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(hits, 1)
+	})
+	limiter := rate.NewLimiter(rate.Every(every), 1)
+	limiter.Allow()
+	a := proxypool.NewProxyAgentWithLimiter(proxy, limiter)
+	a.SetState(proxypool.Ok, "")
+	return a
+}
+
+func TestWaitForCapacityWakesForSoonerAgent(t *testing.T) {
+	var slowHits, fastHits int64
+	p := newTestPool(t, nil, proxypool.WithWaitForCapacity())
+	addAgent(t, p, "slow", limitedAgent(t, &slowHits, time.Second))
+	addAgent(t, p, "fast", limitedAgent(t, &fastHits, 150*time.Millisecond))
+
+	start := time.Now()
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	res.Body.Close()
+	elapsed := time.Since(start)
+	if elapsed < 100*time.Millisecond || elapsed > 700*time.Millisecond {
+		t.Errorf("Do returned after %s, want about 150ms", elapsed)
+	}
+	if fastHits != 1 || slowHits != 0 {
+		t.Errorf("hits: fast=%d slow=%d, want 1 and 0", fastHits, slowHits)
+	}
+}
+
+func TestWaitForCapacityHonorsContext(t *testing.T) {
+	var hits int64
+	p := newTestPool(t, nil, proxypool.WithWaitForCapacity())
+	addAgent(t, p, "slow", limitedAgent(t, &hits, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Do returned after %s, wait was not cancelled", elapsed)
+	}
+	if hits != 0 {
+		t.Errorf("hits = %d, want 0", hits)
+	}
+}
+
+func TestWithoutWaitForCapacityFailsFast(t *testing.T) {
+	var hits int64
+	p := newTestPool(t, nil)
+	addAgent(t, p, "slow", limitedAgent(t, &hits, time.Hour))
+
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if !errors.Is(err, proxypool.ErrNoHealthyAgents) {
+		t.Errorf("err = %v, want ErrNoHealthyAgents", err)
+	}
+}
@@ -0,0 +1,50 @@
+package proxypool
+
+import (
+	"log"
+)
+
+type Logger interface {
+	Debugf(format string, args ...any)
+	Infof(format string, args ...any)
+	Warnf(format string, args ...any)
+}
+
+func WithLogger(l Logger) Option {
+	return func(p *Pool) {
+		if l == nil {
+			l = NopLogger()
+		}
+		p.logger = l
+	}
+}
+
+type stdLogger struct{}
+
+func StdLogger() Logger {
+	return stdLogger{}
+}
+
+func (stdLogger) Debugf(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+func (stdLogger) Infof(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+func (stdLogger) Warnf(format string, args ...any) {
+	log.Printf(format, args...)
+}
+
+type nopLogger struct{}
+
+func NopLogger() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debugf(format string, args ...any) {}
+
+func (nopLogger) Infof(format string, args ...any) {}
+
+func (nopLogger) Warnf(format string, args ...any) {}
@@ -0,0 +1,67 @@
+package proxypool_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"testing"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestLoggerReceivesRetryMessages(t *testing.T) {
+	logger := &captureLogger{}
+	p := newTestPool(t, retryOnFailure, proxypool.WithMaxRetry(2), proxypool.WithLogger(logger))
+	addAgents(t, p, 3, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	p.Do(newRequest(t, http.MethodGet, "http://example.com/path", nil))
+	for _, want := range []string{
+		"try #1/2 for example.com",
+		"retry #2/2 for example.com",
+		"max retry (2) reached for example.com",
+	} {
+		if !logger.contains(want) {
+			t.Errorf("missing log %q in %q", want, logger.msgs)
+		}
+	}
+}
+
+func TestCustomLoggerSilencesGlobalLog(t *testing.T) {
+	var global bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&global)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	logger := &captureLogger{}
+	p := proxypool.New(retryOnFailure, proxypool.WithLogger(logger), proxypool.WithRetryBackoff(nil))
+	defer p.Close()
+	addAgents(t, p, 4, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if len(logger.msgs) == 0 {
+		t.Fatal("custom logger received nothing")
+	}
+	if global.Len() > 0 {
+		t.Errorf("global logger received %q", global.String())
+	}
+}
+
+func TestNilLoggerIsSilent(t *testing.T) {
+	var global bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&global)
+	t.Cleanup(func() { log.SetOutput(prev) })
+
+	p := proxypool.New(retryOnFailure, proxypool.WithLogger(nil), proxypool.WithRetryBackoff(nil))
+	defer p.Close()
+	addAgents(t, p, 4, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusBadGateway)
+	})
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if global.Len() > 0 {
+		t.Errorf("global logger received %q", global.String())
+	}
+}
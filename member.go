@@ -0,0 +1,204 @@
+package proxypool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+type AddOption func(*member)
+
+func WithWeight(weight int) AddOption {
+	return func(m *member) {
+		m.weight = weight
+	}
+}
+
+func AsFallback() AddOption {
+	return func(m *member) {
+		m.fallback = true
+	}
+}
+
+func WithTags(tags ...string) AddOption {
+	return func(m *member) {
+		m.tags = append(m.tags, tags...)
+	}
+}
+
+func (p *Pool) newMember(name string, agent Agent, opts []AddOption) *member {
+	m := &member{Agent: agent, name: name, weight: 1, pool: p, stats: newRollingStats(), stateSince: time.Now()}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if n, ok := agent.(StateNotifier); ok {
+		m.notified = true
+		m.recordedState = storedState(agent)
+		n.NotifyStateChange(func(r StateReport) {
+			m.mu.Lock()
+			m.recordState(r)
+			m.mu.Unlock()
+			m.observeState(r)
+		})
+	}
+	return m
+}
+
+type member struct {
+	Agent
+	weight   int
+	tags     []string
+	pool     *Pool
+	stats    *rollingStats
+	fallback bool
+
+	mu            sync.RWMutex
+	name          string
+	latencyEWMA   time.Duration
+	latency       latencySamples
+	recentErrors  errorRing
+	history       []Transition
+	timeInState   map[State]time.Duration
+	stateSince    time.Time
+	recordedState StateReport
+	notified      bool
+	lastState     StateReport
+	failures      int
+	bytesSent     int64
+	bytesReceived int64
+}
+
+func (m *member) Name() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.name
+}
+
+func (m *member) Weight() int {
+	return m.weight
+}
+
+func (m *member) InFlight() int {
+	if f, ok := m.Agent.(interface{ InFlight() int }); ok {
+		return f.InFlight()
+	}
+	return 0
+}
+
+func (m *member) Tags() []string {
+	return append([]string(nil), m.tags...)
+}
+
+func (m *member) hasTags(tags []string) bool {
+	for _, t := range tags {
+		if !contains(m.tags, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *member) State() StateReport {
+	r := m.Agent.State()
+	m.observeState(r)
+	return r
+}
+
+func (m *member) observeState(r StateReport) {
+	m.mu.Lock()
+	old := m.lastState
+	if old.State == r.State {
+		m.mu.Unlock()
+		return
+	}
+	m.lastState = r
+	if !m.notified {
+		m.recordState(r)
+	}
+	m.mu.Unlock()
+	name := m.Name()
+	m.pool.emit(Event{Type: EventStateChanged, Agent: name, Detail: fmt.Sprintf("%s -> %s", old.State, r.State)})
+	if fn := m.pool.onStateChange; fn != nil {
+		fn(name, old, r)
+	}
+}
+
+func (m *member) Info() Info {
+	info := m.Agent.Info()
+	info.Name = m.Name()
+	info.Tags = m.Tags()
+	info.LatencyEWMA = m.LatencyEWMA().Truncate(time.Millisecond).String()
+	latency := m.LatencyPercentiles()
+	info.LatencyP50 = latency.P50.Truncate(time.Millisecond).String()
+	info.LatencyP95 = latency.P95.Truncate(time.Millisecond).String()
+	info.LatencyP99 = latency.P99.Truncate(time.Millisecond).String()
+	info.LatencySamples = latency.Samples
+	info.BytesSent, info.BytesReceived = m.Bytes()
+	info.SuccessRate1m = m.Stats(time.Minute).SuccessRate()
+	info.SuccessRate10m = m.Stats(10 * time.Minute).SuccessRate()
+	return info
+}
+
+const latencyEWMAAlpha = 0.3
+
+func (m *member) LatencyEWMA() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.latencyEWMA
+}
+
+func (m *member) observeLatency(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.latency.add(d)
+	if m.latencyEWMA == 0 {
+		m.latencyEWMA = d
+		return
+	}
+	m.latencyEWMA = time.Duration(latencyEWMAAlpha*float64(d) + (1-latencyEWMAAlpha)*float64(m.latencyEWMA))
+}
+
+func isFallback(a Agent) bool {
+	if m, ok := a.(*member); ok && m.fallback {
+		return true
+	}
+	f, ok := agentAs[interface{ Fallback() bool }](a)
+	return ok && f.Fallback()
+}
+
+func AgentName(a Agent) string {
+	if n, ok := a.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return a.Info().Name
+}
+
+func unwrap(a Agent) Agent {
+	if m, ok := a.(*member); ok {
+		return m.Agent
+	}
+	return a
+}
+
+// agentAs returns the outermost layer of a that implements T, looking through
+// pool members and decorators that expose Unwrap() Agent. Optional
+// capabilities such as Pauser stay reachable however deeply an agent is
+// wrapped.
+func agentAs[T any](a Agent) (T, bool) {
+	for a != nil {
+		if m, ok := a.(*member); ok {
+			a = m.Agent
+			continue
+		}
+		if t, ok := a.(T); ok {
+			return t, true
+		}
+		u, ok := a.(interface{ Unwrap() Agent })
+		if !ok {
+			break
+		}
+		a = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
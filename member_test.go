@@ -0,0 +1,99 @@
+package proxypool_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+	"golang.org/x/time/rate"
+)
+
+type transitionLog struct {
+	mu  sync.Mutex
+	log []string
+}
+
+func (l *transitionLog) record(name string, old, new proxypool.StateReport) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.log = append(l.log, fmt.Sprintf("%s: %s -> %s", name, old.State, new.State))
+}
+
+func (l *transitionLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.log...)
+}
+
+func TestOnStateChangeSequence(t *testing.T) {
+	var transitions transitionLog
+	var p *proxypool.Pool
+	p = newTestPool(t, nil, proxypool.WithOnStateChange(func(name string, old, new proxypool.StateReport) {
+		// Querying the agent from the callback must not deadlock.
+		if a, ok := p.Get(name); ok {
+			a.State()
+			a.Info()
+		}
+		transitions.record(name, old, new)
+	}))
+	a := newTransportAgent()
+	addAgent(t, p, "a", a)
+	a.SetState(proxypool.Ok, "checked")
+	a.SetState(proxypool.Banned, "403")
+	a.SetState(proxypool.Banned, "403 again")
+	a.SetState(proxypool.Ok, "recovered")
+	want := []string{"a: UNKNOWN -> OK", "a: OK -> BANNED", "a: BANNED -> OK"}
+	got := transitions.get()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("transitions = %q, want %q", got, want)
+	}
+}
+
+func TestOnStateChangeDerivedState(t *testing.T) {
+	var transitions transitionLog
+	p := newTestPool(t, nil, proxypool.WithOnStateChange(transitions.record))
+	a := proxypool.NewProxyAgentWithLimiter(url.URL{Scheme: "http", Host: "proxy.invalid:8080"},
+		rate.NewLimiter(rate.Every(time.Hour), 1), proxypool.WithTransport(okTransport{}))
+	addAgent(t, p, "a", a)
+	a.SetState(proxypool.Ok, "")
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	p.CountByState()
+	want := []string{"a: UNKNOWN -> OK", "a: OK -> UNAVAILABLE"}
+	if got := transitions.get(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("transitions = %q, want %q", got, want)
+	}
+}
+
+func TestStatsFollowMiddlewareVerdict(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithMaxRetry(1))
+	agent := testutil.NewMockAgent("proxy1").
+		EnqueueStatus(http.StatusOK, "").
+		EnqueueStatus(http.StatusBadGateway, "").
+		EnqueueError(errors.New("connection reset")).
+		EnqueueStatus(http.StatusOK, "")
+	addAgent(t, p, "proxy1", agent)
+	for i := 0; i < 4; i++ {
+		p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	}
+	stats, ok := p.Stats("proxy1", time.Minute)
+	if !ok {
+		t.Fatal("Stats(proxy1) not found")
+	}
+	if stats != (proxypool.WindowStats{Successes: 2, Failures: 2, Total: 4}) {
+		t.Errorf("stats = %+v", stats)
+	}
+	info := p.Status()[0]
+	if info.SuccessRate1m != 0.5 || info.SuccessRate10m != 0.5 {
+		t.Errorf("success rates = %.2f/%.2f, want 0.5", info.SuccessRate1m, info.SuccessRate10m)
+	}
+}
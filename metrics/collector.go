@@ -0,0 +1,132 @@
+package metrics
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yozel/proxypool"
+)
+
+var (
+	_ prometheus.Collector = (*Collector)(nil)
+	_ proxypool.Recorder   = (*Collector)(nil)
+)
+
+type Collector struct {
+	pool *proxypool.Pool
+
+	state    *prometheus.Desc
+	tokens   *prometheus.Desc
+	inFlight *prometheus.Desc
+
+	requests *prometheus.CounterVec
+	retries  *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	bytes    *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+func NewCollector(pool *proxypool.Pool) *Collector {
+	c := &Collector{
+		pool: pool,
+		state: prometheus.NewDesc(
+			"proxypool_agent_state",
+			"Current state of the agent, 1 for the active state.",
+			[]string{"agent", "state"}, nil,
+		),
+		tokens: prometheus.NewDesc(
+			"proxypool_agent_tokens",
+			"Rate limiter tokens currently available to the agent.",
+			[]string{"agent"}, nil,
+		),
+		inFlight: prometheus.NewDesc(
+			"proxypool_agent_in_flight_requests",
+			"Requests currently executing on the agent.",
+			[]string{"agent"}, nil,
+		),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxypool_requests_total",
+			Help: "Attempts sent through an agent.",
+		}, []string{"agent"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxypool_retries_total",
+			Help: "Attempts the middleware asked to retry on another agent.",
+		}, []string{"agent"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxypool_errors_total",
+			Help: "Attempts that failed with an error.",
+		}, []string{"agent"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "proxypool_bytes_total",
+			Help: "Body bytes transferred through an agent.",
+		}, []string{"agent", "direction"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "proxypool_attempt_duration_seconds",
+			Help:    "Latency of a single attempt through an agent.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"agent", "status"}),
+	}
+	pool.AddRecorder(c)
+	return c
+}
+
+func (c *Collector) RecordAttempt(r proxypool.AttemptRecord) {
+	c.requests.WithLabelValues(r.Agent).Inc()
+	if r.Err != nil {
+		c.errors.WithLabelValues(r.Agent).Inc()
+	}
+	c.bytes.WithLabelValues(r.Agent, "sent").Add(float64(r.BytesSent))
+	c.bytes.WithLabelValues(r.Agent, "received").Add(float64(r.BytesReceived))
+	c.latency.WithLabelValues(r.Agent, statusClass(r)).Observe(r.Latency.Seconds())
+}
+
+func (c *Collector) RecordRetry(agent string) {
+	c.retries.WithLabelValues(agent).Inc()
+}
+
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.state
+	ch <- c.tokens
+	ch <- c.inFlight
+	c.requests.Describe(ch)
+	c.retries.Describe(ch)
+	c.errors.Describe(ch)
+	c.bytes.Describe(ch)
+	c.latency.Describe(ch)
+}
+
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range c.pool.List() {
+		a, ok := c.pool.Get(name)
+		if !ok {
+			continue
+		}
+		current := a.State().State
+		for _, s := range proxypool.States() {
+			v := 0.0
+			if s == current {
+				v = 1
+			}
+			ch <- prometheus.MustNewConstMetric(c.state, prometheus.GaugeValue, v, name, s.String())
+		}
+		if t, ok := a.(interface{ Tokens() float64 }); ok && !math.IsInf(t.Tokens(), 1) {
+			ch <- prometheus.MustNewConstMetric(c.tokens, prometheus.GaugeValue, t.Tokens(), name)
+		}
+		if f, ok := a.(interface{ InFlight() int }); ok {
+			ch <- prometheus.MustNewConstMetric(c.inFlight, prometheus.GaugeValue, float64(f.InFlight()), name)
+		}
+	}
+	c.requests.Collect(ch)
+	c.retries.Collect(ch)
+	c.errors.Collect(ch)
+	c.bytes.Collect(ch)
+	c.latency.Collect(ch)
+}
+
+func statusClass(r proxypool.AttemptRecord) string {
+	if r.Err != nil || r.StatusCode == 0 {
+		return "error"
+	}
+	return strconv.Itoa(r.StatusCode/100) + "xx"
+}
@@ -0,0 +1,114 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/metrics"
+	mock "github.com/yozel/proxypool/testutil"
+)
+
+type okTransport struct{}
+
+func (okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := mock.NewResponse(http.StatusOK, "hello")
+	res.Request = req
+	return res, nil
+}
+
+func TestCollector(t *testing.T) {
+	p := proxypool.New(func(c *proxypool.Context) {
+		c.Retry = c.Err != nil
+	}, proxypool.WithLogger(proxypool.NopLogger()), proxypool.WithRetryBackoff(nil))
+	defer p.Close()
+	good := proxypool.NewProxyAgentWithLimiter(url.URL{Scheme: "http", Host: "good.invalid:8080"},
+		rate.NewLimiter(rate.Every(time.Hour), 5), proxypool.WithTransport(okTransport{}))
+	good.SetState(proxypool.Ok, "")
+	bad := mock.NewMockAgent("bad").HandleFunc(func(*http.Request) (*http.Response, error) {
+		return nil, errors.New("connection reset")
+	})
+	p.Add("good", good)
+	p.Add("bad", bad)
+
+	reg := prometheus.NewPedanticRegistry()
+	c := metrics.NewCollector(p)
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"good", "good", "bad"} {
+		req, _ := http.NewRequestWithContext(proxypool.WithAgent(context.Background(), name), http.MethodGet, "http://example.com", nil)
+		if res, err := p.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+	bad.SetState(proxypool.Banned, "403")
+
+	var want strings.Builder
+	want.WriteString(`
+# HELP proxypool_requests_total Attempts sent through an agent.
+# TYPE proxypool_requests_total counter
+proxypool_requests_total{agent="bad"} 1
+proxypool_requests_total{agent="good"} 2
+# HELP proxypool_errors_total Attempts that failed with an error.
+# TYPE proxypool_errors_total counter
+proxypool_errors_total{agent="bad"} 1
+# HELP proxypool_bytes_total Body bytes transferred through an agent.
+# TYPE proxypool_bytes_total counter
+proxypool_bytes_total{agent="bad",direction="received"} 0
+proxypool_bytes_total{agent="bad",direction="sent"} 0
+proxypool_bytes_total{agent="good",direction="received"} 10
+proxypool_bytes_total{agent="good",direction="sent"} 0
+# HELP proxypool_agent_state Current state of the agent, 1 for the active state.
+# TYPE proxypool_agent_state gauge
+`)
+	for _, agent := range []struct {
+		name  string
+		state proxypool.State
+	}{{"bad", proxypool.Banned}, {"good", proxypool.Ok}} {
+		for _, s := range proxypool.States() {
+			v := 0
+			if s == agent.state {
+				v = 1
+			}
+			fmt.Fprintf(&want, "proxypool_agent_state{agent=%q,state=%q} %d\n", agent.name, s.String(), v)
+		}
+	}
+	err := testutil.CollectAndCompare(c, strings.NewReader(want.String()),
+		"proxypool_requests_total", "proxypool_errors_total", "proxypool_bytes_total",
+		"proxypool_agent_state")
+	if err != nil {
+		t.Error(err)
+	}
+	// Tokens refill continuously, so only the whole part is stable.
+	if n := testutil.CollectAndCount(c, "proxypool_agent_tokens"); n != 1 {
+		t.Errorf("token gauges = %d, want 1 for the limited agent only", n)
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "proxypool_agent_tokens" {
+			if v := mf.GetMetric()[0].GetGauge().GetValue(); v < 3 || v >= 3.5 {
+				t.Errorf("tokens = %v, want about 3", v)
+			}
+		}
+	}
+	if n := testutil.CollectAndCount(c, "proxypool_attempt_duration_seconds"); n != 2 {
+		t.Errorf("latency histograms = %d, want one per agent and status class", n)
+	}
+	if problems, err := testutil.CollectAndLint(c); err != nil || len(problems) > 0 {
+		t.Errorf("lint: %v %v", problems, err)
+	}
+}
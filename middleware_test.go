@@ -0,0 +1,110 @@
+package proxypool_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestMiddlewareChainLaterWins(t *testing.T) {
+	var order []string
+	p := newTestPool(t, func(c *proxypool.Context) {
+		order = append(order, "first")
+		c.Retry = true
+	})
+	p.Use(func(c *proxypool.Context) {
+		order = append(order, "second")
+		if !c.Retry {
+			t.Error("second middleware did not see Retry set by the first")
+		}
+		c.Retry = false
+	})
+	a, b := statusAgent("a", http.StatusOK), statusAgent("b", http.StatusOK)
+	addAgent(t, p, "a", a)
+	addAgent(t, p, "b", b)
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if a.Calls()+b.Calls() != 1 {
+		t.Errorf("calls a=%d b=%d, want a single attempt after Retry was cleared", a.Calls(), b.Calls())
+	}
+	if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+		t.Errorf("middleware order = %v", order)
+	}
+}
+
+func TestMiddlewareChainLaterSetsRetry(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.RoundRobin()))
+	p.Use(func(c *proxypool.Context) {}, retryOnFailure)
+	bad, good := statusAgent("a", http.StatusBadGateway), statusAgent("b", http.StatusOK)
+	addAgent(t, p, "a", bad)
+	addAgent(t, p, "b", good)
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "b" || bad.Calls() != 1 {
+		t.Errorf("served by %s after %d calls to a, want a retry on b", result.Agent, bad.Calls())
+	}
+}
+
+func TestNoMiddlewareNeverRetries(t *testing.T) {
+	p := newTestPool(t, nil)
+	a, b := statusAgent("a", http.StatusBadGateway), statusAgent("b", http.StatusBadGateway)
+	addAgent(t, p, "a", a)
+	addAgent(t, p, "b", b)
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway || a.Calls()+b.Calls() != 1 {
+		t.Errorf("status %d after %d calls, want the first response as-is", res.StatusCode, a.Calls()+b.Calls())
+	}
+}
+
+func TestRequestHookPerAttempt(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	p.UseRequest(func(req *http.Request, a proxypool.Agent) {
+		if req.Header.Get("X-Session") != "" {
+			t.Errorf("attempt on %s saw a header injected for another agent", proxypool.AgentName(a))
+		}
+		req.Header.Set("X-Session", "session-"+proxypool.AgentName(a))
+		if tagged, ok := a.(interface{ Tags() []string }); ok {
+			for _, tag := range tagged.Tags() {
+				req.Header.Add("X-Tag", tag)
+			}
+		}
+	})
+	a, b := statusAgent("a", http.StatusBadGateway), statusAgent("b", http.StatusOK)
+	addAgent(t, p, "a", a, proxypool.WithTags("residential"))
+	addAgent(t, p, "b", b, proxypool.WithTags("datacenter"))
+	req := newRequest(t, http.MethodGet, "http://example.com", nil)
+	res, err := p.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if len(a.Requests()) != 1 || len(b.Requests()) != 1 {
+		t.Fatalf("requests a=%d b=%d, want one each", len(a.Requests()), len(b.Requests()))
+	}
+	if got := a.Requests()[0].Header.Get("X-Session"); got != "session-a" {
+		t.Errorf("agent a received X-Session %q", got)
+	}
+	if got := b.Requests()[0].Header.Get("X-Session"); got != "session-b" {
+		t.Errorf("agent b received X-Session %q", got)
+	}
+	if got := a.Requests()[0].Header.Get("X-Tag"); got != "residential" {
+		t.Errorf("agent a received X-Tag %q", got)
+	}
+	if got := b.Requests()[0].Header.Get("X-Tag"); got != "datacenter" {
+		t.Errorf("agent b received X-Tag %q", got)
+	}
+	if req.Header.Get("X-Session") != "" {
+		t.Error("request hook mutated the caller's request")
+	}
+}
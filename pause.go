@@ -0,0 +1,33 @@
+package proxypool
+
+import "fmt"
+
+type Pauser interface {
+	Pause()
+	Resume()
+}
+
+var ErrPauseUnsupported = fmt.Errorf("agent does not support pausing")
+
+func (p *Pool) Pause(name string) error {
+	return p.pauser(name, Pauser.Pause)
+}
+
+func (p *Pool) Resume(name string) error {
+	return p.pauser(name, Pauser.Resume)
+}
+
+func (p *Pool) pauser(name string, fn func(Pauser)) error {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	pa, ok := agentAs[Pauser](m.Agent)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPauseUnsupported, name)
+	}
+	fn(pa)
+	return nil
+}
@@ -0,0 +1,78 @@
+package proxypool_test
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestPauseMidTraffic(t *testing.T) {
+	var aHits, bHits int64
+	started, release := make(chan struct{}), make(chan struct{})
+	a := proxypool.NewProxyAgent(newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&aHits, 1) == 1 {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("a"))
+	}))
+	b := proxypool.NewProxyAgent(newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&bHits, 1)
+	}))
+	a.SetState(proxypool.Ok, "")
+	b.SetState(proxypool.Ok, "")
+	p := newTestPool(t, nil)
+	addAgent(t, p, "a", a)
+
+	inFlight := make(chan string, 1)
+	go func() {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			inFlight <- err.Error()
+			return
+		}
+		inFlight <- readBody(t, res)
+	}()
+	<-started
+	addAgent(t, p, "b", b)
+	if err := p.Pause("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if a, b := atomic.LoadInt64(&aHits), atomic.LoadInt64(&bHits); a != 1 || b != 20 {
+		t.Errorf("hits while paused: a=%d b=%d, want 1 and 20", a, b)
+	}
+	if _, err := a.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentPaused) {
+		t.Errorf("Do on paused agent = %v, want ErrAgentPaused", err)
+	}
+	if paused := p.StatusByState(proxypool.Paused); len(paused) != 1 || paused[0].Name != "a" {
+		t.Errorf("paused agents = %v, want only a", statusNames(paused))
+	}
+	if n := len(p.StatusByState(proxypool.Banned)); n != 0 {
+		t.Errorf("%d agents reported as banned", n)
+	}
+
+	close(release)
+	if body := <-inFlight; body != "a" {
+		t.Errorf("in-flight request on the paused agent = %q, want it to complete", body)
+	}
+	if err := p.Resume("a"); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.State().State; s != proxypool.Ok {
+		t.Errorf("state after Resume = %s, want OK", s)
+	}
+	if err := p.Pause("missing"); !errors.Is(err, proxypool.ErrAgentNotFound) {
+		t.Errorf("Pause(missing) = %v, want ErrAgentNotFound", err)
+	}
+}
@@ -1,73 +1,307 @@
 package proxypool
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
-	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"sync"
 	"time"
 
-	"golang.org/x/net/context"
+	"golang.org/x/time/rate"
 )
 
 const (
 	MaxRetry = 3
 )
 
+type Option func(*Pool)
+
+func WithMaxRetry(n int) Option {
+	return func(p *Pool) {
+		p.maxRetry = n
+	}
+}
+
+func WithOnStateChange(fn func(name string, old, new StateReport)) Option {
+	return func(p *Pool) {
+		p.onStateChange = fn
+	}
+}
+
+func WithRemoveExpired() Option {
+	return func(p *Pool) {
+		p.removeExpired = true
+	}
+}
+
+func WithStrategy(s Strategy) Option {
+	return func(p *Pool) {
+		p.strategy = s
+	}
+}
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
 type Pool struct {
-	mu         sync.RWMutex
-	agents     map[string]Agent
-	middleware func(c *Context)
+	totalRequests uint64
+	totalRetries  uint64
+	inFlight      int64
+	events        events
+
+	mu              sync.RWMutex
+	agents          map[string]*member
+	middlewares     []func(c *Context)
+	requestHooks    []func(req *http.Request, a Agent)
+	onStateChange   func(name string, old, new StateReport)
+	recorders       []Recorder
+	logger          Logger
+	maxRetry        int
+	evictAfter      int
+	onEvict         func(name string, a Agent)
+	onSyncError     func(err error)
+	removeExpired   bool
+	stateHistory    int
+	strategy        Strategy
+	backoff         func(attempt int) time.Duration
+	hedgeDelay      time.Duration
+	hedgeParallel   int
+	minRetryBudget  time.Duration
+	streaming       bool
+	maxBodySize     int64
+	groups          map[string]*Group
+	done            chan struct{}
+	closeOnce       sync.Once
+	limiter         *rate.Limiter
+	limiterWait     bool
+	slots           chan struct{}
+	slotsWait       bool
+	waitForCapacity bool
+	tracer          Tracer
 }
 
-func New(fn func(c *Context)) *Pool {
+func New(fn func(c *Context), opts ...Option) *Pool {
 	p := &Pool{
-		agents:     make(map[string]Agent),
-		middleware: fn,
+		agents:         make(map[string]*member),
+		groups:         make(map[string]*Group),
+		done:           make(chan struct{}),
+		maxRetry:       MaxRetry,
+		strategy:       LeastRecentlyUsed(),
+		logger:         StdLogger(),
+		minRetryBudget: DefaultMinRetryBudget,
+		stateHistory:   DefaultStateHistory,
+		backoff:        ExponentialBackoff(DefaultRetryBackoffBase, DefaultRetryBackoffMax),
+	}
+	if fn != nil {
+		p.middlewares = append(p.middlewares, fn)
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
 	return p
 }
 
+func (p *Pool) Use(fns ...func(c *Context)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.middlewares = append(p.middlewares, fns...)
+}
+
+func (p *Pool) UseRequest(fns ...func(req *http.Request, a Agent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requestHooks = append(p.requestHooks, fns...)
+}
+
+func (p *Pool) getRequestHooks() []func(req *http.Request, a Agent) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.requestHooks[:len(p.requestHooks):len(p.requestHooks)]
+}
+
+func (p *Pool) getMiddlewares() []func(c *Context) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.middlewares[:len(p.middlewares):len(p.middlewares)]
+}
+
+func (p *Pool) members() []*member {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return values(p.agents)
+}
+
 func (p *Pool) Status() []Info {
-	r := make([]Info, 0, len(p.agents))
+	members := p.members()
+	r := make([]Info, 0, len(members))
+	for _, m := range members {
+		r = append(r, m.Info())
+	}
+	return r
+}
+
+func (p *Pool) StatusSorted() []Info {
+	members := sortSlice(p.members(), func(a, b *member) bool {
+		return a.Name() < b.Name()
+	})
+	r := make([]Info, 0, len(members))
+	for _, m := range members {
+		r = append(r, m.Info())
+	}
+	return r
+}
+
+func (p *Pool) StatusWhere(fn func(Info) bool) []Info {
+	return filter(fn, p.StatusSorted())
+}
+
+func (p *Pool) StatusByState(states ...State) []Info {
+	members := sortSlice(p.members(), func(a, b *member) bool {
+		return a.Name() < b.Name()
+	})
+	r := make([]Info, 0, len(members))
+	for _, m := range members {
+		if contains(states, m.State().State) {
+			r = append(r, m.Info())
+		}
+	}
+	return r
+}
+
+func (p *Pool) Len() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	for _, a := range p.agents {
-		r = append(r, a.Info())
+	return len(p.agents)
+}
+
+func (p *Pool) CountByState() map[State]int {
+	r := make(map[State]int)
+	for _, m := range p.members() {
+		r[m.State().State]++
 	}
 	return r
 }
 
-func (p *Pool) Add(name string, agent Agent) {
+var ErrAgentExists = fmt.Errorf("agent already exists")
+
+func (p *Pool) Add(name string, agent Agent, opts ...AddOption) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	if _, ok := p.agents[name]; !ok {
-		p.agents[name] = agent
-	} else {
-		log.Printf("agent %s already exists", name)
+	if _, ok := p.agents[name]; ok {
+		return fmt.Errorf("%w: %s", ErrAgentExists, name)
+	}
+	p.agents[name] = p.newMember(name, agent, opts)
+	p.emit(Event{Type: EventAgentAdded, Agent: name})
+	return nil
+}
+
+func (p *Pool) AddOrReplace(name string, agent Agent, opts ...AddOption) (Agent, bool) {
+	p.mu.Lock()
+	m, ok := p.agents[name]
+	p.agents[name] = p.newMember(name, agent, opts)
+	p.mu.Unlock()
+	if !ok {
+		p.emit(Event{Type: EventAgentAdded, Agent: name})
+		return nil, false
 	}
+	p.emit(Event{Type: EventAgentAdded, Agent: name, Detail: "replaced"})
+	if m.Agent != agent {
+		m.Close()
+	}
+	return m.Agent, true
+}
+
+func (p *Pool) Get(name string) (Agent, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	m, ok := p.agents[name]
+	if !ok {
+		return nil, false
+	}
+	return m.Agent, true
 }
 
+var ErrAgentNotFound = fmt.Errorf("agent not found")
+
 func (p *Pool) Delete(name string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	agent, ok := p.agents[name]
 	if !ok {
-		return fmt.Errorf("agent %s not found", name)
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, name)
 	}
 	agent.Close()
 	delete(p.agents, name)
+	for _, g := range p.groups {
+		g.Remove(name)
+	}
+	p.emit(Event{Type: EventAgentDeleted, Agent: name})
 	return nil
 }
 
+func (p *Pool) Rename(old, new string) error {
+	p.mu.Lock()
+	m, ok := p.agents[old]
+	if !ok {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, old)
+	}
+	if _, ok := p.agents[new]; ok {
+		p.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrAgentExists, new)
+	}
+	delete(p.agents, old)
+	p.agents[new] = m
+	m.mu.Lock()
+	m.name = new
+	m.mu.Unlock()
+	for _, g := range p.groups {
+		g.rename(old, new)
+	}
+	p.mu.Unlock()
+	p.emit(Event{Type: EventAgentRenamed, Agent: new, Detail: old})
+	return nil
+}
+
+func (p *Pool) Prune(states ...State) []string {
+	var targets []*member
+	for _, m := range p.members() {
+		if contains(states, m.State().State) {
+			targets = append(targets, m)
+		}
+	}
+	removed := make([]*member, 0, len(targets))
+	p.mu.Lock()
+	for _, m := range targets {
+		if p.agents[m.Name()] != m {
+			continue
+		}
+		delete(p.agents, m.Name())
+		for _, g := range p.groups {
+			g.Remove(m.Name())
+		}
+		removed = append(removed, m)
+	}
+	p.mu.Unlock()
+	names := make([]string, 0, len(removed))
+	for _, m := range removed {
+		m.Close()
+		p.emit(Event{Type: EventAgentDeleted, Agent: m.Name(), Detail: "pruned"})
+		names = append(names, m.Name())
+	}
+	return names
+}
+
+func (p *Pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	for _, m := range p.members() {
+		m.Close()
+	}
+}
+
 func (p *Pool) List() []string {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -78,120 +312,88 @@ func (p *Pool) List() []string {
 	return result
 }
 
-func (p *Pool) getOkAgents() []Agent {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-	healthyAgents := p.getAgents(Ok)
-	timeoutFirst, timeoutLast := splitSlice(shuffleSlice(p.getAgents(OutOfDate)), 1)
-	result := concatSlice(timeoutFirst, healthyAgents, timeoutLast)
+func (p *Pool) ListTagged(tags ...string) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	result := make([]string, 0, len(p.agents))
+	for name, m := range p.agents {
+		if m.hasTags(tags) {
+			result = append(result, name)
+		}
+	}
 	return result
 }
 
-func (p *Pool) getAgents(health State) []Agent {
-	allAgents := values(p.agents)
-	result := filter(func(a Agent) bool {
-		return a.State().State == health
-	}, allAgents)
-	return sortSlice(result, func(a, b Agent) bool {
-		return a.LastRequestTime().Before(b.LastRequestTime())
-	})
+type closeIdler interface {
+	CloseIdleConnections()
 }
 
-var ErrNoHealthyAgents = fmt.Errorf("no healthy agents")
-
-type Context struct {
-	*http.Response
-	Err   error
-	Agent Agent
-	Retry bool
-	Body  []byte
-}
-
-func newContext(agent Agent, res *http.Response, err error) (*Context, error) {
-	if err != nil {
-		return &Context{
-			Response: nil,
-			Err:      err,
-			Agent:    agent,
-			Body:     nil,
-		}, nil
-	}
-	if res == nil {
-		return nil, errors.New("response is nil but error is also nil")
-	}
-	defer res.Body.Close()
-	bodyBytes, err := io.ReadAll(res.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
-	return &Context{
-		Response: res,
-		Err:      nil,
-		Agent:    agent,
-		Body:     bodyBytes,
-	}, nil
-}
-
-func (p *Pool) Do(req *http.Request) (*http.Response, error) {
-	var (
-		bodyBytes []byte
-		err       error
-	)
-	if req.Body != nil {
-		bodyBytes, err = io.ReadAll(req.Body)
-		if err != nil {
-			return nil, err
+func (p *Pool) CloseIdleConnections() {
+	for _, m := range p.members() {
+		if c, ok := m.Agent.(closeIdler); ok {
+			c.CloseIdleConnections()
 		}
 	}
-	factory := func() *http.Request {
-		tmp := req.Clone(req.Context())
-		if bodyBytes != nil {
-			tmp.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-		}
-		return tmp
-	}
+}
 
-	for i, a := range p.getOkAgents() {
-		if i+1 > MaxRetry {
-			log.Printf("max retry reached for %s", a.Info().Name)
-			break
-		}
-		if i+1 > 1 {
-			log.Printf("retry #%d with agent %s", i+1, a.Info().Name)
-		} else {
-			log.Printf("try #%d with agent %s", i+1, a.Info().Name)
-		}
-		res, err := a.Do(factory())
-		if errors.Is(err, context.Canceled) {
-			return nil, err
-		}
-		c, err := newContext(a, res, err)
-		if err != nil {
-			return nil, err
+func (p *Pool) getOkAgents(req *http.Request, g *Group) ([]Agent, error) {
+	if name, ok := pinnedAgent(req.Context()); ok {
+		return p.getPinnedAgent(name, g)
+	}
+	excluded := excludedAgents(req.Context())
+	members := p.members()
+	candidates := make([]Agent, 0, len(members))
+	skipped, expired := 0, false
+	for _, m := range members {
+		s := m.State().State
+		expired = expired || s == Expired
+		if s != Ok && s != OutOfDate && s != Probation {
+			continue
 		}
-		p.middleware(c)
-		if c.Retry {
+		if !p.inScope(m, req, g) {
 			continue
 		}
-		if c.Err != nil {
-			return nil, c.Err
+		if contains(excluded, m.Name()) {
+			skipped++
+			continue
 		}
-		res2 := &http.Response{
-			Status:           c.Status,
-			StatusCode:       c.StatusCode,
-			Proto:            c.Proto,
-			ProtoMajor:       c.ProtoMajor,
-			ProtoMinor:       c.ProtoMinor,
-			Header:           c.Header.Clone(),
-			ContentLength:    c.ContentLength,
-			TransferEncoding: c.TransferEncoding,
-			Close:            false,
-			Uncompressed:     c.Uncompressed,
-			Trailer:          c.Trailer.Clone(),
-			Request:          c.Request,
+		candidates = append(candidates, m)
+	}
+	if expired && p.removeExpired {
+		go p.Prune(Expired)
+	}
+	if len(candidates) == 0 && skipped > 0 {
+		return nil, fmt.Errorf("%w: all candidates excluded %v", ErrNoHealthyAgents, excluded)
+	}
+	return fallbackLast(p.strategy.Select(candidates, req)), nil
+}
+
+func fallbackLast(agents []Agent) []Agent {
+	primary := make([]Agent, 0, len(agents))
+	var fallback []Agent
+	for _, a := range agents {
+		if isFallback(a) {
+			fallback = append(fallback, a)
+		} else {
+			primary = append(primary, a)
 		}
-		res2.Body = io.NopCloser(bytes.NewReader(c.Body))
-		return res2, nil
 	}
-	return nil, ErrNoHealthyAgents
+	return append(primary, fallback...)
+}
+
+func (p *Pool) inScope(m *member, req *http.Request, g *Group) bool {
+	return m.hasTags(requiredTags(req.Context())) && (g == nil || g.Has(m.Name()))
+}
+
+func (p *Pool) getPinnedAgent(name string, g *Group) ([]Agent, error) {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok || (g != nil && !g.Has(name)) {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	if m.State().State == Closed {
+		return nil, fmt.Errorf("%w: %s", ErrAgentClosed, name)
+	}
+	return []Agent{m}, nil
 }
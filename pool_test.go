@@ -0,0 +1,284 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// okTransport answers every request with 200 without touching the network.
+type okTransport struct{}
+
+func (okTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := testutil.NewResponse(http.StatusOK, "ok")
+	res.Request = req
+	return res, nil
+}
+
+func newTransportAgent(opts ...proxypool.AgentOption) *proxypool.ProxyAgentWithLimiter {
+	opts = append([]proxypool.AgentOption{proxypool.WithTransport(okTransport{})}, opts...)
+	return proxypool.NewProxyAgent(url.URL{Scheme: "http", Host: "proxy.invalid:8080"}, opts...)
+}
+
+func TestGetReturnsRegisteredAgent(t *testing.T) {
+	p := newTestPool(t, nil)
+	a := testutil.NewMockAgent("a")
+	addAgent(t, p, "a", a)
+	got, ok := p.Get("a")
+	if !ok || got != a {
+		t.Fatalf("Get(a) = %v, %v", got, ok)
+	}
+	if _, ok := p.Get("missing"); ok {
+		t.Error("Get(missing) reported ok")
+	}
+}
+
+func TestGetAfterDeleteRespectsClosedState(t *testing.T) {
+	p := newTestPool(t, nil)
+	addAgent(t, p, "a", newTransportAgent())
+	a, ok := p.Get("a")
+	if !ok {
+		t.Fatal("agent not found")
+	}
+	if err := p.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentClosed) {
+		t.Errorf("Do after Delete = %v, want ErrAgentClosed", err)
+	}
+}
+
+// Run with -race.
+func TestGetDeleteRace(t *testing.T) {
+	p := newTestPool(t, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			p.Add("a", newTransportAgent())
+		}()
+		go func() {
+			defer wg.Done()
+			p.Delete("a")
+		}()
+		go func() {
+			defer wg.Done()
+			a, ok := p.Get("a")
+			if !ok {
+				return
+			}
+			res, err := a.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if err != nil {
+				if !errors.Is(err, proxypool.ErrAgentClosed) {
+					t.Errorf("Do = %v, want nil or ErrAgentClosed", err)
+				}
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+type generationTransport string
+
+func (g generationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := testutil.NewResponse(http.StatusOK, string(g))
+	res.Request = req
+	return res, nil
+}
+
+func TestAddOrReplaceDuringDo(t *testing.T) {
+	p := newTestPool(t, nil)
+	newAgent := func(gen int) proxypool.Agent {
+		return proxypool.NewProxyAgent(url.URL{Scheme: "http", Host: "proxy.invalid:8080"},
+			proxypool.WithTransport(generationTransport(fmt.Sprint(gen))))
+	}
+	addAgent(t, p, "proxy1", newAgent(0))
+
+	const generations = 20
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	served := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				ctx := proxypool.WithAgent(context.Background(), "proxy1")
+				res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+				if errors.Is(err, proxypool.ErrAgentNotFound) {
+					t.Errorf("Do during swap: %v", err)
+					return
+				}
+				if err != nil {
+					continue
+				}
+				body := readBody(t, res)
+				mu.Lock()
+				served[body]++
+				mu.Unlock()
+			}
+		}()
+	}
+	for gen := 1; gen <= generations; gen++ {
+		old, replaced := p.AddOrReplace("proxy1", newAgent(gen))
+		if !replaced || old == nil {
+			t.Fatalf("generation %d: replaced = %v, old = %v", gen, replaced, old)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if len(served) < 2 {
+		t.Errorf("requests were served by %d generations, want several", len(served))
+	}
+}
+
+func TestPruneRemovesTargetedStates(t *testing.T) {
+	p := newTestPool(t, nil)
+	states := map[string]proxypool.State{
+		"banned1": proxypool.Banned,
+		"banned2": proxypool.Banned,
+		"error":   proxypool.Error,
+		"ok":      proxypool.Ok,
+		"unknown": proxypool.Unknown,
+	}
+	agents := make(map[string]*testutil.MockAgent)
+	for name, s := range states {
+		a := statusAgent(name, http.StatusOK)
+		a.SetState(s, "")
+		agents[name] = a
+		addAgent(t, p, name, a)
+	}
+	events, unsubscribe := p.Subscribe()
+
+	removed := p.Prune(proxypool.Banned, proxypool.Error)
+	sort.Strings(removed)
+	if fmt.Sprint(removed) != "[banned1 banned2 error]" {
+		t.Errorf("Prune = %v, want [banned1 banned2 error]", removed)
+	}
+	if got := sortedList(p); fmt.Sprint(got) != "[ok unknown]" {
+		t.Errorf("remaining = %v, want [ok unknown]", got)
+	}
+	for name, a := range agents {
+		if want := name != "ok" && name != "unknown"; a.Closed() != want {
+			t.Errorf("agent %s closed = %v, want %v", name, a.Closed(), want)
+		}
+	}
+
+	unsubscribe()
+	var deleted []string
+	for e := range events {
+		if e.Type == proxypool.EventAgentDeleted && e.Detail == "pruned" {
+			deleted = append(deleted, e.Agent)
+		}
+	}
+	sort.Strings(deleted)
+	if fmt.Sprint(deleted) != fmt.Sprint(removed) {
+		t.Errorf("delete events = %v, want %v", deleted, removed)
+	}
+	if got := p.Prune(proxypool.Banned); len(got) != 0 {
+		t.Errorf("second Prune = %v, want nothing", got)
+	}
+}
+
+func TestRemoveExpired(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithRemoveExpired())
+	short := newTransportAgent(proxypool.WithTTL(20*time.Millisecond, false))
+	long := newTransportAgent()
+	short.SetState(proxypool.Ok, "")
+	long.SetState(proxypool.Ok, "")
+	addAgent(t, p, "short", short)
+	addAgent(t, p, "long", long)
+
+	time.Sleep(30 * time.Millisecond)
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if !waitFor(t, time.Second, func() bool { return p.Len() == 1 }) {
+		t.Fatalf("agents = %v, want the expired one removed", sortedList(p))
+	}
+	if _, ok := p.Get("long"); !ok {
+		t.Error("agent without TTL was removed")
+	}
+	if s := short.State().State; s != proxypool.Closed {
+		t.Errorf("removed agent state = %s, want CLOSED", s)
+	}
+}
+
+func TestRename(t *testing.T) {
+	p := newTestPool(t, nil)
+	a := statusAgent("a", http.StatusOK)
+	addAgent(t, p, "old", a)
+	addAgent(t, p, "taken", statusAgent("taken", http.StatusOK))
+	g := p.Group("site")
+	if err := g.Add("old"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		req := newRequest(t, http.MethodGet, "http://example.com", nil)
+		res, err := p.Do(req.WithContext(proxypool.WithAgent(req.Context(), "old")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	a.SetState(proxypool.Probation, "watching")
+	events, unsubscribe := p.Subscribe()
+
+	if err := p.Rename("old", "taken"); !errors.Is(err, proxypool.ErrAgentExists) {
+		t.Errorf("Rename onto an existing name = %v, want ErrAgentExists", err)
+	}
+	if err := p.Rename("missing", "other"); !errors.Is(err, proxypool.ErrAgentNotFound) {
+		t.Errorf("Rename of a missing agent = %v, want ErrAgentNotFound", err)
+	}
+	if err := p.Rename("old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	unsubscribe()
+
+	if _, ok := p.Get("old"); ok {
+		t.Error("old name still resolves")
+	}
+	got, ok := p.Get("new")
+	if !ok || got != a {
+		t.Fatal("new name does not resolve to the same agent")
+	}
+	if s := got.State(); s.State != proxypool.Probation || s.Message != "watching" {
+		t.Errorf("state = %s %q, want it kept across the rename", s.State, s.Message)
+	}
+	if stats, _ := p.Stats("new", time.Minute); stats.Total != 2 {
+		t.Errorf("stats total = %d, want 2 carried over", stats.Total)
+	}
+	if !g.Has("new") || g.Has("old") {
+		t.Errorf("group members = %v, want [new]", g.List())
+	}
+	var renamed []proxypool.Event
+	for e := range events {
+		if e.Type == proxypool.EventAgentRenamed {
+			renamed = append(renamed, e)
+		}
+	}
+	if len(renamed) != 1 || renamed[0].Agent != "new" || renamed[0].Detail != "old" {
+		t.Errorf("rename events = %+v, want one from old to new", renamed)
+	}
+}
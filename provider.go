@@ -0,0 +1,153 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type Provider interface {
+	Proxies(ctx context.Context) (map[string]url.URL, error)
+}
+
+type ProviderFunc func(ctx context.Context) (map[string]url.URL, error)
+
+func (f ProviderFunc) Proxies(ctx context.Context) (map[string]url.URL, error) {
+	return f(ctx)
+}
+
+// LimitProvider is implemented by providers that also carry per-proxy rate
+// limits. Sync compares them along with the URL and adjusts the existing
+// agent's limiter when only the limits changed.
+type LimitProvider interface {
+	Limits(name string) (r rate.Limit, burst int, ok bool)
+}
+
+type AgentFactory func(name string, u url.URL) (Agent, error)
+
+func WithOnSyncError(fn func(err error)) Option {
+	return func(p *Pool) {
+		p.onSyncError = fn
+	}
+}
+
+type syncer struct {
+	pool     *Pool
+	provider Provider
+	factory  AgentFactory
+	known    map[string]proxySpec
+}
+
+type proxySpec struct {
+	url   string
+	rate  rate.Limit
+	burst int
+}
+
+func (p *Pool) newSyncer(provider Provider, factory AgentFactory) *syncer {
+	return &syncer{pool: p, provider: provider, factory: factory, known: make(map[string]proxySpec)}
+}
+
+func (p *Pool) Sync(ctx context.Context, provider Provider, interval time.Duration, factory AgentFactory) error {
+	if provider == nil || factory == nil {
+		return errors.New("provider and agent factory are required")
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	s := p.newSyncer(provider, factory)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			s.sync(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *syncer) sync(ctx context.Context) {
+	proxies, err := s.provider.Proxies(ctx)
+	if err != nil {
+		s.pool.syncError(err)
+		return
+	}
+	s.apply(proxies)
+}
+
+func (s *syncer) apply(proxies map[string]url.URL) {
+	p := s.pool
+	for name, u := range proxies {
+		spec := s.spec(name, u)
+		if prev, ok := s.known[name]; ok && prev.url == spec.url {
+			if _, ok := p.Get(name); ok {
+				if prev == spec {
+					continue
+				}
+				if spec.rate > 0 && spec.burst > 0 && p.SetRate(name, spec.rate, spec.burst) == nil {
+					p.logger.Infof("sync: updated rate of agent %s", name)
+					s.known[name] = spec
+					continue
+				}
+			}
+		}
+		_, known := s.known[name]
+		if _, ok := p.Get(name); ok && !known {
+			// Added outside this provider; leave it alone.
+			p.logger.Debugf("sync: skipping agent %s, already in pool", name)
+			continue
+		}
+		agent, err := s.factory(name, u)
+		if err != nil {
+			p.syncError(err)
+			continue
+		}
+		if !known {
+			if err := p.Add(name, agent); err != nil {
+				agent.Close()
+				p.logger.Debugf("sync: skipping agent %s: %v", name, err)
+				continue
+			}
+			p.logger.Infof("sync: added agent %s", name)
+		} else if _, replaced := p.AddOrReplace(name, agent); replaced {
+			p.logger.Infof("sync: replaced agent %s", name)
+		} else {
+			p.logger.Infof("sync: added agent %s", name)
+		}
+		s.known[name] = spec
+	}
+	for name := range s.known {
+		if _, ok := proxies[name]; ok {
+			continue
+		}
+		delete(s.known, name)
+		if err := p.Delete(name); err == nil {
+			p.logger.Infof("sync: deleted agent %s", name)
+		}
+	}
+}
+
+func (s *syncer) spec(name string, u url.URL) proxySpec {
+	spec := proxySpec{url: u.String()}
+	if lp, ok := s.provider.(LimitProvider); ok {
+		spec.rate, spec.burst, _ = lp.Limits(name)
+	}
+	return spec
+}
+
+func (p *Pool) syncError(err error) {
+	p.logger.Warnf("sync: %v", err)
+	if p.onSyncError != nil {
+		p.onSyncError(err)
+	}
+}
@@ -0,0 +1,188 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// fakeProvider serves a proxy list that tests can swap between syncs.
+type fakeProvider struct {
+	mu      sync.Mutex
+	proxies map[string]url.URL
+	err     error
+	calls   int
+}
+
+func (f *fakeProvider) Proxies(ctx context.Context) (map[string]url.URL, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	r := make(map[string]url.URL, len(f.proxies))
+	for k, v := range f.proxies {
+		r[k] = v
+	}
+	return r, nil
+}
+
+func (f *fakeProvider) set(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = nil
+	f.proxies = make(map[string]url.URL, len(names))
+	for _, name := range names {
+		f.proxies[name] = url.URL{Scheme: "http", Host: name + ".invalid:8080"}
+	}
+}
+
+func (f *fakeProvider) fail(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// waitCalls waits until n more syncs have completed. Sync applies the list
+// after Proxies returns, so it waits for one poll beyond that.
+func (f *fakeProvider) waitCalls(t *testing.T, n int) {
+	t.Helper()
+	f.mu.Lock()
+	target := f.calls + n + 1
+	f.mu.Unlock()
+	ok := waitFor(t, time.Second, func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.calls >= target
+	})
+	if !ok {
+		t.Fatal("provider was not polled")
+	}
+}
+
+// mockFactory creates MockAgents and remembers them by name.
+type mockFactory struct {
+	mu      sync.Mutex
+	created map[string][]*testutil.MockAgent
+}
+
+func (f *mockFactory) new(name string, u url.URL) (proxypool.Agent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a := testutil.NewMockAgent(name)
+	f.created[name] = append(f.created[name], a)
+	return a, nil
+}
+
+func (f *mockFactory) agents(name string) []*testutil.MockAgent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.created[name]
+}
+
+func sortedList(p *proxypool.Pool) []string {
+	names := p.List()
+	sort.Strings(names)
+	return names
+}
+
+func TestSyncAddRemoveSteadyState(t *testing.T) {
+	var syncErrs []error
+	var mu sync.Mutex
+	p := newTestPool(t, nil, proxypool.WithOnSyncError(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		syncErrs = append(syncErrs, err)
+	}))
+	provider := &fakeProvider{}
+	provider.set("a", "b")
+	factory := &mockFactory{created: make(map[string][]*testutil.MockAgent)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Sync(ctx, provider, 5*time.Millisecond, factory.new); err != nil {
+		t.Fatal(err)
+	}
+	provider.waitCalls(t, 1)
+	if got := sortedList(p); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("pool = %v, want [a b]", got)
+	}
+
+	// Unchanged entries keep their agent and its state.
+	factory.agents("a")[0].SetState(proxypool.Banned, "")
+	provider.waitCalls(t, 3)
+	if n := len(factory.agents("a")); n != 1 {
+		t.Errorf("agent a created %d times across steady-state syncs", n)
+	}
+	if a, _ := p.Get("a"); a.State().State != proxypool.Banned {
+		t.Errorf("state of a = %s, want BANNED to survive syncs", a.State().State)
+	}
+
+	provider.set("b", "c")
+	provider.waitCalls(t, 2)
+	if got := sortedList(p); len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatalf("pool = %v, want [b c]", got)
+	}
+	if !factory.agents("a")[0].Closed() {
+		t.Error("removed agent a was not closed")
+	}
+
+	// Provider errors are reported and leave the pool as it was.
+	provider.fail(errors.New("provider down"))
+	provider.waitCalls(t, 2)
+	if got := sortedList(p); len(got) != 2 {
+		t.Errorf("pool = %v after provider error, want it unchanged", got)
+	}
+	mu.Lock()
+	if len(syncErrs) == 0 {
+		t.Error("OnSyncError was not called")
+	}
+	mu.Unlock()
+}
+
+func TestSyncRequiresProviderAndFactory(t *testing.T) {
+	p := newTestPool(t, nil)
+	if err := p.Sync(context.Background(), nil, time.Second, nil); err == nil {
+		t.Error("Sync accepted a nil provider and factory")
+	}
+}
+
+func TestSyncKeepsAgentsAddedByHand(t *testing.T) {
+	p := newTestPool(t, nil)
+	manual := testutil.NewMockAgent("a")
+	addAgent(t, p, "a", manual)
+	provider := &fakeProvider{}
+	provider.set("a", "b")
+	factory := &mockFactory{created: make(map[string][]*testutil.MockAgent)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := p.Sync(ctx, provider, 5*time.Millisecond, factory.new); err != nil {
+		t.Fatal(err)
+	}
+	provider.waitCalls(t, 2)
+	if got := sortedList(p); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("pool = %v, want [a b]", got)
+	}
+	if a, _ := p.Get("a"); a != manual {
+		t.Error("sync replaced the agent added by hand")
+	}
+	if manual.Closed() {
+		t.Error("agent added by hand was closed")
+	}
+
+	// Sync never owned it, so dropping it from the list leaves it in place.
+	provider.set("b")
+	provider.waitCalls(t, 2)
+	if a, ok := p.Get("a"); !ok || a != manual {
+		t.Error("sync deleted the agent added by hand")
+	}
+}
@@ -1,8 +1,9 @@
 package proxypool
 
 import (
+	"context"
 	"fmt"
-	"net"
+	"math"
 	"net/http"
 	"net/url"
 	"sync"
@@ -11,39 +12,128 @@ import (
 	"golang.org/x/time/rate"
 )
 
-var _ Agent = (*ProxyAgentWithLimiter)(nil)
+var (
+	_ Agent         = (*ProxyAgentWithLimiter)(nil)
+	_ Suspender     = (*ProxyAgentWithLimiter)(nil)
+	_ StateNotifier = (*ProxyAgentWithLimiter)(nil)
+	_ Prober        = (*ProxyAgentWithLimiter)(nil)
+	_ Restorer      = (*ProxyAgentWithLimiter)(nil)
+	_ AgentFeedback = (*ProxyAgentWithLimiter)(nil)
+	_ HealthChecker = (*ProxyAgentWithLimiter)(nil)
+	_ StatsResetter = (*ProxyAgentWithLimiter)(nil)
+	_ Pauser        = (*ProxyAgentWithLimiter)(nil)
+	_ RateSetter    = (*ProxyAgentWithLimiter)(nil)
+)
 
 type ProxyAgentWithLimiter struct {
-	mu              sync.RWMutex
-	url             url.URL
-	limiter         *rate.Limiter
-	state           StateReport
-	requests        int
-	lastRequestTime time.Time
-	client          *http.Client
-	wg              sync.WaitGroup
-	closed          bool
-}
-
-func NewProxyAgentWithLimiter(url url.URL, limiter *rate.Limiter) *ProxyAgentWithLimiter {
-	return &ProxyAgentWithLimiter{
-		url:     url,
-		limiter: limiter,
-		client: &http.Client{
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(&url),
-				DialContext: (&net.Dialer{
-					Timeout:   10 * time.Second,
-					KeepAlive: 300 * time.Second,
-				}).DialContext,
-				ForceAttemptHTTP2:     false,
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-			},
-		},
+	mu                sync.RWMutex
+	url               url.URL
+	limiter           *rate.Limiter
+	state             StateReport
+	requests          int
+	lastRequestTime   time.Time
+	client            *http.Client
+	wg                sync.WaitGroup
+	closed            bool
+	suspendedUntil    time.Time
+	suspendedMsg      string
+	listeners         []func(StateReport)
+	inFlight          int
+	maxInFlight       int
+	blockingLimiter   bool
+	staleAfter        time.Duration
+	staleAfterState   map[State]time.Duration
+	okStaleAfter      time.Duration
+	bandwidth         *rate.Limiter
+	hostLimiters      *hostLimiters
+	throughput        bandwidthMeter
+	banCooldown       time.Duration
+	probing           bool
+	transport         transportConfig
+	refundOnConnError bool
+	chargeOnSuccess   bool
+	pending           []reservation
+	lastLatency       time.Duration
+	avgLatency        time.Duration
+	lastCompletedAt   time.Time
+	defaultHeaders    http.Header
+	userAgent         func() string
+	checkConsumes     bool
+	paused            bool
+	pausedAt          time.Time
+	ttl               time.Duration
+	ttlFromFirstUse   bool
+	expiresAt         time.Time
+	user              string
+	pass              string
+	credentialSource  bool
+}
+
+const DefaultStaleAfter = 300 * time.Second
+
+var (
+	ErrAgentBusy    = fmt.Errorf("agent is at its in-flight limit")
+	ErrAgentPaused  = fmt.Errorf("agent is paused")
+	ErrAgentExpired = fmt.Errorf("agent TTL elapsed")
+
+	ErrCredentialSource = fmt.Errorf("agent credentials come from a credential source")
+)
+
+func NewProxyAgent(url url.URL, opts ...AgentOption) *ProxyAgentWithLimiter {
+	return NewProxyAgentWithLimiter(url, nil, opts...)
+}
+
+func NewProxyAgentWithLimiter(url url.URL, limiter *rate.Limiter, opts ...AgentOption) *ProxyAgentWithLimiter {
+	a := &ProxyAgentWithLimiter{
+		url:        url,
+		limiter:    limiter,
+		staleAfter: DefaultStaleAfter,
+		transport:  defaultTransportConfig(),
+	}
+	a.user = url.User.Username()
+	a.pass, _ = url.User.Password()
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.credentialSource = a.transport.credentials != nil
+	if !a.credentialSource {
+		a.transport.credentials = a.credentials
+	}
+	if a.ttl > 0 && !a.ttlFromFirstUse {
+		a.expiresAt = time.Now().Add(a.ttl)
+	}
+	a.client = a.transport.newClient(a.url)
+	return a
+}
+
+func (a *ProxyAgentWithLimiter) credentials() (string, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.user, a.pass
+}
+
+// UpdateCredentials replaces the proxy credentials and drops idle
+// connections. An AuthFailed agent goes back to Ok only if the credentials
+// changed. Agents built with WithCredentialSource read their credentials from
+// that function and return ErrCredentialSource.
+func (a *ProxyAgentWithLimiter) UpdateCredentials(user, pass string) error {
+	a.mu.Lock()
+	if a.credentialSource {
+		a.mu.Unlock()
+		return ErrCredentialSource
+	}
+	changed := a.user != user || a.pass != pass
+	a.user, a.pass = user, pass
+	authFailed := a.state.State == AuthFailed
+	a.mu.Unlock()
+	if !changed {
+		return nil
 	}
+	a.CloseIdleConnections()
+	if authFailed {
+		a.SetState(Ok, "credentials updated")
+	}
+	return nil
 }
 
 func (a *ProxyAgentWithLimiter) LastRequestTime() time.Time {
@@ -53,33 +143,174 @@ func (a *ProxyAgentWithLimiter) LastRequestTime() time.Time {
 }
 
 func (a *ProxyAgentWithLimiter) Info() Info {
+	user, pass := a.transport.credentials()
 	a.mu.RLock()
 	defer a.mu.RUnlock()
+	var tokens *float64
+	var next time.Duration
+	var nextText string
+	if a.limiter != nil {
+		t := a.limiter.Tokens()
+		tokens = &t
+		next = tokenDelay(a.limiter)
+		nextText = next.Truncate(time.Second).String()
+	}
 	return Info{
 		Name:                 a.url.Host,
-		State:                fmt.Sprintf("%s, %d tokens", a.State().String(), int(a.limiter.Tokens())),
+		Scheme:               a.url.Scheme,
+		URL:                  redactURL(a.url, user, pass),
+		State:                a.stateText(),
 		LastRequestTimestamp: time.Since(a.lastRequestTime).Truncate(time.Second).String(),
+		Report:               a.currentState(),
+		Tokens:               tokens,
+		LastRequestTime:      a.lastRequestTime,
 		Requests:             a.requests,
+		InFlight:             a.inFlight,
+		AvgLatencyMs:         milliseconds(a.avgLatency),
+		LastLatencyMs:        milliseconds(a.lastLatency),
+		TTLRemaining:         a.ttlRemaining(),
+		NextTokenIn:          nextText,
+		NextTokenInSeconds:   next.Seconds(),
+		Throughput:           a.throughput.current(),
+	}
+}
+
+func (a *ProxyAgentWithLimiter) observeLatency(d time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lastLatency = d
+	a.lastCompletedAt = time.Now()
+	if a.avgLatency == 0 {
+		a.avgLatency = d
+		return
+	}
+	a.avgLatency = time.Duration(latencyEWMAAlpha*float64(d) + (1-latencyEWMAAlpha)*float64(a.avgLatency))
+}
+
+func (a *ProxyAgentWithLimiter) ResetStats() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests = 0
+	a.lastLatency = 0
+	a.avgLatency = 0
+	a.lastCompletedAt = time.Time{}
+	a.throughput.reset()
+}
+
+func (a *ProxyAgentWithLimiter) LastCompletedTime() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lastCompletedAt
+}
+
+func (a *ProxyAgentWithLimiter) InFlight() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.inFlight
+}
+
+func (a *ProxyAgentWithLimiter) stateText() string {
+	if a.limiter == nil {
+		return a.currentState().String()
+	}
+	return fmt.Sprintf("%s, %d tokens", a.currentState().String(), int(a.limiter.Tokens()))
+}
+
+func (a *ProxyAgentWithLimiter) SetRate(r rate.Limit, burst int) {
+	if a.limiter == nil {
+		return
+	}
+	a.limiter.SetLimit(r)
+	a.limiter.SetBurst(burst)
+}
+
+func (a *ProxyAgentWithLimiter) Limited() bool {
+	return a.limiter != nil
+}
+
+func (a *ProxyAgentWithLimiter) Tokens() float64 {
+	if a.limiter == nil {
+		return math.Inf(1)
+	}
+	return a.limiter.Tokens()
+}
+
+var unlimited = rate.NewLimiter(rate.Inf, 0)
+
+// reservation is a token taken at a known time. rate.Reservation.Cancel
+// gives nothing back once the token's time to act has passed, which is
+// always the case after the request has run, so refunds cancel as of the
+// moment the token was taken.
+type reservation struct {
+	*rate.Reservation
+	at time.Time
+}
+
+func reserveAt(l *rate.Limiter) reservation {
+	now := time.Now()
+	return reservation{Reservation: l.ReserveN(now, 1), at: now}
+}
+
+func (r reservation) Cancel() {
+	r.CancelAt(r.at)
+}
+
+func (a *ProxyAgentWithLimiter) reserve() reservation {
+	if a.limiter == nil {
+		return reserveAt(unlimited)
+	}
+	return reserveAt(a.limiter)
+}
+
+func (a *ProxyAgentWithLimiter) NextTokenIn() time.Duration {
+	if a.limiter == nil {
+		return 0
+	}
+	return tokenDelay(a.limiter)
+}
+
+func tokenDelay(l *rate.Limiter) time.Duration {
+	tokens, limit := l.Tokens(), l.Limit()
+	switch {
+	case tokens >= 1 || limit == rate.Inf:
+		return 0
+	case limit <= 0 || l.Burst() < 1:
+		return rate.InfDuration
 	}
+	return time.Duration((1 - tokens) / float64(limit) * float64(time.Second))
 }
 
 func (a *ProxyAgentWithLimiter) Close() {
 	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
 	a.closed = true
 	client := a.client
 	a.client = nil
 	a.mu.Unlock()
+	client.CloseIdleConnections()
+	a.wg.Wait()
+	client.CloseIdleConnections()
+}
+
+func (a *ProxyAgentWithLimiter) CloseIdleConnections() {
+	a.mu.RLock()
+	client := a.client
+	a.mu.RUnlock()
 	if client != nil {
 		client.CloseIdleConnections()
-		a.wg.Wait()
-		client.CloseIdleConnections()
 	}
-	a.client = nil
 }
 
 func (a *ProxyAgentWithLimiter) State() StateReport {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
+	return a.currentState()
+}
+
+func (a *ProxyAgentWithLimiter) currentState() StateReport {
 	if a.closed {
 		return StateReport{
 			State:     Closed,
@@ -87,64 +318,372 @@ func (a *ProxyAgentWithLimiter) State() StateReport {
 			Timestamp: time.Now(),
 		}
 	}
-	if a.limiter.Tokens() < 1 {
+	if a.expired() {
+		return StateReport{
+			State:     Expired,
+			Message:   "Agent TTL elapsed",
+			Timestamp: a.expiresAt,
+		}
+	}
+	if a.paused {
+		return StateReport{
+			State:     Paused,
+			Message:   "Agent paused",
+			Timestamp: a.pausedAt,
+		}
+	}
+	if a.maxInFlight > 0 && a.inFlight >= a.maxInFlight {
+		return StateReport{
+			State:     Unavailable,
+			Message:   "In-flight limit reached",
+			Timestamp: time.Now(),
+		}
+	}
+	if time.Now().Before(a.suspendedUntil) {
 		return StateReport{
 			State:     Unavailable,
-			Message:   "No tokens available",
+			Message:   a.suspendedMsg,
 			Timestamp: time.Now(),
 		}
 	}
-	if a.state.State != Ok && time.Since(a.state.Timestamp) > 300*time.Second {
+	if a.limiter != nil && !a.blockingLimiter && a.limiter.Tokens() < 1 {
+		return StateReport{
+			State:     Unavailable,
+			Message:   fmt.Sprintf("No tokens available, next in %s", tokenDelay(a.limiter).Truncate(time.Second)),
+			Timestamp: time.Now(),
+		}
+	}
+	if a.state.State == Banned && a.banCooldown > 0 {
+		if time.Since(a.state.Timestamp) < a.banCooldown {
+			return a.state
+		}
+		if a.probing {
+			return StateReport{
+				State:     Unavailable,
+				Message:   "Probation request in flight",
+				Timestamp: time.Now(),
+			}
+		}
+		return StateReport{
+			State:     Probation,
+			Message:   "Ban cooldown elapsed: " + a.state.Message,
+			Timestamp: time.Now(),
+		}
+	}
+	if d := a.staleAfterFor(a.state.State); a.state.State != Ok && d > 0 && time.Since(a.state.Timestamp) > d {
 		return StateReport{
 			State:     OutOfDate,
 			Message:   "Out of date health report",
 			Timestamp: time.Now(),
 		}
 	}
+	if a.state.State == Ok && a.okStaleAfter > 0 && time.Since(latest(a.state.Timestamp, a.lastRequestTime)) > a.okStaleAfter {
+		return StateReport{
+			State:     OutOfDate,
+			Message:   "Ok state needs re-verification",
+			Timestamp: time.Now(),
+		}
+	}
 	return a.state
 }
 
+func (a *ProxyAgentWithLimiter) staleAfterFor(h State) time.Duration {
+	if d, ok := a.staleAfterState[h]; ok {
+		return d
+	}
+	return a.staleAfter
+}
+
 func (a *ProxyAgentWithLimiter) SetState(h State, msg string) {
 	a.mu.Lock()
-	defer a.mu.Unlock()
+	changed := a.state.State != h
 	a.state = StateReport{
 		State:     h,
 		Message:   msg,
 		Timestamp: time.Now(),
 	}
+	report := a.state
+	listeners := a.listeners
+	a.mu.Unlock()
+	if !changed {
+		return
+	}
+	for _, fn := range listeners {
+		fn(report)
+	}
 }
 
-func (a *ProxyAgentWithLimiter) Do(req *http.Request) (*http.Response, error) {
+func (a *ProxyAgentWithLimiter) StoredState() StateReport {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.state
+}
+
+func (a *ProxyAgentWithLimiter) RestoreState(r StateReport, requests int, lastRequest time.Time) {
 	a.mu.Lock()
-	if a.closed {
+	changed := a.state.State != r.State
+	a.state = r
+	a.requests = requests
+	a.lastRequestTime = lastRequest
+	listeners := a.listeners
+	a.mu.Unlock()
+	if !changed {
+		return
+	}
+	for _, fn := range listeners {
+		fn(r)
+	}
+}
+
+func (a *ProxyAgentWithLimiter) NotifyStateChange(fn func(StateReport)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listeners = append(a.listeners, fn)
+}
+
+func (a *ProxyAgentWithLimiter) expired() bool {
+	return !a.expiresAt.IsZero() && !time.Now().Before(a.expiresAt)
+}
+
+func (a *ProxyAgentWithLimiter) ttlRemaining() string {
+	switch {
+	case a.ttl <= 0:
+		return ""
+	case a.expiresAt.IsZero():
+		return a.ttl.String()
+	}
+	return max(time.Until(a.expiresAt), 0).Truncate(time.Second).String()
+}
+
+func (a *ProxyAgentWithLimiter) Pause() {
+	a.setPaused(true)
+}
+
+func (a *ProxyAgentWithLimiter) Resume() {
+	a.setPaused(false)
+}
+
+func (a *ProxyAgentWithLimiter) setPaused(paused bool) {
+	a.mu.Lock()
+	if a.paused == paused {
 		a.mu.Unlock()
+		return
+	}
+	a.paused = paused
+	a.pausedAt = time.Now()
+	report := a.currentState()
+	listeners := a.listeners
+	a.mu.Unlock()
+	for _, fn := range listeners {
+		fn(report)
+	}
+}
+
+func (a *ProxyAgentWithLimiter) SuspendUntil(t time.Time, msg string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.suspendedUntil = t
+	a.suspendedMsg = msg
+}
+
+func (a *ProxyAgentWithLimiter) Probe(req *http.Request) (*http.Response, error) {
+	a.mu.RLock()
+	client, closed := a.client, a.closed
+	a.mu.RUnlock()
+	if closed || client == nil {
 		return nil, ErrAgentClosed
 	}
-	if !a.limiter.Allow() {
+	res, err := client.Do(req)
+	if err == nil {
+		err = a.checkProxyAuth(req, res)
+	}
+	if err != nil {
+		return nil, scrubError(err)
+	}
+	return res, nil
+}
+
+// checkProxyAuth reports a 407 to a plain http request sent through an HTTP
+// proxy as ErrProxyAuth, since it comes from the proxy rather than the target.
+func (a *ProxyAgentWithLimiter) checkProxyAuth(req *http.Request, res *http.Response) error {
+	if res.StatusCode != http.StatusProxyAuthRequired || req.URL.Scheme != "http" || !a.transport.viaHTTPProxy(a.url) {
+		return nil
+	}
+	res.Body.Close()
+	return fmt.Errorf("%w: %s", ErrProxyAuth, res.Status)
+}
+
+func (a *ProxyAgentWithLimiter) CheckHealth(ctx context.Context, probeURL string) StateReport {
+	cfg := HealthCheckConfig{URL: probeURL, Verdict: BanAwareVerdict, ConsumeTokens: a.checkConsumes}
+	if err := cfg.validate(); err != nil {
+		a.SetState(Error, err.Error())
+		return a.State()
+	}
+	state, msg := probe(ctx, a, cfg)
+	a.SetState(state, msg)
+	return a.State()
+}
+
+// admit reports why a new request cannot start right now. It is checked
+// again after a blocking limiter wait, since the lock is released while
+// sleeping. Callers must hold a.mu.
+func (a *ProxyAgentWithLimiter) admit() error {
+	switch {
+	case a.closed:
+		return ErrAgentClosed
+	case a.expired():
+		return ErrAgentExpired
+	case a.paused:
+		return ErrAgentPaused
+	case (a.maxInFlight > 0 && a.inFlight >= a.maxInFlight) || a.probing:
+		return ErrAgentBusy
+	}
+	return nil
+}
+
+func (a *ProxyAgentWithLimiter) Do(req *http.Request) (*http.Response, error) {
+	a.mu.Lock()
+	if err := a.admit(); err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	probe := a.currentState().State == Probation
+	hr, err := a.reserveHost(req, a.blockingLimiter)
+	if err != nil {
+		a.mu.Unlock()
+		return nil, err
+	}
+	r := a.reserve()
+	cancel := func() {
+		r.Cancel()
+		if hr != nil {
+			hr.Cancel()
+		}
+	}
+	if a.blockingLimiter {
+		a.mu.Unlock()
+		if !r.OK() {
+			cancel()
+			return nil, fmt.Errorf("rate limit exceeded")
+		}
+		delay := r.Delay()
+		if hr != nil {
+			delay = max(delay, hr.Delay())
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < delay {
+			cancel()
+			return nil, fmt.Errorf("rate limit wait would exceed context deadline")
+		}
+		if err := sleepContext(req.Context(), delay); err != nil {
+			cancel()
+			return nil, err
+		}
+		a.mu.Lock()
+		if err := a.admit(); err != nil {
+			a.mu.Unlock()
+			cancel()
+			return nil, err
+		}
+	} else if !r.OK() || r.Delay() > 0 {
+		cancel()
 		a.mu.Unlock()
 		return nil, fmt.Errorf("rate limit exceeded")
 	}
+	client := a.client
+	if client == nil {
+		a.mu.Unlock()
+		cancel()
+		return nil, ErrAgentClosed
+	}
+	refund, charge := a.refundOnConnError, a.chargeOnSuccess
 	a.wg.Add(1)
 	defer a.wg.Done()
-	if a.client == nil {
-		a.client = &http.Client{ // TODO: remove this
-			Transport: &http.Transport{
-				Proxy: http.ProxyURL(&a.url),
-				DialContext: (&net.Dialer{
-					Timeout:   10 * time.Second,
-					KeepAlive: 300 * time.Second,
-				}).DialContext,
-				ForceAttemptHTTP2:     false,
-				MaxIdleConns:          100,
-				IdleConnTimeout:       90 * time.Second,
-				TLSHandshakeTimeout:   10 * time.Second,
-				ExpectContinueTimeout: 1 * time.Second,
-			},
-			Timeout: 5 * time.Second,
-		}
+	if probe {
+		a.probing = true
 	}
 	a.requests += 1
 	a.lastRequestTime = time.Now()
+	if a.ttl > 0 && a.expiresAt.IsZero() {
+		a.expiresAt = a.lastRequestTime.Add(a.ttl)
+	}
+	a.inFlight++
+	a.mu.Unlock()
+	done := func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.inFlight--
+		if probe {
+			a.probing = false
+		}
+	}
+	req = a.throttleRequest(a.prepare(req))
+	start := time.Now()
+	res, err := client.Do(req)
+	a.observeLatency(time.Since(start))
+	if err == nil {
+		err = a.checkProxyAuth(req, res)
+	}
+	if err != nil {
+		done()
+		if charge || (refund && req.Context().Err() == nil && isConnectionError(err)) {
+			r.Cancel()
+		}
+		err = scrubError(err)
+		if isProxyAuthError(err) {
+			a.SetState(AuthFailed, err.Error())
+		}
+		return nil, err
+	}
+	if charge {
+		a.mu.Lock()
+		if len(a.pending) >= maxPendingOutcomes {
+			a.pending = a.pending[1:]
+		}
+		a.pending = append(a.pending, r)
+		a.mu.Unlock()
+	}
+	res.Body = &doneBody{ReadCloser: a.throttle(req.Context(), res.Body), done: done}
+	return res, nil
+}
+
+// maxPendingOutcomes caps the reservations waiting for ReportOutcome. Beyond
+// it the oldest one is dropped and stays charged.
+const maxPendingOutcomes = 256
+
+// ReportOutcome settles the oldest pending reservation when the agent was
+// created with WithChargeOnSuccess; failed outcomes give the token back.
+func (a *ProxyAgentWithLimiter) ReportOutcome(success bool) {
+	a.mu.Lock()
+	if len(a.pending) == 0 {
+		a.mu.Unlock()
+		return
+	}
+	r := a.pending[0]
+	a.pending = a.pending[1:]
 	a.mu.Unlock()
-	return a.client.Do(req)
+	if !success {
+		r.Cancel()
+	}
+}
+
+func (a *ProxyAgentWithLimiter) prepare(req *http.Request) *http.Request {
+	setUA := a.userAgent != nil && req.Header.Get("User-Agent") == ""
+	if len(a.defaultHeaders) == 0 && !setUA {
+		return req
+	}
+	req = req.Clone(req.Context())
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	if setUA {
+		if ua := a.userAgent(); ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+	}
+	for k, v := range a.defaultHeaders {
+		if _, ok := req.Header[k]; !ok {
+			req.Header[k] = append([]string(nil), v...)
+		}
+	}
+	return req
 }
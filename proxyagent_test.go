@@ -0,0 +1,1034 @@
+package proxypool_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// newProxyServer starts a test server that answers requests sent to it as a
+// plain HTTP forward proxy and returns its URL.
+func newProxyServer(t testing.TB, h http.HandlerFunc) url.URL {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *u
+}
+
+// refusedURL returns the address of a listener that has been closed, so
+// connecting to it is refused.
+func refusedURL(t testing.TB) url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return url.URL{Scheme: "http", Host: addr}
+}
+
+func TestMaxInFlightHoldsUnderLoad(t *testing.T) {
+	const limit = 2
+	var current, peak int64
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&current, 1)
+		defer atomic.AddInt64(&current, -1)
+		for {
+			m := atomic.LoadInt64(&peak)
+			if n <= m || atomic.CompareAndSwapInt64(&peak, m, n) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	agent := proxypool.NewProxyAgent(proxy, proxypool.WithMaxInFlight(limit))
+	defer agent.Close()
+
+	var (
+		wg         sync.WaitGroup
+		ok, busy   int64
+		unexpected = make(chan error, 20)
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			switch {
+			case errors.Is(err, proxypool.ErrAgentBusy):
+				atomic.AddInt64(&busy, 1)
+			case err != nil:
+				unexpected <- err
+			default:
+				atomic.AddInt64(&ok, 1)
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	close(unexpected)
+	for err := range unexpected {
+		t.Errorf("Do: %v", err)
+	}
+	if peak > limit {
+		t.Errorf("proxy saw %d concurrent requests, want at most %d", peak, limit)
+	}
+	if ok == 0 || busy == 0 {
+		t.Errorf("ok = %d, busy = %d, want both non-zero", ok, busy)
+	}
+	if got := agent.InFlight(); got != 0 {
+		t.Errorf("InFlight = %d after all bodies were closed", got)
+	}
+}
+
+func TestMaxInFlightReportsUnavailable(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	})
+	defer close(release)
+	agent := proxypool.NewProxyAgent(proxy, proxypool.WithMaxInFlight(1))
+	defer agent.Close()
+
+	res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := agent.State().State; s != proxypool.Unavailable {
+		t.Errorf("state with open body = %s, want UNAVAILABLE", s)
+	}
+	if got := agent.Info().InFlight; got != 1 {
+		t.Errorf("Info().InFlight = %d, want 1", got)
+	}
+	res.Body.Close()
+	if s := agent.State().State; s == proxypool.Unavailable {
+		t.Errorf("state after closing the body = %s", s)
+	}
+	if got := agent.Info().InFlight; got != 0 {
+		t.Errorf("Info().InFlight = %d after close, want 0", got)
+	}
+}
+
+func TestBlockingLimiterWaitsForToken(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, rate.NewLimiter(1, 1), proxypool.WithBlockingLimiter())
+	defer agent.Close()
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		res.Body.Close()
+		if i == 1 {
+			if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 2*time.Second {
+				t.Errorf("second request took %s, want about 1s", elapsed)
+			}
+		}
+	}
+}
+
+func TestBlockingLimiterHonorsCancellation(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	limiter := rate.NewLimiter(1, 1)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter, proxypool.WithBlockingLimiter())
+	defer agent.Close()
+	limiter.Allow()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Do returned after %s, wait was not cancelled", elapsed)
+	}
+	if s := agent.State().State; s == proxypool.Unavailable {
+		t.Errorf("state = %s, blocking agents should not report token exhaustion", s)
+	}
+	// The cancelled reservation is returned, so the next token is not
+	// pushed further out.
+	if tokens := limiter.Tokens(); tokens < -0.1 {
+		t.Errorf("limiter tokens = %.2f after cancellation", tokens)
+	}
+}
+
+func TestBlockingLimiterRejectsWaitPastDeadline(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter, proxypool.WithBlockingLimiter())
+	defer agent.Close()
+	limiter.Allow()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx)); err == nil {
+		t.Fatal("Do succeeded although the next token is an hour away")
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Do waited %s before giving up", elapsed)
+	}
+}
+
+func TestStaleAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  []proxypool.AgentOption
+		state proxypool.State
+		stale bool
+	}{
+		{"error goes stale", []proxypool.AgentOption{proxypool.WithStaleAfter(20 * time.Millisecond)}, proxypool.Error, true},
+		{"zero never goes stale", []proxypool.AgentOption{proxypool.WithStaleAfter(0)}, proxypool.Error, false},
+		{"ok is not affected", []proxypool.AgentOption{proxypool.WithStaleAfter(20 * time.Millisecond)}, proxypool.Ok, false},
+		{"per-state override", []proxypool.AgentOption{
+			proxypool.WithStaleAfter(20 * time.Millisecond),
+			proxypool.WithStaleAfterFor(proxypool.Banned, time.Hour),
+		}, proxypool.Banned, false},
+		{"per-state override only", []proxypool.AgentOption{
+			proxypool.WithStaleAfter(time.Hour),
+			proxypool.WithStaleAfterFor(proxypool.Banned, 20*time.Millisecond),
+		}, proxypool.Banned, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTransportAgent(tt.opts...)
+			defer agent.Close()
+			agent.SetState(tt.state, "")
+			if s := agent.State().State; s != tt.state {
+				t.Fatalf("state right after SetState = %s, want %s", s, tt.state)
+			}
+			time.Sleep(40 * time.Millisecond)
+			want := tt.state
+			if tt.stale {
+				want = proxypool.OutOfDate
+			}
+			if s := agent.State().State; s != want {
+				t.Errorf("state after 40ms = %s, want %s", s, want)
+			}
+		})
+	}
+}
+
+func markVerdict(c *proxypool.Context) {
+	switch {
+	case c.Err != nil:
+		c.Retry = true
+	case c.StatusCode == http.StatusForbidden:
+		c.Agent.SetState(proxypool.Banned, "forbidden")
+		c.Retry = true
+	default:
+		c.Agent.SetState(proxypool.Ok, "")
+	}
+}
+
+func TestBanCooldownProbationRecovery(t *testing.T) {
+	p := newTestPool(t, markVerdict)
+	banned := newTransportAgent(proxypool.WithBanCooldown(50 * time.Millisecond))
+	banned.SetState(proxypool.Banned, "forbidden")
+	addAgent(t, p, "banned", banned)
+	addAgent(t, p, "other", statusAgent("other", http.StatusOK))
+
+	do := func() {
+		t.Helper()
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	do()
+	do()
+	if n := banned.Info().Requests; n != 0 {
+		t.Fatalf("banned agent served %d requests during cooldown", n)
+	}
+	if s := banned.State().State; s != proxypool.Banned {
+		t.Fatalf("state during cooldown = %s, want BANNED", s)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if s := banned.State().State; s != proxypool.Probation {
+		t.Fatalf("state after cooldown = %s, want PROBATION", s)
+	}
+	do()
+	if n := banned.Info().Requests; n != 1 {
+		t.Fatalf("probation agent served %d requests, want the probe", n)
+	}
+	if s := banned.State().State; s != proxypool.Ok {
+		t.Fatalf("state after a successful probe = %s, want OK", s)
+	}
+
+	for i := 0; i < 4; i++ {
+		do()
+	}
+	if n := banned.Info().Requests; n < 2 {
+		t.Errorf("recovered agent served %d requests, want it back in rotation", n)
+	}
+}
+
+func TestProbationAllowsOneRequest(t *testing.T) {
+	agent := newTransportAgent(proxypool.WithBanCooldown(10 * time.Millisecond))
+	defer agent.Close()
+	agent.SetState(proxypool.Banned, "forbidden")
+	time.Sleep(20 * time.Millisecond)
+
+	res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := agent.State().State; s != proxypool.Unavailable {
+		t.Errorf("state with probe in flight = %s, want UNAVAILABLE", s)
+	}
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentBusy) {
+		t.Errorf("second request err = %v, want ErrAgentBusy", err)
+	}
+	res.Body.Close()
+
+	// Without a verdict from the middleware the agent stays on probation.
+	if s := agent.State().State; s != proxypool.Probation {
+		t.Errorf("state after the probe = %s, want PROBATION", s)
+	}
+	agent.SetState(proxypool.Banned, "still forbidden")
+	if s := agent.State().State; s != proxypool.Banned {
+		t.Errorf("state after a failed probe = %s, want BANNED for a new cooldown", s)
+	}
+}
+
+// recordingTransport answers every request itself and records what it saw.
+type recordingTransport struct {
+	mu         sync.Mutex
+	urls       []string
+	closeIdles int
+}
+
+func (r *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.urls = append(r.urls, req.URL.String())
+	res := testutil.NewResponse(http.StatusOK, "recorded")
+	res.Request = req
+	return res, nil
+}
+
+func (r *recordingTransport) CloseIdleConnections() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeIdles++
+}
+
+func TestWithTransportIsUsedVerbatim(t *testing.T) {
+	rt := &recordingTransport{}
+	agent := proxypool.NewProxyAgent(refusedURL(t), proxypool.WithTransport(rt))
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", agent)
+	agent.SetState(proxypool.Ok, "")
+
+	for _, path := range []string{"/a", "/b", "/c"} {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com"+path, nil))
+		if err != nil {
+			t.Fatalf("Do %s: %v", path, err)
+		}
+		if body := readBody(t, res); body != "recorded" {
+			t.Errorf("body = %q, want the recording transport's reply", body)
+		}
+	}
+	rt.mu.Lock()
+	if fmt.Sprint(rt.urls) != "[http://example.com/a http://example.com/b http://example.com/c]" {
+		t.Errorf("transport saw %v", rt.urls)
+	}
+	rt.mu.Unlock()
+
+	agent.Close()
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.closeIdles == 0 {
+		t.Error("Close did not call CloseIdleConnections on the transport")
+	}
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentClosed) {
+		t.Errorf("Do after Close = %v, want ErrAgentClosed", err)
+	}
+}
+
+func TestClosedAgent(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	agent := proxypool.NewProxyAgent(proxy, proxypool.WithClientTimeout(time.Second))
+	res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	agent.Close()
+	agent.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentClosed) {
+			t.Fatalf("Do after Close = %v, want ErrAgentClosed", err)
+		}
+	}
+	if s := agent.State().State; s != proxypool.Closed {
+		t.Errorf("state = %s, want CLOSED", s)
+	}
+	if n := agent.Info().Requests; n != 1 {
+		t.Errorf("requests = %d, calls after Close must not be counted", n)
+	}
+	agent.SetState(proxypool.Ok, "")
+	if s := agent.State().State; s != proxypool.Closed {
+		t.Errorf("state after SetState = %s, a closed agent stays CLOSED", s)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	agent := proxypool.NewProxyAgent(proxy, proxypool.WithClientTimeout(30*time.Millisecond))
+	defer agent.Close()
+	start := time.Now()
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err == nil {
+		t.Fatal("Do succeeded past the client timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Do returned after %s, want the 30ms client timeout", elapsed)
+	}
+}
+
+func TestConcurrentCloseAndDo(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+	})
+	for round := 0; round < 10; round++ {
+		agent := proxypool.NewProxyAgent(proxy)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 5; j++ {
+					res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+					if err != nil {
+						continue
+					}
+					res.Body.Close()
+				}
+			}()
+		}
+		wg.Add(2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer wg.Done()
+				time.Sleep(2 * time.Millisecond)
+				agent.Close()
+			}()
+		}
+		wg.Wait()
+		if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentClosed) {
+			t.Fatalf("Do after concurrent Close = %v, want ErrAgentClosed", err)
+		}
+		if got := agent.InFlight(); got != 0 {
+			t.Fatalf("InFlight = %d after Close", got)
+		}
+	}
+}
+
+func TestRefundOnConnectionError(t *testing.T) {
+	failing := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	tests := []struct {
+		name   string
+		proxy  url.URL
+		opts   []proxypool.AgentOption
+		tokens float64
+	}{
+		{"dead proxy refunded", refusedURL(t), []proxypool.AgentOption{proxypool.WithRefundOnConnectionError()}, 3},
+		{"dead proxy without option", refusedURL(t), nil, 0},
+		{"HTTP error not refunded", failing, []proxypool.AgentOption{proxypool.WithRefundOnConnectionError()}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := rate.NewLimiter(rate.Every(time.Hour), 3)
+			agent := proxypool.NewProxyAgentWithLimiter(tt.proxy, limiter, tt.opts...)
+			defer agent.Close()
+			for i := 0; i < 3; i++ {
+				res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+				if err == nil {
+					res.Body.Close()
+				}
+			}
+			if got := limiter.Tokens(); got < tt.tokens-0.01 || got > tt.tokens+0.01 {
+				t.Errorf("tokens = %.2f, want %.0f", got, tt.tokens)
+			}
+		})
+	}
+}
+
+func TestRefundSkipsCancelledRequests(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter, proxypool.WithRefundOnConnectionError())
+	defer agent.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx)); err == nil {
+		t.Fatal("Do succeeded after its context expired")
+	}
+	if got := limiter.Tokens(); got > 0.01 {
+		t.Errorf("tokens = %.2f, a cancelled request must stay charged", got)
+	}
+}
+
+func TestChargeOnSuccess(t *testing.T) {
+	var status int64 = http.StatusForbidden
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+	})
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 2)
+	agent := proxypool.NewProxyAgentWithLimiter(proxy, limiter, proxypool.WithChargeOnSuccess())
+	agent.SetState(proxypool.Ok, "")
+	p := newTestPool(t, func(c *proxypool.Context) {
+		c.Retry = c.Err != nil || c.StatusCode == http.StatusForbidden
+	}, proxypool.WithMaxRetry(1))
+	addAgent(t, p, "proxy1", agent)
+
+	for i := 0; i < 3; i++ {
+		p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	}
+	if got := limiter.Tokens(); got < 1.99 {
+		t.Errorf("tokens after rejected attempts = %.2f, want 2", got)
+	}
+	atomic.StoreInt64(&status, http.StatusOK)
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if got := limiter.Tokens(); got < 0.99 || got > 1.01 {
+		t.Errorf("tokens after a confirmed success = %.2f, want 1", got)
+	}
+}
+
+func TestLatencyIsRecorded(t *testing.T) {
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(40 * time.Millisecond)
+	})
+	agent := proxypool.NewProxyAgent(proxy)
+	defer agent.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	info := agent.Info()
+	for name, ms := range map[string]float64{"last": info.LastLatencyMs, "average": info.AvgLatencyMs} {
+		if ms < 40 || ms > 400 {
+			t.Errorf("%s latency = %.1fms, want about 40ms", name, ms)
+		}
+	}
+	if done := agent.LastCompletedTime(); !done.After(start.Add(100 * time.Millisecond)) {
+		t.Errorf("last completed at %s, want after the third request finished", done.Sub(start))
+	}
+}
+
+func TestInFlightCounter(t *testing.T) {
+	const n = 5
+	release := make(chan struct{})
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	agent := proxypool.NewProxyAgent(proxy)
+	defer agent.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	if !waitFor(t, time.Second, func() bool { return agent.InFlight() == n }) {
+		t.Errorf("InFlight = %d, want %d", agent.InFlight(), n)
+	}
+	if got := agent.Info().InFlight; got != n {
+		t.Errorf("Info().InFlight = %d, want %d", got, n)
+	}
+	close(release)
+	wg.Wait()
+	if got := agent.InFlight(); got != 0 {
+		t.Errorf("InFlight = %d after all requests finished", got)
+	}
+}
+
+func TestStrategySeesInFlight(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	agent := proxypool.NewProxyAgent(proxy)
+	agent.SetState(proxypool.Ok, "")
+	seen := make(chan int, 1)
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.StrategyFunc(func(candidates []proxypool.Agent, req *http.Request) []proxypool.Agent {
+		if req.URL.Path == "/probe" {
+			seen <- candidates[0].Info().InFlight
+		}
+		return candidates
+	})))
+	addAgent(t, p, "proxy1", agent)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err == nil {
+			res.Body.Close()
+		}
+	}()
+	if !waitFor(t, time.Second, func() bool { return agent.InFlight() == 1 }) {
+		t.Fatal("request did not start")
+	}
+	go p.Do(newRequest(t, http.MethodGet, "http://example.com/probe", nil))
+	if got := <-seen; got != 1 {
+		t.Errorf("strategy saw InFlight = %d, want 1", got)
+	}
+	close(release)
+	<-done
+}
+
+func TestAgentWithoutLimiter(t *testing.T) {
+	agent := newTransportAgent()
+	defer agent.Close()
+	agent.SetState(proxypool.Ok, "")
+	for i := 0; i < 100; i++ {
+		res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+		res.Body.Close()
+	}
+	if s := agent.State().State; s != proxypool.Ok {
+		t.Errorf("state = %s, want OK", s)
+	}
+	info := agent.Info()
+	if info.Tokens != nil || info.NextTokenIn != "" {
+		t.Errorf("Info reports tokens (next in %q) for an unlimited agent", info.NextTokenIn)
+	}
+	if strings.Contains(info.State, "token") {
+		t.Errorf("Info state %q mentions tokens", info.State)
+	}
+	if agent.Limited() {
+		t.Error("Limited() = true without a limiter")
+	}
+}
+
+func TestAgentWithLimiterReportsTokens(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(url.URL{Scheme: "http", Host: "proxy.invalid:8080"}, limiter,
+		proxypool.WithTransport(okTransport{}))
+	defer agent.Close()
+	agent.SetState(proxypool.Ok, "")
+	res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s := agent.State().State; s != proxypool.Unavailable {
+		t.Errorf("state = %s, want UNAVAILABLE without tokens", s)
+	}
+	if info := agent.Info(); info.Tokens == nil || info.NextTokenIn == "" {
+		t.Errorf("Info omits the token count of a limited agent: %+v", info)
+	}
+}
+
+func basicAuth(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
+
+func TestUpdateCredentials(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	proxy, proxyURL := newConnectProxy(t)
+	proxyURL.User = url.UserPassword("user", "old")
+
+	agent := proxypool.NewProxyAgent(proxyURL, proxypool.WithTLSConfig(&tls.Config{RootCAs: roots}))
+	defer agent.Close()
+	do := func() {
+		t.Helper()
+		res, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	do()
+	agent.SetState(proxypool.AuthFailed, "407")
+	if err := agent.UpdateCredentials("user", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if s := agent.State().State; s != proxypool.Ok {
+		t.Errorf("state after new credentials = %s, want OK", s)
+	}
+	// The tunnel built with the old password is dropped, so the next
+	// request opens a new one with the new password.
+	do()
+	_, auth := proxy.seen()
+	want := []string{basicAuth("user", "old"), basicAuth("user", "new")}
+	if fmt.Sprint(auth) != fmt.Sprint(want) {
+		t.Errorf("Proxy-Authorization = %q, want %q", auth, want)
+	}
+	if strings.Contains(agent.Info().URL, "new") {
+		t.Errorf("Info URL %q exposes the password", agent.Info().URL)
+	}
+}
+
+func TestCredentialSource(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		seen []string
+		pass = "first"
+	)
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, r.Header.Get("Proxy-Authorization"))
+	})
+	agent := proxypool.NewProxyAgent(proxy, proxypool.WithCredentialSource(func() (string, string) {
+		mu.Lock()
+		defer mu.Unlock()
+		return "user", pass
+	}))
+	defer agent.Close()
+	for _, next := range []string{"second", ""} {
+		res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		mu.Lock()
+		pass = next
+		mu.Unlock()
+	}
+	mu.Lock()
+	want := []string{basicAuth("user", "first"), basicAuth("user", "second")}
+	if fmt.Sprint(seen) != fmt.Sprint(want) {
+		t.Errorf("Proxy-Authorization = %q, want %q", seen, want)
+	}
+	mu.Unlock()
+	if err := agent.UpdateCredentials("user", "other"); !errors.Is(err, proxypool.ErrCredentialSource) {
+		t.Errorf("UpdateCredentials = %v, want ErrCredentialSource", err)
+	}
+}
+
+func TestTTLFromConstruction(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	agent := newTransportAgent(proxypool.WithTTL(ttl, false))
+	defer agent.Close()
+	agent.SetState(proxypool.Ok, "")
+	if remaining := agent.Info().TTLRemaining; remaining == "" {
+		t.Error("Info has no TTL remaining")
+	}
+
+	time.Sleep(ttl + 10*time.Millisecond)
+	if s := agent.State().State; s != proxypool.Expired {
+		t.Errorf("state after TTL = %s, want EXPIRED", s)
+	}
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentExpired) {
+		t.Errorf("Do after TTL = %v, want ErrAgentExpired", err)
+	}
+	if remaining := agent.Info().TTLRemaining; remaining != "0s" {
+		t.Errorf("TTL remaining = %q, want 0s", remaining)
+	}
+}
+
+func TestTTLFromFirstUse(t *testing.T) {
+	const ttl = 50 * time.Millisecond
+	agent := newTransportAgent(proxypool.WithTTL(ttl, true))
+	defer agent.Close()
+	agent.SetState(proxypool.Ok, "")
+
+	time.Sleep(ttl + 10*time.Millisecond)
+	if s := agent.State().State; s != proxypool.Ok {
+		t.Fatalf("state before first use = %s, want OK", s)
+	}
+	if remaining := agent.Info().TTLRemaining; remaining != ttl.String() {
+		t.Errorf("TTL remaining before first use = %q, want %s", remaining, ttl)
+	}
+	res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if s := agent.State().State; s != proxypool.Ok {
+		t.Errorf("state right after first use = %s, want OK", s)
+	}
+	time.Sleep(ttl + 10*time.Millisecond)
+	if s := agent.State().State; s != proxypool.Expired {
+		t.Errorf("state after TTL = %s, want EXPIRED", s)
+	}
+}
+
+func TestNextTokenCountdown(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Minute), 1)
+	agent := proxypool.NewProxyAgentWithLimiter(url.URL{}, limiter, proxypool.WithTransport(okTransport{}))
+	defer agent.Close()
+	if info := agent.Info(); info.NextTokenIn != "0s" || info.NextTokenInSeconds != 0 {
+		t.Errorf("countdown with a token available = %q/%v, want 0s", info.NextTokenIn, info.NextTokenInSeconds)
+	}
+
+	res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for i := 0; i < 3; i++ {
+		info := agent.Info()
+		if info.NextTokenIn != "59s" {
+			t.Errorf("NextTokenIn = %q, want 59s", info.NextTokenIn)
+		}
+		if s := info.NextTokenInSeconds; s < 55 || s > 60 {
+			t.Errorf("NextTokenInSeconds = %v, want just under 60", s)
+		}
+	}
+	if report := agent.State(); report.State != proxypool.Unavailable || !strings.Contains(report.Message, "next in 59s") {
+		t.Errorf("state = %s, want UNAVAILABLE with the countdown", report)
+	}
+	// Reading the countdown must not hold on to a reservation.
+	if tokens := limiter.Tokens(); tokens < -0.01 {
+		t.Errorf("tokens = %.2f, the countdown consumed tokens", tokens)
+	}
+	if d := agent.NextTokenIn(); d <= 55*time.Second || d > time.Minute {
+		t.Errorf("NextTokenIn() = %s, want just under a minute", d)
+	}
+}
+
+func TestProxyAuthRejected(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(target.Certificate())
+	connect, connectURL := newConnectProxy(t)
+	connect.reject = http.StatusProxyAuthRequired
+	forward := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	})
+	socks := newSOCKS5Server(t, target.Listener.Addr().String())
+	socks.requirePassword("right")
+
+	tests := []struct {
+		name   string
+		proxy  url.URL
+		target string
+	}{
+		{"CONNECT 407", connectURL, target.URL},
+		{"forward proxy 407", forward, "http://example.com"},
+		{"SOCKS5 auth failure", url.URL{Scheme: "socks5", User: url.UserPassword("user", "wrong"), Host: socks.l.Addr().String()}, target.URL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := proxypool.NewProxyAgent(tt.proxy, proxypool.WithTLSConfig(&tls.Config{RootCAs: roots}))
+			defer agent.Close()
+			_, err := agent.Do(newRequest(t, http.MethodGet, tt.target, nil))
+			if got := proxypool.ClassifyError(err); got != proxypool.ErrClassProxyAuthFailed {
+				t.Errorf("ClassifyError(%v) = %s, want PROXY AUTH FAILED", err, got)
+			}
+			if s := agent.State().State; s != proxypool.AuthFailed {
+				t.Errorf("state = %s, want AUTH FAILED", s)
+			}
+
+			agent.SetState(proxypool.Error, "")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			p := newTestPool(t, nil)
+			addAgent(t, p, "proxy1", agent)
+			err = p.StartHealthCheck(ctx, proxypool.HealthCheckConfig{URL: tt.target, Interval: 10 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !waitFor(t, time.Second, func() bool { return agent.State().State == proxypool.AuthFailed }) {
+				t.Errorf("health check state = %s, want AUTH FAILED", agent.State().State)
+			}
+		})
+	}
+}
+
+func TestProxyAuthRecoversWithCredentials(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	socks := newSOCKS5Server(t, target.Listener.Addr().String())
+	socks.requirePassword("right")
+	agent := proxypool.NewProxyAgent(url.URL{Scheme: "socks5", User: url.UserPassword("user", "wrong"), Host: socks.l.Addr().String()})
+	defer agent.Close()
+
+	if _, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil)); err == nil {
+		t.Fatal("Do succeeded with the wrong password")
+	}
+	if err := agent.UpdateCredentials("user", "right"); err != nil {
+		t.Fatal(err)
+	}
+	if s := agent.State().State; s != proxypool.Ok {
+		t.Errorf("state after fixing credentials = %s, want OK", s)
+	}
+	res, err := agent.Do(newRequest(t, http.MethodGet, target.URL, nil))
+	if err != nil {
+		t.Fatalf("Do with the right password: %v", err)
+	}
+	res.Body.Close()
+}
+
+func TestOkStaleAfterCycle(t *testing.T) {
+	const d = 40 * time.Millisecond
+	stale := newTransportAgent(proxypool.WithOkStaleAfter(d))
+	fresh := newTransportAgent()
+	stale.SetState(proxypool.Ok, "")
+	fresh.SetState(proxypool.Ok, "")
+	p := newTestPool(t, nil)
+	addAgent(t, p, "stale", stale)
+	addAgent(t, p, "fresh", fresh)
+
+	time.Sleep(d + 10*time.Millisecond)
+	if s := stale.State().State; s != proxypool.OutOfDate {
+		t.Fatalf("state after %s idle = %s, want OUT OF DATE", d, s)
+	}
+	if s := fresh.State().State; s != proxypool.Ok {
+		t.Errorf("agent without the option = %s, want OK", s)
+	}
+
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "stale" {
+		t.Errorf("served by %s, want the out-of-date agent to get the probe slot", result.Agent)
+	}
+	if s := stale.State().State; s != proxypool.Ok {
+		t.Errorf("state after a successful request = %s, want OK", s)
+	}
+	time.Sleep(d + 10*time.Millisecond)
+	if s := stale.State().State; s != proxypool.OutOfDate {
+		t.Errorf("state after idling again = %s, want OUT OF DATE", s)
+	}
+}
+
+func TestBandwidthLimitDownload(t *testing.T) {
+	const limit, size = 1 << 20, 3 << 19
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(bytes.Repeat([]byte("x"), size))
+	}))
+	defer srv.Close()
+	agent := proxypool.NewProxyAgent(url.URL{}, proxypool.WithBandwidthLimit(limit))
+	agent.SetState(proxypool.Ok, "")
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", agent)
+
+	start := time.Now()
+	res, err := p.Do(newRequest(t, http.MethodGet, srv.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, res); len(body) != size {
+		t.Fatalf("body = %d bytes, want %d", len(body), size)
+	}
+	elapsed := time.Since(start)
+	// The first tenth of a second is the limiter's burst.
+	want := time.Duration(size-limit/10) * time.Second / limit
+	if elapsed < want*9/10 || elapsed > 3*want {
+		t.Errorf("download took %s, want about %s", elapsed, want)
+	}
+	if tp := agent.Info().Throughput; tp < limit/2 || tp > limit*6/5 {
+		t.Errorf("Info throughput = %.0f B/s, want about %d", tp, limit)
+	}
+}
+
+func TestPasswordNotLeaked(t *testing.T) {
+	const password = "hunter2"
+	withAuth := func(u url.URL) url.URL {
+		u.User = url.UserPassword("alice", password)
+		return u
+	}
+	refused := refusedURL(t)
+	_, first := newConnectProxy(t)
+	tests := []struct {
+		name  string
+		agent func() (*proxypool.ProxyAgentWithLimiter, error)
+	}{
+		{"http proxy refused", func() (*proxypool.ProxyAgentWithLimiter, error) {
+			return proxypool.NewProxyAgent(withAuth(refused)), nil
+		}},
+		{"socks5 proxy refused", func() (*proxypool.ProxyAgentWithLimiter, error) {
+			u := withAuth(refused)
+			u.Scheme = "socks5"
+			return proxypool.NewProxyAgent(u), nil
+		}},
+		{"chain hop refused", func() (*proxypool.ProxyAgentWithLimiter, error) {
+			return proxypool.NewChainedAgent([]url.URL{withAuth(first), withAuth(refused)})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, err := tt.agent()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer agent.Close()
+			agent.SetState(proxypool.Ok, "")
+			_, err = agent.Do(newRequest(t, http.MethodGet, "https://example.com", nil))
+			if err == nil {
+				t.Fatal("Do succeeded through a refused proxy")
+			}
+			if strings.Contains(err.Error(), password) {
+				t.Errorf("error leaks the password: %v", err)
+			}
+			info := agent.Info()
+			if strings.Contains(info.URL, password) || !strings.Contains(info.URL, "alice:***@") {
+				t.Errorf("Info().URL = %q, want the password redacted", info.URL)
+			}
+			if strings.Contains(agent.State().Message, password) {
+				t.Errorf("state message leaks the password: %q", agent.State().Message)
+			}
+		})
+	}
+}
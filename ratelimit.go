@@ -0,0 +1,36 @@
+package proxypool
+
+import (
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+type RateSetter interface {
+	SetRate(r rate.Limit, burst int)
+}
+
+var ErrRateUnsupported = fmt.Errorf("agent has no adjustable rate limiter")
+
+func (p *Pool) SetRate(name string, r rate.Limit, burst int) error {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	rs, ok := agentAs[RateSetter](m.Agent)
+	if !ok || !limited(m.Agent) {
+		return fmt.Errorf("%w: %s", ErrRateUnsupported, name)
+	}
+	rs.SetRate(r, burst)
+	return nil
+}
+
+func (p *Pool) SetRateAll(r rate.Limit, burst int) {
+	for _, m := range p.members() {
+		if rs, ok := agentAs[RateSetter](m.Agent); ok {
+			rs.SetRate(r, burst)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package proxypool_test
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestSetRateChangesAllow(t *testing.T) {
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	limiter.Allow()
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", proxypool.NewProxyAgentWithLimiter(url.URL{}, limiter))
+
+	if err := p.SetRate("proxy1", rate.Every(10*time.Millisecond), 3); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	allowed := 0
+	for limiter.Allow() {
+		allowed++
+	}
+	if allowed != 3 {
+		t.Errorf("allowed %d requests after refilling, want the new burst of 3", allowed)
+	}
+	if info := p.StatusSorted()[0]; info.Tokens == nil || *info.Tokens > 0.5 {
+		t.Errorf("Info tokens = %v, want the drained limiter", info.Tokens)
+	}
+	time.Sleep(15 * time.Millisecond)
+	if !limiter.Allow() {
+		t.Error("no token 15ms after draining at the new 10ms rate")
+	}
+}
+
+func TestSetRateAll(t *testing.T) {
+	limiters := []*rate.Limiter{rate.NewLimiter(rate.Inf, 1), rate.NewLimiter(rate.Every(time.Millisecond), 5)}
+	p := newTestPool(t, nil)
+	for i, l := range limiters {
+		addAgent(t, p, []string{"a", "b"}[i], proxypool.NewProxyAgentWithLimiter(url.URL{}, l))
+	}
+	addAgent(t, p, "unlimited", proxypool.NewProxyAgent(url.URL{}))
+
+	p.SetRateAll(rate.Every(time.Hour), 1)
+	for i, l := range limiters {
+		if l.Limit() != rate.Every(time.Hour) || l.Burst() != 1 {
+			t.Errorf("limiter %d = %v/%d, want 1 per hour, burst 1", i, l.Limit(), l.Burst())
+		}
+		l.Allow()
+		if l.Allow() {
+			t.Errorf("limiter %d allowed a second request within the hour", i)
+		}
+	}
+	if err := p.SetRate("unlimited", rate.Inf, 1); !errors.Is(err, proxypool.ErrRateUnsupported) {
+		t.Errorf("SetRate on an unlimited agent = %v, want ErrRateUnsupported", err)
+	}
+	if err := p.SetRate("missing", rate.Inf, 1); !errors.Is(err, proxypool.ErrAgentNotFound) {
+		t.Errorf("SetRate on a missing agent = %v, want ErrAgentNotFound", err)
+	}
+}
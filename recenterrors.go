@@ -0,0 +1,65 @@
+package proxypool
+
+import (
+	"fmt"
+	"time"
+)
+
+const recentErrorsSize = 20
+
+type ErrorRecord struct {
+	Time       time.Time `json:"time"`
+	State      State     `json:"state"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Err        string    `json:"error,omitempty"`
+}
+
+type errorRing struct {
+	records [recentErrorsSize]ErrorRecord
+	next    int
+	count   int
+}
+
+func (r *errorRing) add(rec ErrorRecord) {
+	r.records[r.next] = rec
+	r.next = (r.next + 1) % recentErrorsSize
+	r.count = min(r.count+1, recentErrorsSize)
+}
+
+func (r *errorRing) list() []ErrorRecord {
+	out := make([]ErrorRecord, 0, r.count)
+	for i := r.count; i > 0; i-- {
+		out = append(out, r.records[(r.next-i+recentErrorsSize)%recentErrorsSize])
+	}
+	return out
+}
+
+func (m *member) recordError(c *Context) {
+	rec := ErrorRecord{Time: time.Now(), State: m.Agent.State().State}
+	if c.Response != nil {
+		rec.StatusCode = c.StatusCode
+	}
+	if c.Err != nil {
+		rec.Err = c.Err.Error()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recentErrors.add(rec)
+}
+
+// RecentErrors returns up to the last 20 failed outcomes, oldest first.
+func (m *member) RecentErrors() []ErrorRecord {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.recentErrors.list()
+}
+
+func (p *Pool) RecentErrors(name string) ([]ErrorRecord, error) {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrAgentNotFound, name)
+	}
+	return m.RecentErrors(), nil
+}
@@ -0,0 +1,85 @@
+package proxypool_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func TestRecentErrorsEvictOldestFirst(t *testing.T) {
+	var n int64
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", testutil.NewMockAgent("proxy1").HandleFunc(func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("failure %d", atomic.AddInt64(&n, 1)-1)
+	}))
+
+	const total, size = 25, 20
+	for i := 0; i < total; i++ {
+		p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	}
+	records, err := p.RecentErrors("proxy1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != size {
+		t.Fatalf("kept %d records, want %d", len(records), size)
+	}
+	for i, r := range records {
+		if want := fmt.Sprintf("failure %d", total-size+i); r.Err != want {
+			t.Errorf("record %d = %q, want %q", i, r.Err, want)
+		}
+		if i > 0 && r.Time.Before(records[i-1].Time) {
+			t.Errorf("record %d is older than the one before it", i)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	p.StatusHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	var status struct {
+		Agents []struct {
+			RecentErrors []proxypool.ErrorRecord `json:"recent_errors"`
+		} `json:"agents"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if got := status.Agents[0].RecentErrors; len(got) != size || got[0].Err != records[0].Err {
+		t.Errorf("status handler recent_errors = %d records starting %q", len(got), got[0].Err)
+	}
+	if _, err := p.RecentErrors("missing"); err == nil {
+		t.Error("RecentErrors of a missing agent succeeded")
+	}
+}
+
+func TestRecentErrorsConcurrent(t *testing.T) {
+	p := newTestPool(t, nil)
+	addAgent(t, p, "proxy1", testutil.NewMockAgent("proxy1").HandleFunc(func(*http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("failure")
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if records, _ := p.RecentErrors("proxy1"); len(records) > 20 {
+					t.Errorf("ring grew to %d records", len(records))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,37 @@
+package proxypool
+
+import (
+	"time"
+)
+
+type AttemptRecord struct {
+	Agent         string
+	StatusCode    int
+	Latency       time.Duration
+	Err           error
+	BytesSent     int64
+	BytesReceived int64
+}
+
+type Recorder interface {
+	RecordAttempt(AttemptRecord)
+	RecordRetry(agent string)
+}
+
+func WithRecorder(r Recorder) Option {
+	return func(p *Pool) {
+		p.recorders = append(p.recorders, r)
+	}
+}
+
+func (p *Pool) AddRecorder(r Recorder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.recorders = append(p.recorders, r)
+}
+
+func (p *Pool) getRecorders() []Recorder {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.recorders[:len(p.recorders):len(p.recorders)]
+}
@@ -0,0 +1,63 @@
+package proxypool
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redactedPassword = "***"
+
+func redactURL(u url.URL, user, pass string) string {
+	if user == "" {
+		u.User = nil
+		return u.String()
+	}
+	u.User = url.User(user)
+	s := u.String()
+	if pass != "" {
+		// url.UserPassword would escape the asterisks, so splice them in
+		// before the userinfo's closing @.
+		i := strings.Index(s, "@")
+		s = s[:i] + ":" + redactedPassword + s[i:]
+	}
+	return s
+}
+
+type scrubbedError struct {
+	err error
+	msg string
+}
+
+func (e *scrubbedError) Error() string {
+	return e.msg
+}
+
+func (e *scrubbedError) Unwrap() error {
+	return e.err
+}
+
+// userinfoPattern matches the password part of any URL userinfo, so every
+// hop of a chain is covered without knowing its credentials.
+var userinfoPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://[^:@/\s]*):[^@/\s]*@`)
+
+// scrubError redacts passwords from URLs echoed in transport errors. Only URL
+// userinfo is touched; the rest of the message is left as is.
+func scrubError(err error) error {
+	if err == nil {
+		return err
+	}
+	if uerr, ok := err.(*url.Error); ok {
+		return &url.Error{Op: uerr.Op, URL: redactString(uerr.URL), Err: scrubError(uerr.Err)}
+	}
+	msg := err.Error()
+	scrubbed := redactString(msg)
+	if scrubbed == msg {
+		return err
+	}
+	return &scrubbedError{err: err, msg: scrubbed}
+}
+
+func redactString(s string) string {
+	return userinfoPattern.ReplaceAllString(s, "${1}:"+redactedPassword+"@")
+}
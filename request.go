@@ -0,0 +1,59 @@
+package proxypool
+
+import (
+	"context"
+	"net/http"
+)
+
+type excludedAgentsKey struct{}
+
+func WithExcludedAgents(ctx context.Context, names ...string) context.Context {
+	excluded := append(excludedAgents(ctx), names...)
+	return context.WithValue(ctx, excludedAgentsKey{}, excluded)
+}
+
+func excludedAgents(ctx context.Context) []string {
+	excluded, _ := ctx.Value(excludedAgentsKey{}).([]string)
+	return excluded[:len(excluded):len(excluded)]
+}
+
+type pinnedAgentKey struct{}
+
+func WithAgent(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, pinnedAgentKey{}, name)
+}
+
+func pinnedAgent(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(pinnedAgentKey{}).(string)
+	return name, ok
+}
+
+type requiredTagsKey struct{}
+
+func WithRequiredTags(ctx context.Context, tags ...string) context.Context {
+	required := append(requiredTags(ctx), tags...)
+	return context.WithValue(ctx, requiredTagsKey{}, required)
+}
+
+func requiredTags(ctx context.Context) []string {
+	required, _ := ctx.Value(requiredTagsKey{}).([]string)
+	return required[:len(required):len(required)]
+}
+
+type allowRetryNonIdempotentKey struct{}
+
+func AllowRetryNonIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, allowRetryNonIdempotentKey{}, true)
+}
+
+func isRetryable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if req.Header.Get("Idempotency-Key") != "" {
+		return true
+	}
+	allowed, _ := req.Context().Value(allowRetryNonIdempotentKey{}).(bool)
+	return allowed
+}
@@ -0,0 +1,358 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+	"golang.org/x/time/rate"
+)
+
+func pinned(t *testing.T, name string) *http.Request {
+	ctx := proxypool.WithAgent(context.Background(), name)
+	return newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx)
+}
+
+func TestPinnedAgentHonorsRateLimiter(t *testing.T) {
+	var seen []proxypool.Agent
+	p := newTestPool(t, func(c *proxypool.Context) {
+		seen = append(seen, c.Agent)
+		retryOnFailure(c)
+	})
+	limited := proxypool.NewProxyAgentWithLimiter(url.URL{Scheme: "http", Host: "proxy.invalid:8080"},
+		rate.NewLimiter(rate.Every(time.Hour), 1), proxypool.WithTransport(okTransport{}))
+	other := statusAgent("other", http.StatusOK)
+	addAgent(t, p, "limited", limited)
+	addAgent(t, p, "other", other)
+
+	res, result, err := p.DoResult(pinned(t, "limited"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "limited" {
+		t.Fatalf("served by %s", result.Agent)
+	}
+	if _, err := p.Do(pinned(t, "limited")); err == nil {
+		t.Fatal("second pinned request bypassed the rate limiter")
+	}
+	if other.Calls() != 0 {
+		t.Errorf("pinned request fell through to another agent")
+	}
+	if len(seen) != 2 || seen[1] != limited {
+		t.Errorf("middleware ran %d times, want once per pinned attempt", len(seen))
+	}
+}
+
+func TestPinnedAgentNotFound(t *testing.T) {
+	p := newTestPool(t, retryOnFailure)
+	a := statusAgent("a", http.StatusOK)
+	addAgent(t, p, "a", a)
+	_, err := p.Do(pinned(t, "missing"))
+	if !errors.Is(err, proxypool.ErrAgentNotFound) {
+		t.Fatalf("err = %v, want ErrAgentNotFound", err)
+	}
+	if a.Calls() != 0 {
+		t.Errorf("request for a missing agent reached agent a")
+	}
+}
+
+func TestPinnedAgentClosed(t *testing.T) {
+	p := newTestPool(t, retryOnFailure)
+	a := statusAgent("a", http.StatusOK)
+	addAgent(t, p, "a", a)
+	a.Close()
+	if _, err := p.Do(pinned(t, "a")); !errors.Is(err, proxypool.ErrAgentClosed) {
+		t.Fatalf("err = %v, want ErrAgentClosed", err)
+	}
+}
+
+func TestPinnedAgentDoesNotRetryElsewhere(t *testing.T) {
+	p := newTestPool(t, func(c *proxypool.Context) {
+		retryOnFailure(c)
+		if c.Retry {
+			c.Agent.SetState(proxypool.Banned, "bad gateway")
+		}
+	})
+	bad, good := statusAgent("bad", http.StatusBadGateway), statusAgent("good", http.StatusOK)
+	addAgent(t, p, "bad", bad)
+	addAgent(t, p, "good", good)
+	_, err := p.Do(pinned(t, "bad"))
+	if !errors.Is(err, proxypool.ErrPinnedAgentFailed) {
+		t.Fatalf("err = %v, want ErrPinnedAgentFailed", err)
+	}
+	if bad.Calls() != 1 || good.Calls() != 0 {
+		t.Errorf("calls bad=%d good=%d, want 1 and 0", bad.Calls(), good.Calls())
+	}
+	if s := bad.State().State; s != proxypool.Banned {
+		t.Errorf("bad agent state = %s, want the middleware's ban", s)
+	}
+}
+
+func TestNonIdempotentRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		header    string
+		optIn     bool
+		wantCalls int
+	}{
+		{"POST", http.MethodPost, "", false, 1},
+		{"PATCH", http.MethodPatch, "", false, 1},
+		{"POST with opt-in", http.MethodPost, "", true, 2},
+		{"POST with Idempotency-Key", http.MethodPost, "key-1", false, 2},
+		{"PUT", http.MethodPut, "", false, 2},
+		{"GET", http.MethodGet, "", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+			first := statusAgent("a", http.StatusBadGateway)
+			second := statusAgent("b", http.StatusOK)
+			addAgent(t, p, "a", first)
+			addAgent(t, p, "b", second)
+			ctx := context.Background()
+			if tt.optIn {
+				ctx = proxypool.AllowRetryNonIdempotent(ctx)
+			}
+			req := newRequest(t, tt.method, "http://example.com", strings.NewReader("payload")).WithContext(ctx)
+			if tt.header != "" {
+				req.Header.Set("Idempotency-Key", tt.header)
+			}
+			res, err := p.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := readBody(t, res)
+			if got := first.Calls() + second.Calls(); got != tt.wantCalls {
+				t.Fatalf("calls = %d, want %d", got, tt.wantCalls)
+			}
+			if tt.wantCalls == 1 && (res.StatusCode != http.StatusBadGateway || body != "a") {
+				t.Errorf("suppressed retry returned %d %q, want the first agent's response", res.StatusCode, body)
+			}
+			if tt.wantCalls == 2 && string(second.Requests()[0].Body) != "payload" {
+				t.Errorf("retried request body = %q", second.Requests()[0].Body)
+			}
+		})
+	}
+}
+
+func TestNonIdempotentRetryReturnsTransportError(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	boom := errors.New("connection reset")
+	addAgent(t, p, "a", testutil.NewMockAgent("a").EnqueueError(boom))
+	second := statusAgent("b", http.StatusOK)
+	addAgent(t, p, "b", second)
+	_, err := p.Do(newRequest(t, http.MethodPost, "http://example.com", strings.NewReader("payload")))
+	if !errors.Is(err, boom) {
+		t.Fatalf("err = %v, want the first agent's error", err)
+	}
+	if second.Calls() != 0 {
+		t.Error("POST was retried without opt-in")
+	}
+}
+
+type bodyRecord struct {
+	body          string
+	contentLength int64
+}
+
+func recordingAgent(name string, code int, records *[]bodyRecord) *testutil.MockAgent {
+	return testutil.NewMockAgent(name).HandleFunc(func(req *http.Request) (*http.Response, error) {
+		r := bodyRecord{contentLength: req.ContentLength}
+		if req.Body != nil {
+			b, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			r.body = string(b)
+		}
+		*records = append(*records, r)
+		return testutil.NewResponse(code, name), nil
+	})
+}
+
+type readTracker struct {
+	io.Reader
+	reads int
+}
+
+func (r *readTracker) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+func (r *readTracker) Close() error { return nil }
+
+func TestRequestBodyReplay(t *testing.T) {
+	const payload = "payload"
+	tests := []struct {
+		name    string
+		request func(t *testing.T) *http.Request
+		want    bodyRecord
+	}{
+		{"GetBody present", func(t *testing.T) *http.Request {
+			return newRequest(t, http.MethodPut, "http://example.com", strings.NewReader(payload))
+		}, bodyRecord{payload, int64(len(payload))}},
+		{"GetBody absent", func(t *testing.T) *http.Request {
+			req := newRequest(t, http.MethodPut, "http://example.com", io.NopCloser(strings.NewReader(payload)))
+			if req.GetBody != nil {
+				t.Fatal("GetBody unexpectedly set")
+			}
+			return req
+		}, bodyRecord{payload, int64(len(payload))}},
+		{"nil body", func(t *testing.T) *http.Request {
+			return newRequest(t, http.MethodPut, "http://example.com", nil)
+		}, bodyRecord{"", 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var records []bodyRecord
+			p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+			addAgent(t, p, "a", recordingAgent("a", http.StatusBadGateway, &records))
+			addAgent(t, p, "b", recordingAgent("b", http.StatusBadGateway, &records))
+			addAgent(t, p, "c", recordingAgent("c", http.StatusOK, &records))
+			res, err := p.Do(tt.request(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if len(records) != 3 {
+				t.Fatalf("%d attempts, want 3", len(records))
+			}
+			for i, r := range records {
+				if r != tt.want {
+					t.Errorf("attempt %d received %+v, want %+v", i+1, r, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestBodyUsesGetBody(t *testing.T) {
+	var records []bodyRecord
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	addAgent(t, p, "a", recordingAgent("a", http.StatusBadGateway, &records))
+	addAgent(t, p, "b", recordingAgent("b", http.StatusOK, &records))
+	req := newRequest(t, http.MethodPut, "http://example.com", strings.NewReader("payload"))
+	original := &readTracker{Reader: strings.NewReader("payload")}
+	req.Body = original
+	res, err := p.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if original.reads != 0 {
+		t.Errorf("original body read %d times, want replay through GetBody only", original.reads)
+	}
+	if len(records) != 2 || records[1].body != "payload" {
+		t.Errorf("attempts received %+v", records)
+	}
+}
+
+func TestExcludedAgentsAreSkipped(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	agents := addAgents(t, p, 3, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	names := sortedList(p)
+
+	ctx := proxypool.WithExcludedAgents(context.Background(), names[0])
+	ctx = proxypool.WithExcludedAgents(ctx, names[1])
+	for i := 0; i < 5; i++ {
+		res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if result.Agent != names[2] {
+			t.Errorf("served by %s, want %s with the others excluded", result.Agent, names[2])
+		}
+	}
+	if calls := agents[0].Calls() + agents[1].Calls(); calls != 0 {
+		t.Errorf("excluded agents received %d calls", calls)
+	}
+}
+
+func TestAllAgentsExcluded(t *testing.T) {
+	p := newTestPool(t, retryOnFailure)
+	agents := addAgents(t, p, 2, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	ctx := proxypool.WithExcludedAgents(context.Background(), sortedList(p)...)
+	_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if !errors.Is(err, proxypool.ErrNoHealthyAgents) || !strings.Contains(err.Error(), "all candidates excluded") {
+		t.Errorf("err = %v, want ErrNoHealthyAgents for all candidates excluded", err)
+	}
+	if totalCalls(agents) != 0 {
+		t.Errorf("excluded agents received %d calls", totalCalls(agents))
+	}
+}
+
+func TestRequiredTagsFilterSelection(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	tags := map[string][]string{
+		"eu-res": {"eu", "residential"},
+		"eu-dc":  {"eu", "datacenter"},
+		"us-res": {"us", "residential"},
+	}
+	agents := map[string]*testutil.MockAgent{}
+	for name, tt := range tags {
+		agents[name] = statusAgent(name, http.StatusOK)
+		addAgent(t, p, name, agents[name], proxypool.WithTags(tt...))
+	}
+
+	ctx := proxypool.WithRequiredTags(context.Background(), "eu")
+	ctx = proxypool.WithRequiredTags(ctx, "residential")
+	for i := 0; i < 4; i++ {
+		res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if result.Agent != "eu-res" {
+			t.Errorf("served by %s, want eu-res", result.Agent)
+		}
+	}
+	if agents["eu-dc"].Calls()+agents["us-res"].Calls() != 0 {
+		t.Error("agents without every required tag were used")
+	}
+
+	ctx = proxypool.WithRequiredTags(context.Background(), "asia")
+	if _, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx)); !errors.Is(err, proxypool.ErrNoHealthyAgents) {
+		t.Errorf("err = %v, want ErrNoHealthyAgents when no agent has the tag", err)
+	}
+}
+
+func TestListTagged(t *testing.T) {
+	p := newTestPool(t, nil)
+	addAgent(t, p, "a", statusAgent("a", http.StatusOK), proxypool.WithTags("eu", "residential"))
+	addAgent(t, p, "b", statusAgent("b", http.StatusOK), proxypool.WithTags("eu"))
+	addAgent(t, p, "c", statusAgent("c", http.StatusOK))
+
+	tests := []struct {
+		tags []string
+		want string
+	}{
+		{nil, "[a b c]"},
+		{[]string{"eu"}, "[a b]"},
+		{[]string{"eu", "residential"}, "[a]"},
+		{[]string{"us"}, "[]"},
+	}
+	for _, tt := range tests {
+		got := p.ListTagged(tt.tags...)
+		sort.Strings(got)
+		if fmt.Sprint(got) != tt.want {
+			t.Errorf("ListTagged(%v) = %v, want %s", tt.tags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package proxypool
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var DefaultRetryAfter = 60 * time.Second
+
+// maxRetryAfter caps the suspension a Retry-After header can ask for, which
+// also keeps large second counts from overflowing time.Duration.
+const maxRetryAfter = 24 * time.Hour
+
+type Suspender interface {
+	SuspendUntil(t time.Time, msg string)
+}
+
+func RespectRetryAfter(c *Context) bool {
+	return RetryAfter(DefaultRetryAfter)(c)
+}
+
+func RetryAfter(fallback time.Duration) func(c *Context) bool {
+	return func(c *Context) bool {
+		if c.Response == nil {
+			return false
+		}
+		if c.StatusCode != http.StatusTooManyRequests && c.StatusCode != http.StatusServiceUnavailable {
+			return false
+		}
+		d, ok := parseRetryAfter(c.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			d = fallback
+		}
+		msg := fmt.Sprintf("%d, retry after %s", c.StatusCode, d)
+		if s, ok := c.Agent.(Suspender); ok {
+			s.SuspendUntil(time.Now().Add(d), msg)
+		} else {
+			c.Agent.SetState(Unavailable, msg)
+		}
+		c.Retry = true
+		return true
+	}
+}
+
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		if secs > int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter, true
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return min(d, maxRetryAfter), true
+	}
+	return 0, true
+}
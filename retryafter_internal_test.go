@@ -0,0 +1,37 @@
+package proxypool
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	tests := []struct {
+		name string
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"seconds", "120", 2 * time.Minute, true},
+		{"padded seconds", " 5 ", 5 * time.Second, true},
+		{"zero", "0", 0, true},
+		{"negative", "-1", 0, false},
+		{"huge", "9223372036854775807", maxRetryAfter, true},
+		{"HTTP date", now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{"past date", now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"far future date", now.AddDate(1, 0, 0).Format(http.TimeFormat), maxRetryAfter, true},
+		{"empty", "", 0, false},
+		{"garbage", "soon", 0, false},
+		{"fraction", "1.5", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseRetryAfter(tt.in, now)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseRetryAfter(%q) = %s, %v; want %s, %v", tt.in, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package proxypool_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// retryAfterTransport answers every request with code and a Retry-After
+// header.
+type retryAfterTransport struct {
+	code  int
+	after string
+}
+
+func (rt retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res := testutil.NewResponse(rt.code, "")
+	res.Header.Set("Retry-After", rt.after)
+	res.Request = req
+	return res, nil
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		after   string
+		handled bool
+		msg     string
+	}{
+		{"seconds", http.StatusTooManyRequests, "120", true, "429, retry after 2m0s"},
+		{"HTTP date", http.StatusServiceUnavailable, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), true, "503, retry after 59m"},
+		{"garbage uses fallback", http.StatusTooManyRequests, "later", true, "429, retry after 1m30s"},
+		{"other status", http.StatusBadGateway, "120", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var handled bool
+			p := newTestPool(t, func(c *proxypool.Context) {
+				handled = proxypool.RetryAfter(90 * time.Second)(c)
+			}, proxypool.WithMaxRetry(0))
+
+			// ProxyAgentWithLimiter is a Suspender: its stored state is
+			// kept and it reports Unavailable until the deadline.
+			agent := newTransportAgent(proxypool.WithTransport(retryAfterTransport{tt.code, tt.after}))
+			agent.SetState(proxypool.Ok, "")
+			addAgent(t, p, "proxy1", agent)
+			p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if handled != tt.handled {
+				t.Fatalf("handled = %v, want %v", handled, tt.handled)
+			}
+			report := agent.State()
+			if !tt.handled {
+				if report.State != proxypool.Ok {
+					t.Errorf("state = %s, want OK", report)
+				}
+				return
+			}
+			if report.State != proxypool.Unavailable || !strings.HasPrefix(report.Message, tt.msg) {
+				t.Errorf("state = %s, want UNAVAILABLE with %q", report, tt.msg)
+			}
+			if stored := agent.StoredState().State; stored != proxypool.Ok {
+				t.Errorf("stored state = %s, want OK while suspended", stored)
+			}
+		})
+	}
+}
+
+func TestRetryAfterWithoutSuspender(t *testing.T) {
+	p := newTestPool(t, func(c *proxypool.Context) {
+		proxypool.RespectRetryAfter(c)
+	}, proxypool.WithMaxRetry(0))
+	res := testutil.NewResponse(http.StatusTooManyRequests, "")
+	res.Header.Set("Retry-After", "30")
+	agent := testutil.NewMockAgent("proxy1").Enqueue(res, nil)
+	addAgent(t, p, "proxy1", agent)
+	p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if report := agent.State(); report.State != proxypool.Unavailable || report.Message != "429, retry after 30s" {
+		t.Errorf("state = %s, want UNAVAILABLE set on the agent", report)
+	}
+}
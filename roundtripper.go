@@ -0,0 +1,30 @@
+package proxypool
+
+import (
+	"net/http"
+	"net/url"
+
+	"golang.org/x/time/rate"
+)
+
+var _ Agent = (*RoundTripperAgent)(nil)
+
+// RoundTripperAgent sends requests through an arbitrary http.RoundTripper
+// while keeping the state, limiter and request bookkeeping of
+// ProxyAgentWithLimiter. Closing the agent closes the round tripper's idle
+// connections if it supports CloseIdleConnections.
+type RoundTripperAgent struct {
+	*ProxyAgentWithLimiter
+	name string
+}
+
+func NewRoundTripperAgent(name string, rt http.RoundTripper, limiter *rate.Limiter, opts ...AgentOption) *RoundTripperAgent {
+	opts = append(opts[:len(opts):len(opts)], WithTransport(rt))
+	return &RoundTripperAgent{NewProxyAgentWithLimiter(url.URL{}, limiter, opts...), name}
+}
+
+func (a *RoundTripperAgent) Info() Info {
+	info := a.ProxyAgentWithLimiter.Info()
+	info.Name = a.name
+	return info
+}
@@ -0,0 +1,57 @@
+package proxypool_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestRoundTripperAgent(t *testing.T) {
+	rts := []*recordingTransport{{}, {}}
+	agents := make([]*proxypool.RoundTripperAgent, len(rts))
+	p := newTestPool(t, nil)
+	for i, rt := range rts {
+		name := fmt.Sprintf("tunnel%d", i)
+		agents[i] = proxypool.NewRoundTripperAgent(name, rt, rate.NewLimiter(rate.Every(time.Hour), 2))
+		agents[i].SetState(proxypool.Ok, "")
+		addAgent(t, p, name, agents[i])
+	}
+
+	for i := 0; i < 4; i++ {
+		res, err := p.Do(newRequest(t, http.MethodGet, fmt.Sprintf("http://example.com/%d", i), nil))
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		if body := readBody(t, res); body != "recorded" {
+			t.Errorf("body = %q", body)
+		}
+	}
+	for i, rt := range rts {
+		if len(rt.urls) != 2 {
+			t.Errorf("tunnel%d carried %v, want two requests", i, rt.urls)
+		}
+		info := agents[i].Info()
+		if info.Name != fmt.Sprintf("tunnel%d", i) || info.Requests != 2 || info.LastRequestTime.IsZero() {
+			t.Errorf("Info = %s, %d requests, last %s", info.Name, info.Requests, info.LastRequestTime)
+		}
+		if s := info.Report.State; s != proxypool.Unavailable {
+			t.Errorf("tunnel%d state = %s, want UNAVAILABLE after its burst", i, s)
+		}
+	}
+	if _, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err == nil {
+		t.Error("request succeeded with every limiter drained")
+	}
+
+	agents[0].Close()
+	if rts[0].closeIdles == 0 {
+		t.Error("Close did not close the round tripper's idle connections")
+	}
+	if s := agents[0].State().State; s != proxypool.Closed {
+		t.Errorf("state after Close = %s, want CLOSED", s)
+	}
+}
@@ -0,0 +1,112 @@
+package proxypool
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	_ Agent         = (*ProxyAgentWithSemaphore)(nil)
+	_ StateNotifier = (*ProxyAgentWithSemaphore)(nil)
+)
+
+type SemaphoreOption func(*ProxyAgentWithSemaphore)
+
+func WithFailFast() SemaphoreOption {
+	return func(a *ProxyAgentWithSemaphore) {
+		a.failFast = true
+	}
+}
+
+// WithAgentOptions applies AgentOptions such as WithDialTimeout or
+// WithStaleAfter to the underlying agent.
+func WithAgentOptions(opts ...AgentOption) SemaphoreOption {
+	return func(a *ProxyAgentWithSemaphore) {
+		a.agentOpts = append(a.agentOpts, opts...)
+	}
+}
+
+// ProxyAgentWithSemaphore bounds the number of concurrent requests instead of
+// their rate. State, staleness and lifecycle are shared with
+// ProxyAgentWithLimiter.
+type ProxyAgentWithSemaphore struct {
+	*ProxyAgentWithLimiter
+	slots     chan struct{}
+	failFast  bool
+	agentOpts []AgentOption
+}
+
+func NewProxyAgentWithSemaphore(u url.URL, maxConcurrent int, opts ...SemaphoreOption) *ProxyAgentWithSemaphore {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	a := &ProxyAgentWithSemaphore{
+		slots: make(chan struct{}, maxConcurrent),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.ProxyAgentWithLimiter = NewProxyAgentWithLimiter(u, nil, a.agentOpts...)
+	return a
+}
+
+func (a *ProxyAgentWithSemaphore) InFlight() int {
+	return len(a.slots)
+}
+
+func (a *ProxyAgentWithSemaphore) Info() Info {
+	info := a.ProxyAgentWithLimiter.Info()
+	info.Report = a.State()
+	info.State = fmt.Sprintf("%s, %d/%d slots", info.Report.String(), len(a.slots), cap(a.slots))
+	info.InFlight = len(a.slots)
+	return info
+}
+
+func (a *ProxyAgentWithSemaphore) State() StateReport {
+	state := a.ProxyAgentWithLimiter.State()
+	switch state.State {
+	case Closed, Expired, Paused:
+		return state
+	}
+	if len(a.slots) >= cap(a.slots) {
+		return StateReport{
+			State:     Unavailable,
+			Message:   "All slots in use",
+			Timestamp: time.Now(),
+		}
+	}
+	return state
+}
+
+func (a *ProxyAgentWithSemaphore) acquire(req *http.Request) error {
+	if a.failFast {
+		select {
+		case a.slots <- struct{}{}:
+			return nil
+		default:
+			return ErrAgentBusy
+		}
+	}
+	select {
+	case a.slots <- struct{}{}:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+func (a *ProxyAgentWithSemaphore) Do(req *http.Request) (*http.Response, error) {
+	if err := a.acquire(req); err != nil {
+		return nil, err
+	}
+	release := func() { <-a.slots }
+	res, err := a.ProxyAgentWithLimiter.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &doneBody{ReadCloser: res.Body, done: release}
+	return res, nil
+}
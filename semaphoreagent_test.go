@@ -0,0 +1,108 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestSemaphoreCeiling(t *testing.T) {
+	const slots = 3
+	var current, peak int64
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&current, 1)
+		defer atomic.AddInt64(&current, -1)
+		for {
+			m := atomic.LoadInt64(&peak)
+			if n <= m || atomic.CompareAndSwapInt64(&peak, m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	})
+	agent := proxypool.NewProxyAgentWithSemaphore(proxy, slots)
+	defer agent.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3*slots; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if peak > slots {
+		t.Errorf("proxy saw %d concurrent requests, want at most %d", peak, slots)
+	}
+	if got := agent.InFlight(); got != 0 {
+		t.Errorf("InFlight = %d after all requests finished", got)
+	}
+}
+
+func TestSemaphoreSaturation(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	agent := proxypool.NewProxyAgentWithSemaphore(proxy, 1, proxypool.WithFailFast())
+	defer agent.Close()
+	agent.SetState(proxypool.Ok, "")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if res, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); err == nil {
+			res.Body.Close()
+		}
+	}()
+	if !waitFor(t, time.Second, func() bool { return agent.InFlight() == 1 }) {
+		t.Fatal("request did not start")
+	}
+	if s := agent.State().State; s != proxypool.Unavailable {
+		t.Errorf("state when saturated = %s, want UNAVAILABLE", s)
+	}
+	if info := agent.Info(); !strings.Contains(info.State, "1/1 slots") || info.InFlight != 1 {
+		t.Errorf("Info = %q in flight %d, want 1/1 slots", info.State, info.InFlight)
+	}
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil)); !errors.Is(err, proxypool.ErrAgentBusy) {
+		t.Errorf("fail-fast err = %v, want ErrAgentBusy", err)
+	}
+	close(release)
+	<-done
+	if s := agent.State().State; s != proxypool.Ok {
+		t.Errorf("state after release = %s, want OK", s)
+	}
+}
+
+func TestSemaphoreBlockingHonorsContext(t *testing.T) {
+	release := make(chan struct{})
+	proxy := newProxyServer(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	agent := proxypool.NewProxyAgentWithSemaphore(proxy, 1)
+	defer agent.Close()
+	defer close(release)
+
+	go agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if !waitFor(t, time.Second, func() bool { return agent.InFlight() == 1 }) {
+		t.Fatal("request did not start")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := agent.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+}
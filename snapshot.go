@@ -0,0 +1,76 @@
+package proxypool
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+type Restorer interface {
+	StoredState() StateReport
+	RestoreState(r StateReport, requests int, lastRequest time.Time)
+}
+
+type agentSnapshot struct {
+	Name            string    `json:"name"`
+	State           string    `json:"state"`
+	Message         string    `json:"message"`
+	Timestamp       time.Time `json:"timestamp"`
+	Requests        int       `json:"requests"`
+	LastRequestTime time.Time `json:"last_request_time"`
+}
+
+type poolSnapshot struct {
+	Agents []agentSnapshot `json:"agents"`
+}
+
+func (p *Pool) Snapshot() ([]byte, error) {
+	members := sortSlice(p.members(), func(a, b *member) bool {
+		return a.Name() < b.Name()
+	})
+	s := poolSnapshot{Agents: make([]agentSnapshot, 0, len(members))}
+	for _, m := range members {
+		state := storedState(m.Agent)
+		s.Agents = append(s.Agents, agentSnapshot{
+			Name:            m.Name(),
+			State:           state.State.String(),
+			Message:         state.Message,
+			Timestamp:       state.Timestamp,
+			Requests:        m.Agent.Info().Requests,
+			LastRequestTime: m.Agent.LastRequestTime(),
+		})
+	}
+	return json.Marshal(s)
+}
+
+// Restore applies a snapshot taken with Snapshot. Entries are validated
+// before any agent is touched, so an invalid snapshot changes nothing.
+// Agents missing from the pool are skipped.
+func (p *Pool) Restore(data []byte) error {
+	var s poolSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	states := make([]State, len(s.Agents))
+	for i, a := range s.Agents {
+		state, err := ParseState(a.State)
+		if err != nil {
+			return fmt.Errorf("agent %s: %w", a.Name, err)
+		}
+		states[i] = state
+	}
+	for i, a := range s.Agents {
+		p.mu.RLock()
+		m, ok := p.agents[a.Name]
+		p.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		if r, ok := agentAs[Restorer](m.Agent); ok {
+			r.RestoreState(StateReport{State: states[i], Message: a.Message, Timestamp: a.Timestamp}, a.Requests, a.LastRequestTime)
+		} else {
+			m.Agent.SetState(states[i], a.Message)
+		}
+	}
+	return nil
+}
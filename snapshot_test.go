@@ -0,0 +1,86 @@
+package proxypool_test
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	secret := url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: "proxy.invalid:8080"}
+	newAgent := func() *proxypool.ProxyAgentWithLimiter {
+		return proxypool.NewProxyAgent(secret, proxypool.WithTransport(okTransport{}))
+	}
+
+	p := newTestPool(t, nil)
+	banned, ok := newAgent(), newAgent()
+	addAgent(t, p, "banned", banned)
+	addAgent(t, p, "ok", ok)
+	for i := 0; i < 2; i++ {
+		res, err := banned.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	banned.SetState(proxypool.Banned, "403 from target")
+	ok.SetState(proxypool.Ok, "")
+	bannedAt := banned.State().Timestamp
+
+	data, err := p.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{"secret", "user", "proxy.invalid"} {
+		if strings.Contains(string(data), leak) {
+			t.Errorf("snapshot contains %q: %s", leak, data)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	restored := newTestPool(t, nil)
+	restoredBanned := newAgent()
+	addAgent(t, restored, "banned", restoredBanned)
+	addAgent(t, restored, "new", newAgent())
+	if err := restored.Restore(data); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	state := restoredBanned.State()
+	if state.State != proxypool.Banned || state.Message != "403 from target" {
+		t.Errorf("restored state = %s %q, want BANNED", state.State, state.Message)
+	}
+	if !state.Timestamp.Equal(bannedAt) {
+		t.Errorf("restored timestamp = %s, want %s", state.Timestamp, bannedAt)
+	}
+	if n := restoredBanned.Info().Requests; n != 2 {
+		t.Errorf("restored requests = %d, want 2", n)
+	}
+	if restored.Len() != 2 {
+		t.Errorf("Len = %d, Restore must not add agents", restored.Len())
+	}
+}
+
+func TestRestoreInvalidSnapshotChangesNothing(t *testing.T) {
+	p := newTestPool(t, nil)
+	agent := newTransportAgent()
+	agent.SetState(proxypool.Ok, "")
+	addAgent(t, p, "a", agent)
+
+	data := `{"agents":[
+		{"name":"a","state":"BANNED","message":"restored"},
+		{"name":"b","state":"NOT A STATE"}
+	]}`
+	if err := p.Restore([]byte(data)); err == nil {
+		t.Fatal("Restore accepted an unknown state")
+	}
+	if s := agent.State(); s.State != proxypool.Ok {
+		t.Errorf("state = %s %q, want OK untouched", s.State, s.Message)
+	}
+	if err := p.Restore([]byte("not json")); err == nil {
+		t.Error("Restore accepted malformed JSON")
+	}
+}
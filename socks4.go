@@ -0,0 +1,116 @@
+package proxypool
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSOCKS4Unsupported = errors.New("socks4: unsupported operation")
+
+func socks4Dialer(u url.URL, forward dialFunc) dialFunc {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	remoteDNS := u.Scheme == "socks4a"
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil, fmt.Errorf("%w: network %q, only TCP CONNECT is supported", ErrSOCKS4Unsupported, network)
+		}
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("socks4: invalid port %q", portStr)
+		}
+		req := []byte{4, 1, 0, 0}
+		binary.BigEndian.PutUint16(req[2:], uint16(port))
+		ip := net.ParseIP(host).To4()
+		switch {
+		case ip != nil:
+		case net.ParseIP(host) != nil:
+			return nil, fmt.Errorf("%w: IPv6 destination %s", ErrSOCKS4Unsupported, host)
+		case !remoteDNS:
+			if ip, err = lookupIPv4(ctx, host); err != nil {
+				return nil, err
+			}
+		}
+		if ip != nil {
+			req = append(req, ip...)
+		} else {
+			req = append(req, 0, 0, 0, 1)
+		}
+		req = append(req, u.User.Username()...)
+		req = append(req, 0)
+		if ip == nil {
+			req = append(req, host...)
+			req = append(req, 0)
+		}
+		conn, err := forward(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+			defer conn.SetDeadline(time.Time{})
+		}
+		if _, err := conn.Write(req); err != nil {
+			conn.Close()
+			return nil, socks4Error(network, err)
+		}
+		var reply [8]byte
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			conn.Close()
+			return nil, socks4Error(network, err)
+		}
+		if reply[1] != 0x5a {
+			conn.Close()
+			err := fmt.Errorf("connect to %s failed: %s", addr, socks4Status(reply[1]))
+			if reply[1] == 0x5c || reply[1] == 0x5d {
+				err = fmt.Errorf("%w: %v", ErrProxyAuth, err)
+			}
+			return nil, socks4Error(network, err)
+		}
+		return conn, nil
+	}
+}
+
+func socks4Error(network string, err error) error {
+	return &net.OpError{Op: "socks4 connect", Net: network, Err: err}
+}
+
+func lookupIPv4(ctx context.Context, host string) (net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("socks4: no IPv4 address for %s", host)
+}
+
+func socks4Status(code byte) string {
+	switch code {
+	case 0x5b:
+		return "request rejected or failed"
+	case 0x5c:
+		return "identd unreachable"
+	case 0x5d:
+		return "identd user mismatch"
+	default:
+		return fmt.Sprintf("unknown status 0x%02x", code)
+	}
+}
@@ -0,0 +1,143 @@
+package proxypool_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+// socks4Server is a minimal in-process SOCKS4/4a server.
+type socks4Server struct {
+	l      net.Listener
+	reject bool
+
+	mu      sync.Mutex
+	userIDs []string
+	hosts   []string
+}
+
+func newSOCKS4Server(t *testing.T, reject bool) *socks4Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks4Server{l: l, reject: reject}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *socks4Server) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks4Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 4 || head[1] != 1 {
+		return
+	}
+	userID, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(head[2:4])
+	host := net.IP(head[4:8]).String()
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		if host, err = r.ReadString(0); err != nil {
+			return
+		}
+		host = host[:len(host)-1]
+	}
+	s.mu.Lock()
+	s.userIDs = append(s.userIDs, userID[:len(userID)-1])
+	s.hosts = append(s.hosts, host)
+	s.mu.Unlock()
+
+	reply := []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}
+	var upstream net.Conn
+	if !s.reject {
+		upstream, err = net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	}
+	if s.reject || err != nil {
+		reply[1] = 0x5b
+		conn.Write(reply)
+		return
+	}
+	defer upstream.Close()
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	go io.Copy(upstream, r)
+	io.Copy(conn, upstream)
+}
+
+func (s *socks4Server) seen() (userIDs, hosts []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.userIDs...), append([]string(nil), s.hosts...)
+}
+
+func TestSOCKS4(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("socks4"))
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	tests := []struct {
+		scheme   string
+		wantHost string
+	}{
+		{"socks4", "127.0.0.1"},
+		{"socks4a", "localhost"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scheme, func(t *testing.T) {
+			srv := newSOCKS4Server(t, false)
+			agent := proxypool.NewProxyAgent(url.URL{Scheme: tt.scheme, User: url.User("alice"), Host: srv.l.Addr().String()})
+			defer agent.Close()
+			res, err := agent.Do(newRequest(t, http.MethodGet, "http://localhost:"+port, nil))
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			if body := readBody(t, res); body != "socks4" {
+				t.Errorf("body = %q", body)
+			}
+			userIDs, hosts := srv.seen()
+			if len(hosts) != 1 || hosts[0] != tt.wantHost || userIDs[0] != "alice" {
+				t.Errorf("server saw hosts %v user %v, want %s and alice", hosts, userIDs, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestSOCKS4Rejected(t *testing.T) {
+	srv := newSOCKS4Server(t, true)
+	agent := proxypool.NewProxyAgent(url.URL{Scheme: "socks4", Host: srv.l.Addr().String()})
+	defer agent.Close()
+	_, err := agent.Do(newRequest(t, http.MethodGet, "http://127.0.0.1:9", nil))
+	if err == nil {
+		t.Fatal("Do succeeded through a rejecting server")
+	}
+	if got := proxypool.ClassifyError(err); got != proxypool.ErrClassProxyHandshakeFailed {
+		t.Errorf("class = %s, want PROXY HANDSHAKE FAILED", got)
+	}
+}
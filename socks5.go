@@ -0,0 +1,50 @@
+package proxypool
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// socks5Dialer hands the target hostname to the proxy untouched, so DNS is
+// resolved remotely for both socks5:// and socks5h:// unless localDNS is set,
+// in which case socks5:// targets are resolved before the handshake.
+func socks5Dialer(u url.URL, forward dialFunc, credentials func() (string, string), localDNS bool) dialFunc {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	resolve := localDNS && u.Scheme == "socks5"
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var auth *proxy.Auth
+		if credentials != nil {
+			if user, pass := credentials(); user != "" {
+				auth = &proxy.Auth{User: user, Password: pass}
+			}
+		}
+		if resolve {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			if net.ParseIP(host) == nil {
+				ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				if len(ips) == 0 {
+					return nil, fmt.Errorf("socks5: no address for %s", host)
+				}
+				addr = net.JoinHostPort(ips[0].IP.String(), port)
+			}
+		}
+		d, err := proxy.SOCKS5("tcp", proxyAddr, auth, contextDialer{forward})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	}
+}
@@ -0,0 +1,219 @@
+package proxypool_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+// socks5Server is a minimal in-process SOCKS5 server that records the
+// destination of each CONNECT and forwards every connection to upstream.
+// Once requirePassword is called, other passwords fail the auth
+// sub-negotiation.
+type socks5Server struct {
+	l        net.Listener
+	upstream string
+
+	mu       sync.Mutex
+	hosts    []string
+	users    []string
+	password string
+}
+
+func newSOCKS5Server(t *testing.T, upstream string) *socks5Server {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{l: l, upstream: upstream}
+	t.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *socks5Server) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil || head[0] != 5 {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return
+	}
+	var user string
+	if hasMethod(methods, 2) {
+		conn.Write([]byte{5, 2})
+		var pass string
+		var err error
+		if user, pass, err = readUserPass(r); err != nil {
+			return
+		}
+		s.mu.Lock()
+		want := s.password
+		s.mu.Unlock()
+		if want != "" && pass != want {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	} else {
+		conn.Write([]byte{5, 0})
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(r, req[:]); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	case 3:
+		n, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		name := make([]byte, n)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.hosts = append(s.hosts, host)
+	s.users = append(s.users, user)
+	s.mu.Unlock()
+
+	upstream, err := net.Dial("tcp", s.upstream)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	reply := []byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], binary.BigEndian.Uint16(port[:]))
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	go io.Copy(upstream, r)
+	io.Copy(conn, upstream)
+}
+
+func readUserPass(r *bufio.Reader) (user, pass string, err error) {
+	read := func() (string, error) {
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(r, b)
+		return string(b), err
+	}
+	if _, err := r.ReadByte(); err != nil {
+		return "", "", err
+	}
+	if user, err = read(); err != nil {
+		return "", "", err
+	}
+	pass, err = read()
+	return user, pass, err
+}
+
+func hasMethod(methods []byte, m byte) bool {
+	for _, c := range methods {
+		if c == m {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *socks5Server) requirePassword(pass string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = pass
+}
+
+func (s *socks5Server) seen() (hosts, users []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.hosts...), append([]string(nil), s.users...)
+}
+
+func TestSOCKS5DNSResolution(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("socks5"))
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name     string
+		scheme   string
+		opts     []proxypool.AgentOption
+		hostname bool
+	}{
+		{"socks5 resolves remotely", "socks5", nil, true},
+		{"socks5h resolves remotely", "socks5h", nil, true},
+		{"socks5 with local DNS", "socks5", []proxypool.AgentOption{proxypool.WithLocalDNS()}, false},
+		{"socks5h ignores local DNS", "socks5h", []proxypool.AgentOption{proxypool.WithLocalDNS()}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSOCKS5Server(t, target.Listener.Addr().String())
+			agent := proxypool.NewProxyAgent(url.URL{
+				Scheme: tt.scheme,
+				User:   url.UserPassword("alice", "secret"),
+				Host:   srv.l.Addr().String(),
+			}, tt.opts...)
+			defer agent.Close()
+			res, err := agent.Do(newRequest(t, http.MethodGet, "http://localhost/", nil))
+			if err != nil {
+				t.Fatalf("Do: %v", err)
+			}
+			if body := readBody(t, res); body != "socks5" {
+				t.Errorf("body = %q", body)
+			}
+			hosts, users := srv.seen()
+			if len(hosts) != 1 || users[0] != "alice" {
+				t.Fatalf("server saw hosts %v users %v, want one connect as alice", hosts, users)
+			}
+			if isIP := net.ParseIP(hosts[0]) != nil; isIP == tt.hostname {
+				t.Errorf("server received %q, want hostname=%v", hosts[0], tt.hostname)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package proxypool
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	statsBucketSize  = time.Minute
+	statsBucketCount = 10
+)
+
+type WindowStats struct {
+	Successes int `json:"successes"`
+	Failures  int `json:"failures"`
+	Total     int `json:"total"`
+}
+
+func (s WindowStats) SuccessRate() float64 {
+	if s.Total == 0 {
+		return 1
+	}
+	return float64(s.Successes) / float64(s.Total)
+}
+
+type statsBucket struct {
+	start     int64
+	successes int
+	failures  int
+}
+
+type rollingStats struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	buckets [statsBucketCount]statsBucket
+}
+
+func newRollingStats() *rollingStats {
+	return &rollingStats{now: time.Now}
+}
+
+func (s *rollingStats) bucket(t time.Time) *statsBucket {
+	start := t.Truncate(statsBucketSize).Unix()
+	b := &s.buckets[(start/int64(statsBucketSize/time.Second))%statsBucketCount]
+	if b.start != start {
+		*b = statsBucket{start: start}
+	}
+	return b
+}
+
+func (s *rollingStats) record(success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.bucket(s.now())
+	if success {
+		b.successes++
+	} else {
+		b.failures++
+	}
+}
+
+func (s *rollingStats) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets = [statsBucketCount]statsBucket{}
+}
+
+func (s *rollingStats) window(d time.Duration) WindowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := int64(min(max(d/statsBucketSize, 1), statsBucketCount))
+	current := s.now().Truncate(statsBucketSize).Unix()
+	oldest := current - (n-1)*int64(statsBucketSize/time.Second)
+	var r WindowStats
+	for _, b := range s.buckets {
+		if b.start < oldest || b.start > current {
+			continue
+		}
+		r.Successes += b.successes
+		r.Failures += b.failures
+	}
+	r.Total = r.Successes + r.Failures
+	return r
+}
+
+func (m *member) Stats(window time.Duration) WindowStats {
+	return m.stats.window(window)
+}
+
+func (p *Pool) Stats(name string, window time.Duration) (WindowStats, bool) {
+	p.mu.RLock()
+	m, ok := p.agents[name]
+	p.mu.RUnlock()
+	if !ok {
+		return WindowStats{}, false
+	}
+	return m.Stats(window), true
+}
@@ -0,0 +1,46 @@
+package proxypool
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRollingStatsBucketRotation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	s := newRollingStats()
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 8; i++ {
+		s.record(i%4 != 0)
+	}
+	if got := s.window(time.Minute); got != (WindowStats{Successes: 6, Failures: 2, Total: 8}) {
+		t.Fatalf("1m window = %+v", got)
+	}
+
+	now = now.Add(time.Minute)
+	s.record(false)
+	s.record(false)
+	if got := s.window(time.Minute); got != (WindowStats{Failures: 2, Total: 2}) {
+		t.Errorf("1m window after a minute = %+v", got)
+	}
+	if got := s.window(10 * time.Minute); got != (WindowStats{Successes: 6, Failures: 4, Total: 10}) {
+		t.Errorf("10m window after a minute = %+v", got)
+	}
+
+	// Nine minutes later the first bucket has left the 10m window.
+	now = now.Add(9 * time.Minute)
+	if got := s.window(10 * time.Minute); got != (WindowStats{Failures: 2, Total: 2}) {
+		t.Errorf("10m window after ten minutes = %+v", got)
+	}
+
+	// A slot reused by a later minute starts from zero.
+	s.record(true)
+	if got := s.window(time.Minute); got != (WindowStats{Successes: 1, Total: 1}) {
+		t.Errorf("1m window in a reused slot = %+v", got)
+	}
+
+	now = now.Add(time.Hour)
+	if got := s.window(10 * time.Minute); got.Total != 0 || got.SuccessRate() != 1 {
+		t.Errorf("window after an idle hour = %+v, rate %.2f", got, got.SuccessRate())
+	}
+}
@@ -0,0 +1,103 @@
+package proxypool
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type agentStatus struct {
+	Name            string             `json:"name"`
+	State           string             `json:"state"`
+	StateCode       int                `json:"state_code"`
+	Message         string             `json:"message"`
+	Tokens          *float64           `json:"tokens,omitempty"`
+	Requests        int                `json:"requests"`
+	LastRequestTime string             `json:"last_request_time,omitempty"`
+	Tags            []string           `json:"tags,omitempty"`
+	LatencyP50Ms    float64            `json:"latency_p50_ms"`
+	LatencyP95Ms    float64            `json:"latency_p95_ms"`
+	LatencyP99Ms    float64            `json:"latency_p99_ms"`
+	LatencySamples  int                `json:"latency_samples"`
+	BytesSent       int64              `json:"bytes_sent"`
+	BytesReceived   int64              `json:"bytes_received"`
+	RecentErrors    []ErrorRecord      `json:"recent_errors,omitempty"`
+	History         []Transition       `json:"history,omitempty"`
+	TimeInState     map[string]float64 `json:"time_in_state_seconds"`
+}
+
+type poolStatus struct {
+	InFlight int           `json:"in_flight"`
+	Agents   []agentStatus `json:"agents"`
+}
+
+func (m *member) status() agentStatus {
+	info := m.Info()
+	state := m.State()
+	s := agentStatus{
+		Name:      m.Name(),
+		State:     state.State.String(),
+		StateCode: int(state.State),
+		Message:   state.Message,
+		Requests:  info.Requests,
+		Tags:      info.Tags,
+	}
+	s.RecentErrors = m.RecentErrors()
+	s.History = m.History()
+	s.TimeInState = make(map[string]float64)
+	for state, d := range m.TimeInState() {
+		s.TimeInState[state.String()] = d.Seconds()
+	}
+	s.BytesSent, s.BytesReceived = m.Bytes()
+	latency := m.LatencyPercentiles()
+	s.LatencyP50Ms = milliseconds(latency.P50)
+	s.LatencyP95Ms = milliseconds(latency.P95)
+	s.LatencyP99Ms = milliseconds(latency.P99)
+	s.LatencySamples = latency.Samples
+	if t, ok := agentAs[interface{ Tokens() float64 }](m.Agent); ok && limited(m.Agent) {
+		tokens := t.Tokens()
+		s.Tokens = &tokens
+	}
+	if last := m.LastRequestTime(); !last.IsZero() {
+		s.LastRequestTime = last.Format(time.RFC3339)
+	}
+	return s
+}
+
+func limited(a Agent) bool {
+	l, ok := a.(interface{ Limited() bool })
+	return !ok || l.Limited()
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (p *Pool) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var states []State
+		for _, v := range r.URL.Query()["state"] {
+			state, err := ParseState(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			states = append(states, state)
+		}
+		members := sortSlice(p.members(), func(a, b *member) bool {
+			return a.Name() < b.Name()
+		})
+		result := make([]agentStatus, 0, len(members))
+		for _, m := range members {
+			s := m.status()
+			if len(states) > 0 && !contains(states, State(s.StateCode)) {
+				continue
+			}
+			result = append(result, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(poolStatus{InFlight: p.InFlight(), Agents: result}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
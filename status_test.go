@@ -0,0 +1,139 @@
+package proxypool_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func statusNames(infos []proxypool.Info) []string {
+	r := make([]string, len(infos))
+	for i, info := range infos {
+		r[i] = info.Name
+	}
+	return r
+}
+
+func TestStatusSortedIsStable(t *testing.T) {
+	p := newTestPool(t, nil)
+	agents := addAgents(t, p, 12, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	for i, a := range agents {
+		if i%3 == 0 {
+			a.SetState(proxypool.Banned, "")
+		}
+	}
+	first := statusNames(p.StatusSorted())
+	if len(first) != 12 || !sort.StringsAreSorted(first) {
+		t.Fatalf("StatusSorted = %v", first)
+	}
+	for i := 0; i < 20; i++ {
+		if got := statusNames(p.StatusSorted()); fmt.Sprint(got) != fmt.Sprint(first) {
+			t.Fatalf("call %d returned %v, want %v", i, got, first)
+		}
+	}
+}
+
+func TestStatusFiltering(t *testing.T) {
+	p := newTestPool(t, nil)
+	agents := addAgents(t, p, 12, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	var wantBanned []string
+	for i, a := range agents {
+		if i%3 == 0 {
+			a.SetState(proxypool.Banned, "")
+			wantBanned = append(wantBanned, a.Info().Name)
+		}
+	}
+	banned := statusNames(p.StatusByState(proxypool.Banned))
+	if fmt.Sprint(banned) != fmt.Sprint(wantBanned) {
+		t.Errorf("StatusByState(Banned) = %v, want %v", banned, wantBanned)
+	}
+	ok := p.StatusWhere(func(info proxypool.Info) bool {
+		return info.Report.State == proxypool.Ok
+	})
+	if len(ok) != 8 || !sort.StringsAreSorted(statusNames(ok)) {
+		t.Errorf("StatusWhere(Ok) = %v", statusNames(ok))
+	}
+	if got := p.StatusByState(proxypool.Ok, proxypool.Banned); len(got) != 12 {
+		t.Errorf("StatusByState(Ok, Banned) returned %d agents", len(got))
+	}
+}
+
+func TestInfoStateIsConsistent(t *testing.T) {
+	a := newTransportAgent()
+	a.SetState(proxypool.Banned, "403")
+	info := a.Info()
+	if info.Report.State != proxypool.Banned || info.State != info.Report.String() {
+		t.Errorf("Info state %q does not match report %v", info.State, info.Report)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// TestStatusJSONGolden pins the JSON shape of Pool.Status. The display
+// strings derived from the wall clock are replaced before comparing.
+func TestStatusJSONGolden(t *testing.T) {
+	at := time.Date(2023, 4, 5, 6, 7, 8, 0, time.UTC)
+	p := newTestPool(t, nil)
+	limited := proxypool.NewProxyAgentWithLimiter(
+		url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: "proxy1.example:8080"},
+		rate.NewLimiter(rate.Every(time.Minute), 5),
+		proxypool.WithStaleAfter(0),
+	)
+	limited.RestoreState(proxypool.StateReport{State: proxypool.Banned, Message: "403 Forbidden", Timestamp: at}, 3, at)
+	addAgent(t, p, "proxy1", limited, proxypool.WithTags("eu", "residential"))
+	plain := proxypool.NewProxyAgent(url.URL{Scheme: "socks5", Host: "proxy2.example:1080"}, proxypool.WithStaleAfter(0))
+	plain.RestoreState(proxypool.StateReport{State: proxypool.Ok, Message: "validated", Timestamp: at}, 0, time.Time{})
+	addAgent(t, p, "proxy2", plain)
+
+	data, err := json.Marshal(p.StatusSorted())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status []map[string]any
+	if err := json.Unmarshal(data, &status); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range status {
+		info["state"] = "<display>"
+		info["last_request_timestamp"] = "<elapsed>"
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(status); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.Bytes()
+
+	golden := filepath.Join("testdata", "status.golden.json")
+	if *updateGolden {
+		if err := os.WriteFile(golden, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("status JSON differs from %s (run with -update to rewrite):\n%s", golden, got)
+	}
+}
@@ -0,0 +1,117 @@
+package proxypool
+
+import (
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const stickyReplicas = 64
+
+var _ Strategy = (*StickyHost)(nil)
+
+type StickyHost struct {
+	mu   sync.Mutex
+	key  string
+	ring *hashRing
+}
+
+func StickyByHost() *StickyHost {
+	return &StickyHost{ring: newHashRing(nil, stickyReplicas)}
+}
+
+func (s *StickyHost) Select(candidates []Agent, req *http.Request) []Agent {
+	healthyAgents := agentsInState(candidates, Ok)
+	byName := make(map[string]Agent, len(healthyAgents))
+	names := make([]string, 0, len(healthyAgents))
+	for _, a := range healthyAgents {
+		name := AgentName(a)
+		byName[name] = a
+		names = append(names, name)
+	}
+	ring := s.ringFor(names)
+	result := make([]Agent, 0, len(candidates))
+	for _, name := range ring.walk(req.URL.Hostname()) {
+		result = append(result, byName[name])
+	}
+	return concatSlice(result, shuffleSlice(staleAgents(candidates)))
+}
+
+func (s *StickyHost) Lookup(host string) (string, bool) {
+	s.mu.Lock()
+	ring := s.ring
+	s.mu.Unlock()
+	names := ring.walk(host)
+	if len(names) == 0 {
+		return "", false
+	}
+	return names[0], true
+}
+
+func (s *StickyHost) ringFor(names []string) *hashRing {
+	sort.Strings(names)
+	key := strings.Join(names, "\x00")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.key != key {
+		s.key = key
+		s.ring = newHashRing(names, stickyReplicas)
+	}
+	return s.ring
+}
+
+type hashRing struct {
+	hashes []uint32
+	owners map[uint32]string
+	size   int
+}
+
+func newHashRing(names []string, replicas int) *hashRing {
+	r := &hashRing{
+		owners: make(map[uint32]string, len(names)*replicas),
+		size:   len(names),
+	}
+	for _, name := range names {
+		for i := 0; i < replicas; i++ {
+			h := hashString(strconv.Itoa(i) + "#" + name)
+			if _, ok := r.owners[h]; ok {
+				continue
+			}
+			r.owners[h] = name
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool {
+		return r.hashes[i] < r.hashes[j]
+	})
+	return r
+}
+
+func (r *hashRing) walk(key string) []string {
+	if len(r.hashes) == 0 {
+		return nil
+	}
+	h := hashString(key)
+	start := sort.Search(len(r.hashes), func(i int) bool {
+		return r.hashes[i] >= h
+	})
+	seen := make(map[string]bool, r.size)
+	result := make([]string, 0, r.size)
+	for i := 0; i < len(r.hashes) && len(result) < r.size; i++ {
+		name := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
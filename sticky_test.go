@@ -0,0 +1,102 @@
+package proxypool_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func stickyPool(t *testing.T, n int) (*proxypool.Pool, *proxypool.StickyHost, []*testutil.MockAgent) {
+	sticky := proxypool.StickyByHost()
+	p := newTestPool(t, nil, proxypool.WithStrategy(sticky))
+	agents := addAgents(t, p, n, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	return p, sticky, agents
+}
+
+func serve(t *testing.T, p *proxypool.Pool, host string) string {
+	t.Helper()
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://"+host+"/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return result.Agent
+}
+
+func TestStickyByHostIsConsistent(t *testing.T) {
+	p, sticky, _ := stickyPool(t, 5)
+	for i := 0; i < 20; i++ {
+		host := fmt.Sprintf("host%d.example", i)
+		first := serve(t, p, host)
+		for j := 0; j < 5; j++ {
+			if got := serve(t, p, host); got != first {
+				t.Fatalf("%s served by %s then %s", host, first, got)
+			}
+		}
+		if got, ok := sticky.Lookup(host); !ok || got != first {
+			t.Errorf("Lookup(%s) = %s, %v, want %s", host, got, ok, first)
+		}
+	}
+}
+
+func TestStickyByHostRemapsOnlyDeletedAgentHosts(t *testing.T) {
+	p, sticky, _ := stickyPool(t, 5)
+	const hosts = 200
+	before := make(map[string]string, hosts)
+	for i := 0; i < hosts; i++ {
+		host := fmt.Sprintf("host%d.example", i)
+		before[host] = serve(t, p, host)
+	}
+	const deleted = "agent02"
+	if err := p.Delete(deleted); err != nil {
+		t.Fatal(err)
+	}
+	moved := 0
+	for host, prev := range before {
+		got := serve(t, p, host)
+		if got == deleted {
+			t.Fatalf("%s still mapped to deleted agent", host)
+		}
+		if prev != deleted && got != prev {
+			t.Errorf("%s moved from %s to %s although its agent was not deleted", host, prev, got)
+		}
+		if prev == deleted {
+			moved++
+		}
+		if name, _ := sticky.Lookup(host); name != got {
+			t.Errorf("Lookup(%s) = %s, served by %s", host, name, got)
+		}
+	}
+	if moved == 0 || moved > hosts/2 {
+		t.Errorf("%d of %d hosts were remapped", moved, hosts)
+	}
+}
+
+func TestStickyByHostFallsBackWhileBanned(t *testing.T) {
+	p, _, agents := stickyPool(t, 3)
+	const host = "session.example"
+	preferred := serve(t, p, host)
+	var agent *testutil.MockAgent
+	for _, a := range agents {
+		if a.Info().Name == preferred {
+			agent = a
+		}
+	}
+	agent.SetState(proxypool.Banned, "")
+	fallback := serve(t, p, host)
+	if fallback == preferred {
+		t.Fatalf("banned agent %s still served %s", preferred, host)
+	}
+	if got := serve(t, p, host); got != fallback {
+		t.Errorf("fallback changed from %s to %s", fallback, got)
+	}
+	agent.SetState(proxypool.Ok, "")
+	if got := serve(t, p, host); got != preferred {
+		t.Errorf("after recovery %s served by %s, want %s", host, got, preferred)
+	}
+}
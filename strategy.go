@@ -0,0 +1,136 @@
+package proxypool
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Strategy interface {
+	Select(candidates []Agent, req *http.Request) []Agent
+}
+
+type StrategyFunc func(candidates []Agent, req *http.Request) []Agent
+
+func (f StrategyFunc) Select(candidates []Agent, req *http.Request) []Agent {
+	return f(candidates, req)
+}
+
+func LeastRecentlyUsed() Strategy {
+	return StrategyFunc(func(candidates []Agent, req *http.Request) []Agent {
+		healthyAgents := sortByLastRequest(agentsInState(candidates, Ok))
+		timeoutFirst, timeoutLast := splitSlice(shuffleSlice(staleAgents(candidates)), 1)
+		return concatSlice(timeoutFirst, healthyAgents, timeoutLast)
+	})
+}
+
+func Random() Strategy {
+	return StrategyFunc(func(candidates []Agent, req *http.Request) []Agent {
+		return concatSlice(
+			shuffleSlice(agentsInState(candidates, Ok)),
+			shuffleSlice(staleAgents(candidates)),
+		)
+	})
+}
+
+type roundRobin struct {
+	mu   sync.Mutex
+	last string
+}
+
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+func (r *roundRobin) Select(candidates []Agent, req *http.Request) []Agent {
+	healthyAgents := sortByName(agentsInState(candidates, Ok))
+	timeoutAgents := shuffleSlice(staleAgents(candidates))
+	if len(healthyAgents) == 0 {
+		return timeoutAgents
+	}
+	r.mu.Lock()
+	start := 0
+	for i, a := range healthyAgents {
+		if AgentName(a) > r.last {
+			start = i
+			break
+		}
+	}
+	r.last = AgentName(healthyAgents[start])
+	r.mu.Unlock()
+	return concatSlice(healthyAgents[start:], healthyAgents[:start], timeoutAgents)
+}
+
+func WeightedRandom() Strategy {
+	return StrategyFunc(func(candidates []Agent, req *http.Request) []Agent {
+		healthyAgents := agentsInState(candidates, Ok)
+		weighted := filter(func(a Agent) bool { return weightOf(a) > 0 }, healthyAgents)
+		lastResort := filter(func(a Agent) bool { return weightOf(a) <= 0 }, healthyAgents)
+		keys := make(map[Agent]float64, len(weighted))
+		for _, a := range weighted {
+			keys[a] = math.Pow(rand.Float64(), 1/float64(weightOf(a)))
+		}
+		weighted = sortSlice(weighted, func(a, b Agent) bool {
+			return keys[a] > keys[b]
+		})
+		return concatSlice(
+			weighted,
+			shuffleSlice(staleAgents(candidates)),
+			shuffleSlice(lastResort),
+		)
+	})
+}
+
+func LowestLatency(explore float64) Strategy {
+	return StrategyFunc(func(candidates []Agent, req *http.Request) []Agent {
+		healthyAgents := sortSlice(agentsInState(candidates, Ok), func(a, b Agent) bool {
+			return latencyOf(a) < latencyOf(b)
+		})
+		if len(healthyAgents) > 1 && rand.Float64() < explore {
+			i := rand.Intn(len(healthyAgents))
+			healthyAgents = concatSlice(healthyAgents[i:i+1], healthyAgents[:i], healthyAgents[i+1:])
+		}
+		return concatSlice(healthyAgents, shuffleSlice(staleAgents(candidates)))
+	})
+}
+
+func latencyOf(a Agent) time.Duration {
+	if l, ok := a.(interface{ LatencyEWMA() time.Duration }); ok {
+		return l.LatencyEWMA()
+	}
+	return 0
+}
+
+func weightOf(a Agent) int {
+	if w, ok := a.(interface{ Weight() int }); ok {
+		return w.Weight()
+	}
+	return 1
+}
+
+func agentsInState(agents []Agent, state State) []Agent {
+	return filter(func(a Agent) bool {
+		return a.State().State == state
+	}, agents)
+}
+
+func staleAgents(agents []Agent) []Agent {
+	return filter(func(a Agent) bool {
+		s := a.State().State
+		return s == OutOfDate || s == Probation
+	}, agents)
+}
+
+func sortByLastRequest(agents []Agent) []Agent {
+	return sortSlice(agents, func(a, b Agent) bool {
+		return a.LastRequestTime().Before(b.LastRequestTime())
+	})
+}
+
+func sortByName(agents []Agent) []Agent {
+	return sortSlice(agents, func(a, b Agent) bool {
+		return AgentName(a) < AgentName(b)
+	})
+}
@@ -0,0 +1,284 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func mockAgents(names ...string) []proxypool.Agent {
+	agents := make([]proxypool.Agent, len(names))
+	for i, name := range names {
+		agents[i] = statusAgent(name, http.StatusOK)
+	}
+	return agents
+}
+
+func names(agents []proxypool.Agent) []string {
+	r := make([]string, len(agents))
+	for i, a := range agents {
+		r[i] = proxypool.AgentName(a)
+	}
+	return r
+}
+
+func indexOf(agents []proxypool.Agent, name string) int {
+	for i, a := range agents {
+		if proxypool.AgentName(a) == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestLeastRecentlyUsedOrdering(t *testing.T) {
+	agents := mockAgents("a", "b", "c", "stale1", "stale2")
+	for _, i := range []int{2, 0, 1} {
+		agents[i].Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		time.Sleep(time.Millisecond)
+	}
+	agents[3].SetState(proxypool.OutOfDate, "")
+	agents[4].SetState(proxypool.Probation, "")
+	req := newRequest(t, http.MethodGet, "http://example.com", nil)
+	for i := 0; i < 20; i++ {
+		got := proxypool.LeastRecentlyUsed().Select(agents, req)
+		if len(got) != len(agents) {
+			t.Fatalf("Select returned %v", names(got))
+		}
+		if s := got[0].State().State; s != proxypool.OutOfDate && s != proxypool.Probation {
+			t.Fatalf("first agent %s is %s, want a stale agent", proxypool.AgentName(got[0]), s)
+		}
+		if ok := names(got[1:4]); ok[0] != "c" || ok[1] != "a" || ok[2] != "b" {
+			t.Fatalf("Ok agents = %v, want least recently used first [c a b]", ok)
+		}
+	}
+}
+
+func TestRandomOrdering(t *testing.T) {
+	agents := mockAgents("a", "b", "c", "stale")
+	agents[3].SetState(proxypool.OutOfDate, "")
+	req := newRequest(t, http.MethodGet, "http://example.com", nil)
+	first := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		got := proxypool.Random().Select(agents, req)
+		if len(got) != len(agents) {
+			t.Fatalf("Select returned %v", names(got))
+		}
+		if indexOf(got, "stale") != len(got)-1 {
+			t.Fatalf("stale agent not last: %v", names(got))
+		}
+		first[proxypool.AgentName(got[0])]++
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if first[name] == 0 {
+			t.Errorf("agent %s was never selected first: %v", name, first)
+		}
+	}
+}
+
+func TestStrategiesSkipUnhealthyAgents(t *testing.T) {
+	agents := mockAgents("ok", "banned", "error")
+	agents[1].SetState(proxypool.Banned, "")
+	agents[2].SetState(proxypool.Error, "")
+	req := newRequest(t, http.MethodGet, "http://example.com", nil)
+	for name, s := range map[string]proxypool.Strategy{
+		"lru":    proxypool.LeastRecentlyUsed(),
+		"random": proxypool.Random(),
+	} {
+		if got := names(s.Select(agents, req)); len(got) != 1 || got[0] != "ok" {
+			t.Errorf("%s: Select = %v, want [ok]", name, got)
+		}
+	}
+}
+
+func TestWithStrategy(t *testing.T) {
+	var seen *http.Request
+	last := proxypool.StrategyFunc(func(candidates []proxypool.Agent, req *http.Request) []proxypool.Agent {
+		seen = req
+		i := indexOf(candidates, "b")
+		return candidates[i : i+1]
+	})
+	p := newTestPool(t, nil, proxypool.WithStrategy(last))
+	a, b := statusAgent("a", http.StatusOK), statusAgent("b", http.StatusOK)
+	addAgent(t, p, "a", a)
+	addAgent(t, p, "b", b)
+	req := newRequest(t, http.MethodGet, "http://example.com/x", nil)
+	res, result, err := p.DoResult(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "b" || a.Calls() != 0 || b.Calls() != 1 {
+		t.Errorf("served by %s, calls a=%d b=%d", result.Agent, a.Calls(), b.Calls())
+	}
+	if seen == nil || seen.URL.Path != "/x" {
+		t.Errorf("strategy did not receive the request: %v", seen)
+	}
+}
+
+func TestRoundRobinEvenDistribution(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.RoundRobin()))
+	agents := addAgents(t, p, 10, func(name string) *testutil.MockAgent {
+		return statusAgent(name, http.StatusOK)
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			res.Body.Close()
+		}()
+	}
+	wg.Wait()
+	for _, a := range agents {
+		if n := a.Calls(); n < 9 || n > 11 {
+			t.Errorf("agent %s served %d requests, want 10±1", a.Info().Name, n)
+		}
+	}
+}
+
+func TestRoundRobinSkipsUnhealthyAgents(t *testing.T) {
+	agents := mockAgents("a", "b", "c", "d")
+	agents[1].SetState(proxypool.Banned, "")
+	rr := proxypool.RoundRobin()
+	req := newRequest(t, http.MethodGet, "http://example.com", nil)
+	var got []string
+	for i := 0; i < 6; i++ {
+		got = append(got, proxypool.AgentName(rr.Select(agents, req)[0]))
+	}
+	want := []string{"a", "c", "d", "a", "c", "d"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("first picks = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestWeightedRandomDistribution(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.WeightedRandom()))
+	light, heavy, spare := statusAgent("light", http.StatusOK), statusAgent("heavy", http.StatusOK), statusAgent("spare", http.StatusOK)
+	addAgent(t, p, "light", light, proxypool.WithWeight(1))
+	addAgent(t, p, "heavy", heavy, proxypool.WithWeight(3))
+	addAgent(t, p, "spare", spare, proxypool.WithWeight(0))
+	const n = 4000
+	for i := 0; i < n; i++ {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if share := float64(heavy.Calls()) / n; share < 0.70 || share > 0.80 {
+		t.Errorf("heavy agent share = %.3f, want about 0.75", share)
+	}
+	if spare.Calls() != 0 {
+		t.Errorf("weight 0 agent served %d requests while others were healthy", spare.Calls())
+	}
+
+	light.SetState(proxypool.Banned, "")
+	heavy.SetState(proxypool.Banned, "")
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "spare" {
+		t.Errorf("last resort request served by %s, want spare", result.Agent)
+	}
+}
+
+func TestWeightedRandomOrdersLastResortAfterWeighted(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.WeightedRandom()), proxypool.WithMaxRetry(0))
+	addAgent(t, p, "a", statusAgent("a", http.StatusBadGateway), proxypool.WithWeight(2))
+	addAgent(t, p, "b", statusAgent("b", http.StatusBadGateway), proxypool.WithWeight(1))
+	addAgent(t, p, "spare", statusAgent("spare", http.StatusBadGateway), proxypool.WithWeight(0))
+	for i := 0; i < 50; i++ {
+		_, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		var attempts *proxypool.AttemptsError
+		if !errors.As(err, &attempts) || len(attempts.Attempts) != 3 {
+			t.Fatalf("err = %v", err)
+		}
+		if attempts.Attempts[2].Agent != "spare" {
+			t.Fatalf("attempt order = %v, want spare last", attempts.Attempts)
+		}
+	}
+}
+
+func delayAgent(name string, d time.Duration) *testutil.MockAgent {
+	return testutil.NewMockAgent(name).HandleFunc(func(*http.Request) (*http.Response, error) {
+		time.Sleep(d)
+		return testutil.NewResponse(http.StatusOK, name), nil
+	})
+}
+
+func TestLowestLatencyPrefersFastAgents(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.LowestLatency(0)))
+	fast, slow := delayAgent("fast", 2*time.Millisecond), delayAgent("slow", 40*time.Millisecond)
+	addAgent(t, p, "fast", fast)
+	addAgent(t, p, "slow", slow)
+	for _, name := range []string{"fast", "slow"} {
+		ctx := proxypool.WithAgent(context.Background(), name)
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	for i := 0; i < 10; i++ {
+		res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if result.Agent != "fast" {
+			t.Fatalf("request %d served by %s, want fast", i, result.Agent)
+		}
+	}
+	for _, info := range p.StatusSorted() {
+		ewma, err := time.ParseDuration(info.LatencyEWMA)
+		if err != nil {
+			t.Fatalf("agent %s: LatencyEWMA %q: %v", info.Name, info.LatencyEWMA, err)
+		}
+		switch info.Name {
+		case "fast":
+			if ewma < 2*time.Millisecond || ewma >= 40*time.Millisecond {
+				t.Errorf("fast EWMA = %s", ewma)
+			}
+		case "slow":
+			if ewma < 40*time.Millisecond {
+				t.Errorf("slow EWMA = %s", ewma)
+			}
+		}
+	}
+}
+
+func TestLowestLatencyExplores(t *testing.T) {
+	p := newTestPool(t, nil, proxypool.WithStrategy(proxypool.LowestLatency(0.5)))
+	fast, slow := delayAgent("fast", 0), delayAgent("slow", 5*time.Millisecond)
+	addAgent(t, p, "fast", fast)
+	addAgent(t, p, "slow", slow)
+	for i := 0; i < 60; i++ {
+		res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if slow.Calls() == 0 {
+		t.Error("slow agent never explored")
+	}
+	if fast.Calls() <= slow.Calls() {
+		t.Errorf("calls fast=%d slow=%d, want fast preferred", fast.Calls(), slow.Calls())
+	}
+}
@@ -0,0 +1,40 @@
+package proxypool
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var ErrStreamLocked = errors.New("response body cannot be read before the retry decision")
+
+func WithStreaming() Option {
+	return func(p *Pool) {
+		p.streaming = true
+	}
+}
+
+type streamResponseKey struct{}
+
+func StreamResponse(ctx context.Context) context.Context {
+	return context.WithValue(ctx, streamResponseKey{}, true)
+}
+
+func isStreaming(ctx context.Context) bool {
+	stream, _ := ctx.Value(streamResponseKey{}).(bool)
+	return stream
+}
+
+// lockedBody refuses reads until the middleware has made its retry decision,
+// because a body that has been partially consumed can't be retried.
+type lockedBody struct {
+	io.ReadCloser
+	unlocked bool
+}
+
+func (b *lockedBody) Read(p []byte) (int, error) {
+	if !b.unlocked {
+		return 0, ErrStreamLocked
+	}
+	return b.ReadCloser.Read(p)
+}
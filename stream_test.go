@@ -0,0 +1,97 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"runtime"
+	"testing"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+// zeroReader produces n zero bytes without allocating them.
+type zeroReader struct {
+	n int64
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > z.n {
+		p = p[:z.n]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	z.n -= int64(len(p))
+	return len(p), nil
+}
+
+func largeBodyAgent(name string, size int64) *testutil.MockAgent {
+	return testutil.NewMockAgent(name).HandleFunc(func(*http.Request) (*http.Response, error) {
+		res := testutil.NewResponse(http.StatusOK, "")
+		res.Body = io.NopCloser(&zeroReader{n: size})
+		res.ContentLength = size
+		return res, nil
+	})
+}
+
+func totalAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.TotalAlloc
+}
+
+func TestStreamingDoesNotBufferBody(t *testing.T) {
+	const size = 1 << 30
+	var sawBody []byte
+	var readErr error
+	p := newTestPool(t, func(c *proxypool.Context) {
+		sawBody = c.Body
+		_, readErr = c.Response.Body.Read(make([]byte, 1))
+	}, proxypool.WithStreaming())
+	addAgent(t, p, "a", largeBodyAgent("a", size))
+
+	before := totalAlloc()
+	res, err := p.Do(newRequest(t, http.MethodGet, "http://example.com", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if err != nil || n != size {
+		t.Fatalf("streamed %d bytes, err %v", n, err)
+	}
+	if allocated := totalAlloc() - before; allocated > 16<<20 {
+		t.Errorf("streaming a 1 GB body allocated %d bytes", allocated)
+	}
+	if sawBody != nil {
+		t.Error("middleware received a buffered body in streaming mode")
+	}
+	if !errors.Is(readErr, proxypool.ErrStreamLocked) {
+		t.Errorf("middleware body read = %v, want ErrStreamLocked", readErr)
+	}
+}
+
+func TestStreamResponsePerRequest(t *testing.T) {
+	p := newTestPool(t, retryOnFailure, proxypool.WithStrategy(proxypool.RoundRobin()))
+	bad := statusAgent("a", http.StatusBadGateway)
+	addAgent(t, p, "a", bad)
+	addAgent(t, p, "b", largeBodyAgent("b", 1<<20))
+	ctx := proxypool.StreamResponse(context.Background())
+	res, result, err := p.DoResult(newRequest(t, http.MethodGet, "http://example.com", nil).WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if result.Agent != "b" || bad.Calls() != 1 {
+		t.Errorf("served by %s after %d calls to the failing agent", result.Agent, bad.Calls())
+	}
+	if n, err := io.Copy(io.Discard, res.Body); err != nil || n != 1<<20 {
+		t.Errorf("streamed %d bytes, err %v", n, err)
+	}
+}
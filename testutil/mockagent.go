@@ -0,0 +1,230 @@
+// Package testutil provides a scriptable MockAgent for testing code built on
+// proxypool without real proxies or HTTP servers.
+//
+// A retry policy can be asserted deterministically by scripting the agents'
+// replies and checking what they received:
+//
+//	a := testutil.NewMockAgent("a").EnqueueStatus(http.StatusBadGateway, "")
+//	b := testutil.NewMockAgent("b").EnqueueError(io.ErrUnexpectedEOF)
+//	pool := proxypool.New(func(c *proxypool.Context) {
+//		c.Retry = c.Err != nil || c.StatusCode >= 500
+//	}, proxypool.WithLogger(proxypool.NopLogger()))
+//	pool.Add("a", a)
+//	pool.Add("b", b)
+//	_, err := pool.Do(req)
+//	// err is an *proxypool.AttemptsError with two attempts,
+//	// a.Calls() == 1 and b.Calls() == 1.
+package testutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yozel/proxypool"
+)
+
+var ErrNoResponse = errors.New("mock agent has no scripted response")
+
+type Request struct {
+	Method string
+	URL    string
+	Header http.Header
+	Body   []byte
+}
+
+type reply struct {
+	res *http.Response
+	err error
+}
+
+type MockAgent struct {
+	mu        sync.Mutex
+	name      string
+	state     proxypool.StateReport
+	replies   []reply
+	handler   func(*http.Request) (*http.Response, error)
+	requests  []Request
+	last      time.Time
+	closed    bool
+	listeners []func(proxypool.StateReport)
+}
+
+var (
+	_ proxypool.Agent         = (*MockAgent)(nil)
+	_ proxypool.StateNotifier = (*MockAgent)(nil)
+)
+
+func NewMockAgent(name string) *MockAgent {
+	return &MockAgent{
+		name:  name,
+		state: proxypool.StateReport{State: proxypool.Ok, Timestamp: time.Now()},
+	}
+}
+
+// Enqueue scripts the result of the next unscripted call. Queued replies are
+// consumed in order before the handler is consulted.
+func (a *MockAgent) Enqueue(res *http.Response, err error) *MockAgent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.replies = append(a.replies, reply{res: res, err: err})
+	return a
+}
+
+func (a *MockAgent) EnqueueStatus(code int, body string) *MockAgent {
+	return a.Enqueue(NewResponse(code, body), nil)
+}
+
+func (a *MockAgent) EnqueueError(err error) *MockAgent {
+	return a.Enqueue(nil, err)
+}
+
+func (a *MockAgent) HandleFunc(fn func(*http.Request) (*http.Response, error)) *MockAgent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.handler = fn
+	return a
+}
+
+func NewResponse(code int, body string) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func (a *MockAgent) Do(req *http.Request) (*http.Response, error) {
+	r := Request{Method: req.Method, URL: req.URL.String(), Header: req.Header.Clone()}
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return nil, proxypool.ErrAgentClosed
+	}
+	a.requests = append(a.requests, r)
+	a.last = time.Now()
+	var next reply
+	handler := a.handler
+	scripted := len(a.replies) > 0
+	if scripted {
+		next, a.replies = a.replies[0], a.replies[1:]
+	}
+	a.mu.Unlock()
+	switch {
+	case scripted:
+	case handler != nil:
+		next.res, next.err = handler(req)
+	default:
+		return nil, ErrNoResponse
+	}
+	if next.res != nil {
+		if next.res.Body == nil {
+			next.res.Body = http.NoBody
+		}
+		if next.res.Header == nil {
+			next.res.Header = make(http.Header)
+		}
+		next.res.Request = req
+	}
+	return next.res, next.err
+}
+
+func (a *MockAgent) Requests() []Request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]Request(nil), a.requests...)
+}
+
+func (a *MockAgent) Calls() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.requests)
+}
+
+func (a *MockAgent) Pending() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.replies)
+}
+
+func (a *MockAgent) Info() proxypool.Info {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info := proxypool.Info{
+		Name:            a.name,
+		State:           a.state.String(),
+		Report:          a.state,
+		LastRequestTime: a.last,
+		Requests:        len(a.requests),
+	}
+	if !a.last.IsZero() {
+		info.LastRequestTimestamp = a.last.Format(time.RFC3339)
+	}
+	return info
+}
+
+func (a *MockAgent) SetState(s proxypool.State, msg string) {
+	a.mu.Lock()
+	changed := a.state.State != s
+	a.state = proxypool.StateReport{State: s, Message: msg, Timestamp: time.Now()}
+	report, listeners := a.state, a.listeners
+	a.mu.Unlock()
+	if !changed {
+		return
+	}
+	for _, fn := range listeners {
+		fn(report)
+	}
+}
+
+func (a *MockAgent) NotifyStateChange(fn func(proxypool.StateReport)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.listeners = append(a.listeners, fn)
+}
+
+func (a *MockAgent) State() proxypool.StateReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return proxypool.StateReport{State: proxypool.Closed, Message: "closed", Timestamp: a.state.Timestamp}
+	}
+	return a.state
+}
+
+func (a *MockAgent) LastRequestTime() time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.last
+}
+
+func (a *MockAgent) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+}
+
+func (a *MockAgent) Closed() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.closed
+}
@@ -0,0 +1,144 @@
+package testutil_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func retryOnFailure(c *proxypool.Context) {
+	c.Retry = c.Err != nil || c.StatusCode >= 500
+}
+
+func TestMockAgentScriptThenHandler(t *testing.T) {
+	a := testutil.NewMockAgent("a").
+		EnqueueStatus(http.StatusTooManyRequests, "slow down").
+		EnqueueError(io.ErrUnexpectedEOF).
+		HandleFunc(func(req *http.Request) (*http.Response, error) {
+			return testutil.NewResponse(http.StatusOK, "handled "+req.URL.Path), nil
+		})
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/first", strings.NewReader("payload"))
+	req.Header.Set("X-Test", "1")
+	res, err := a.Do(req)
+	if err != nil || res.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("first call = %v, %v; want the scripted 429", res, err)
+	}
+	if _, err := a.Do(req); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("second call err = %v, want the scripted error", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/third", nil)
+	res, err = a.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(res.Body); string(body) != "handled /third" {
+		t.Errorf("third call body = %q, want the handler's", body)
+	}
+	if a.Pending() != 0 || a.Calls() != 3 {
+		t.Errorf("pending = %d calls = %d, want 0 and 3", a.Pending(), a.Calls())
+	}
+
+	first := a.Requests()[0]
+	if first.Method != http.MethodPost || first.URL != "http://example.com/first" ||
+		first.Header.Get("X-Test") != "1" || string(first.Body) != "payload" {
+		t.Errorf("recorded request = %+v", first)
+	}
+	if second := a.Requests()[1]; string(second.Body) != "payload" {
+		t.Errorf("body was not restored for the next reader: %q", second.Body)
+	}
+}
+
+func TestMockAgentUnscripted(t *testing.T) {
+	a := testutil.NewMockAgent("a")
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := a.Do(req); !errors.Is(err, testutil.ErrNoResponse) {
+		t.Errorf("err = %v, want ErrNoResponse", err)
+	}
+	a.Close()
+	if _, err := a.Do(req); !errors.Is(err, proxypool.ErrAgentClosed) {
+		t.Errorf("err after Close = %v, want ErrAgentClosed", err)
+	}
+	if s := a.State().State; s != proxypool.Closed {
+		t.Errorf("state after Close = %s, want CLOSED", s)
+	}
+}
+
+func TestMockAgentState(t *testing.T) {
+	a := testutil.NewMockAgent("a")
+	var reports []proxypool.State
+	a.NotifyStateChange(func(r proxypool.StateReport) { reports = append(reports, r.State) })
+	a.SetState(proxypool.Banned, "403")
+	a.SetState(proxypool.Banned, "403 again")
+	a.SetState(proxypool.Ok, "")
+	if fmt.Sprint(reports) != "[BANNED OK]" {
+		t.Errorf("notified states = %v, want [BANNED OK]", reports)
+	}
+	if info := a.Info(); info.Name != "a" || info.Report.State != proxypool.Ok {
+		t.Errorf("Info = %+v", info)
+	}
+}
+
+func TestMockAgentInPool(t *testing.T) {
+	p := proxypool.New(retryOnFailure, proxypool.WithLogger(proxypool.NopLogger()), proxypool.WithRetryBackoff(nil))
+	defer p.Close()
+	bad := testutil.NewMockAgent("bad").EnqueueStatus(http.StatusBadGateway, "")
+	bad.SetState(proxypool.OutOfDate, "")
+	good := testutil.NewMockAgent("good").EnqueueStatus(http.StatusOK, "ok")
+	p.Add("bad", bad)
+	p.Add("good", good)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	res, result, err := p.DoResult(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if result.Agent != "good" || result.Attempts != 2 {
+		t.Errorf("served by %s after %d attempts, want good after 2", result.Agent, result.Attempts)
+	}
+	if bad.Calls() != 1 || good.Calls() != 1 {
+		t.Errorf("calls bad=%d good=%d, want 1 each", bad.Calls(), good.Calls())
+	}
+}
+
+// Scripting every agent's replies makes the number of attempts and the order
+// in which they fail deterministic.
+func ExampleMockAgent_retry() {
+	a := testutil.NewMockAgent("a").EnqueueStatus(http.StatusBadGateway, "")
+	b := testutil.NewMockAgent("b").EnqueueError(io.ErrUnexpectedEOF)
+	pool := proxypool.New(retryOnFailure, proxypool.WithLogger(proxypool.NopLogger()), proxypool.WithRetryBackoff(nil))
+	defer pool.Close()
+	pool.Add("a", a)
+	pool.Add("b", b)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	_, err := pool.Do(req)
+	var attempts *proxypool.AttemptsError
+	if errors.As(err, &attempts) {
+		fmt.Println("attempts:", len(attempts.Attempts))
+	}
+	fmt.Println("calls:", a.Calls(), b.Calls())
+	// Output:
+	// attempts: 2
+	// calls: 1 1
+}
+
+func ExampleMockAgent_Requests() {
+	a := testutil.NewMockAgent("a").HandleFunc(func(*http.Request) (*http.Response, error) {
+		return testutil.NewResponse(http.StatusOK, ""), nil
+	})
+	req, _ := http.NewRequest(http.MethodPut, "http://example.com/item", strings.NewReader(`{"id":1}`))
+	a.Do(req)
+	for _, r := range a.Requests() {
+		fmt.Println(r.Method, r.URL, string(r.Body))
+	}
+	// Output:
+	// PUT http://example.com/item {"id":1}
+}
@@ -0,0 +1,32 @@
+package proxypool
+
+import (
+	"context"
+	"net/http"
+)
+
+// Tracer is told when a call and each of its attempts start and end. The
+// tracing package provides an OpenTelemetry implementation.
+type Tracer interface {
+	StartCall(ctx context.Context, req *http.Request) (context.Context, func(CallEnd))
+	StartAttempt(ctx context.Context, agent, proxyHost string) (context.Context, func(AttemptEnd))
+}
+
+type CallEnd struct {
+	Agent    string
+	Attempts int
+	Err      error
+}
+
+type AttemptEnd struct {
+	StatusCode int
+	Retry      bool
+	Err        error
+	ErrClass   ErrClass
+}
+
+func WithTracer(t Tracer) Option {
+	return func(p *Pool) {
+		p.tracer = t
+	}
+}
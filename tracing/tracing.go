@@ -0,0 +1,75 @@
+// Package tracing emits OpenTelemetry spans for pool calls and attempts.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/yozel/proxypool"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/yozel/proxypool"
+
+// WithTracing records a span per Pool.Do call and a child span per attempt.
+// A nil provider uses the one of the span found in the request context.
+func WithTracing(tp trace.TracerProvider) proxypool.Option {
+	return proxypool.WithTracer(New(tp))
+}
+
+func New(tp trace.TracerProvider) proxypool.Tracer {
+	return &tracer{tp: tp}
+}
+
+type tracer struct {
+	tp trace.TracerProvider
+}
+
+func (t *tracer) tracer(ctx context.Context) trace.Tracer {
+	tp := t.tp
+	if tp == nil {
+		tp = trace.SpanFromContext(ctx).TracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+func (t *tracer) StartCall(ctx context.Context, req *http.Request) (context.Context, func(proxypool.CallEnd)) {
+	ctx, span := t.tracer(ctx).Start(ctx, "proxypool.Do", trace.WithAttributes(
+		attribute.String("http.method", req.Method),
+		attribute.String("http.host", req.URL.Host),
+	))
+	return ctx, func(e proxypool.CallEnd) {
+		span.SetAttributes(
+			attribute.String("proxypool.agent", e.Agent),
+			attribute.Int("proxypool.attempts", e.Attempts),
+		)
+		end(span, e.Err)
+	}
+}
+
+func (t *tracer) StartAttempt(ctx context.Context, agent, proxyHost string) (context.Context, func(proxypool.AttemptEnd)) {
+	ctx, span := t.tracer(ctx).Start(ctx, "proxypool.attempt", trace.WithAttributes(
+		attribute.String("proxypool.agent", agent),
+		attribute.String("proxypool.proxy_host", proxyHost),
+	))
+	return ctx, func(e proxypool.AttemptEnd) {
+		if e.StatusCode != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", e.StatusCode))
+		}
+		span.SetAttributes(attribute.Bool("proxypool.retry", e.Retry))
+		if e.Err != nil {
+			span.SetAttributes(attribute.String("proxypool.error_class", e.ErrClass.String()))
+		}
+		end(span, e.Err)
+	}
+}
+
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
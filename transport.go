@@ -0,0 +1,191 @@
+package proxypool
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+type transportConfig struct {
+	dialTimeout         time.Duration
+	keepAlive           time.Duration
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	tlsHandshakeTimeout time.Duration
+	clientTimeout       time.Duration
+	roundTripper        http.RoundTripper
+	tlsConfig           *tls.Config
+	tunnel              func(first dialFunc) dialFunc
+	dialContext         dialFunc
+	proxyTLSConfig      *tls.Config
+	credentials         func() (user, pass string)
+	jar                 *agentJar
+	checkRedirect       func(req *http.Request, via []*http.Request) error
+	http2               bool
+	localDNS            bool
+}
+
+func defaultTransportConfig() transportConfig {
+	return transportConfig{
+		dialTimeout:         10 * time.Second,
+		keepAlive:           300 * time.Second,
+		maxIdleConns:        100,
+		idleConnTimeout:     90 * time.Second,
+		tlsHandshakeTimeout: 10 * time.Second,
+	}
+}
+
+func (t transportConfig) newClient(u url.URL) *http.Client {
+	var jar http.CookieJar
+	if t.jar != nil {
+		jar = t.jar
+	}
+	if t.roundTripper != nil {
+		return &http.Client{Transport: t.roundTripper, Timeout: t.clientTimeout, Jar: jar, CheckRedirect: t.checkRedirect}
+	}
+	var proxy func(*http.Request) (*url.URL, error)
+	dial := (&net.Dialer{
+		Timeout:   t.dialTimeout,
+		KeepAlive: t.keepAlive,
+	}).DialContext
+	if t.dialContext != nil {
+		dial = t.dialContext
+	}
+	switch {
+	case t.tunnel != nil:
+		dial = withTimeout(t.tunnel(dial), t.dialTimeout)
+	case u.Scheme == "socks4" || u.Scheme == "socks4a":
+		dial = socks4Dialer(u, dial)
+	case u.Scheme == "socks5" || u.Scheme == "socks5h":
+		dial = socks5Dialer(u, dial, t.credentials, t.localDNS)
+	case u.Scheme == "https" && t.proxyTLSConfig != nil:
+		proxy, dial = proxyOverTLS(u, t.proxyTLSConfig, dial, t.credentials)
+	case u.Host != "":
+		proxy = proxyURL(u, t.credentials)
+	}
+	var onConnect func(context.Context, *url.URL, *http.Request, *http.Response) error
+	if proxy != nil {
+		onConnect = checkProxyConnect
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                  proxy,
+			OnProxyConnectResponse: onConnect,
+			DialContext:            dial,
+			ForceAttemptHTTP2:      t.http2,
+			MaxIdleConns:           t.maxIdleConns,
+			MaxIdleConnsPerHost:    t.maxIdleConnsPerHost,
+			IdleConnTimeout:        t.idleConnTimeout,
+			TLSHandshakeTimeout:    t.tlsHandshakeTimeout,
+			TLSClientConfig:        t.tlsClientConfig(),
+			ExpectContinueTimeout:  1 * time.Second,
+		},
+		Timeout:       t.clientTimeout,
+		Jar:           jar,
+		CheckRedirect: t.checkRedirect,
+	}
+}
+
+// withTimeout bounds every dial by d. Tunnels use it so the dial timeout
+// covers the handshakes with each hop, not just the first TCP connect.
+func withTimeout(dial dialFunc, d time.Duration) dialFunc {
+	if d <= 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, d)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
+// proxyOverTLS performs the TLS handshake with an https:// proxy itself so
+// that it can use its own config, and hands the transport a plain http://
+// proxy URL for the already encrypted connection.
+func proxyOverTLS(u url.URL, cfg *tls.Config, dial dialFunc, credentials func() (string, string)) (func(*http.Request) (*url.URL, error), dialFunc) {
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = u.Hostname()
+	}
+	plain := u
+	plain.Scheme = "http"
+	if u.Port() == "" {
+		plain.Host = net.JoinHostPort(u.Hostname(), "443")
+	}
+	return proxyURL(plain, credentials), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy TLS handshake with %s: %w", u.Host, err)
+		}
+		return tlsConn, nil
+	}
+}
+
+// checkProxyConnect turns a rejected CONNECT into a proxyconnect error so
+// that it can be classified, instead of the bare status text the transport
+// would return.
+func checkProxyConnect(ctx context.Context, proxy *url.URL, req *http.Request, res *http.Response) error {
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	err := fmt.Errorf("CONNECT %s: %s", req.Host, strings.TrimSpace(res.Status))
+	if res.StatusCode == http.StatusProxyAuthRequired {
+		err = fmt.Errorf("%w: %v", ErrProxyAuth, err)
+	}
+	return &net.OpError{Op: "proxyconnect", Net: "tcp", Err: err}
+}
+
+// viaHTTPProxy reports whether plain http requests are forwarded to an HTTP
+// proxy, in which case a 407 response comes from the proxy itself.
+func (t transportConfig) viaHTTPProxy(u url.URL) bool {
+	return t.roundTripper == nil && t.tunnel == nil && u.Host != "" && !strings.HasPrefix(u.Scheme, "socks")
+}
+
+func proxyURL(u url.URL, credentials func() (string, string)) func(*http.Request) (*url.URL, error) {
+	if credentials == nil {
+		return http.ProxyURL(&u)
+	}
+	return func(*http.Request) (*url.URL, error) {
+		r := u
+		if user, pass := credentials(); user != "" {
+			r.User = url.UserPassword(user, pass)
+		}
+		return &r, nil
+	}
+}
+
+func (t transportConfig) tlsClientConfig() *tls.Config {
+	cfg := t.tlsConfig.Clone()
+	if cfg == nil {
+		if !t.http2 {
+			return nil
+		}
+		cfg = &tls.Config{}
+	}
+	protos := filter(func(p string) bool { return p != "h2" }, cfg.NextProtos)
+	if t.http2 {
+		protos = append([]string{"h2"}, protos...)
+		if !contains(protos, "http/1.1") {
+			protos = append(protos, "http/1.1")
+		}
+	}
+	cfg.NextProtos = protos
+	return cfg
+}
@@ -0,0 +1,61 @@
+package proxypool
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func agentTransport(t *testing.T, a *ProxyAgentWithLimiter) *http.Transport {
+	t.Helper()
+	tr, ok := a.client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transport = %T, want *http.Transport", a.client.Transport)
+	}
+	return tr
+}
+
+func TestAgentOptionsReachTransport(t *testing.T) {
+	u := url.URL{Scheme: "http", Host: "proxy.invalid:8080"}
+
+	a := NewProxyAgent(u)
+	tr := agentTransport(t, a)
+	if tr.MaxIdleConns != 100 || tr.IdleConnTimeout != 90*time.Second || tr.TLSHandshakeTimeout != 10*time.Second {
+		t.Errorf("default transport = idle %d/%s, handshake %s", tr.MaxIdleConns, tr.IdleConnTimeout, tr.TLSHandshakeTimeout)
+	}
+	if tr.ForceAttemptHTTP2 {
+		t.Error("HTTP/2 enabled by default")
+	}
+	if a.client.Timeout != 0 {
+		t.Errorf("default client timeout = %s, want none", a.client.Timeout)
+	}
+	if a.transport.dialTimeout != 10*time.Second || a.transport.keepAlive != 300*time.Second {
+		t.Errorf("default dialer = %s/%s", a.transport.dialTimeout, a.transport.keepAlive)
+	}
+
+	a = NewProxyAgent(u,
+		WithDialTimeout(time.Second),
+		WithKeepAlive(2*time.Second),
+		WithTLSHandshakeTimeout(3*time.Second),
+		WithIdleConns(7, 3, 4*time.Second),
+		WithClientTimeout(5*time.Second),
+	)
+	tr = agentTransport(t, a)
+	if tr.MaxIdleConns != 7 || tr.MaxIdleConnsPerHost != 3 || tr.IdleConnTimeout != 4*time.Second {
+		t.Errorf("idle conns = %d/%d/%s, want 7/3/4s", tr.MaxIdleConns, tr.MaxIdleConnsPerHost, tr.IdleConnTimeout)
+	}
+	if tr.TLSHandshakeTimeout != 3*time.Second {
+		t.Errorf("TLS handshake timeout = %s, want 3s", tr.TLSHandshakeTimeout)
+	}
+	if a.client.Timeout != 5*time.Second {
+		t.Errorf("client timeout = %s, want 5s", a.client.Timeout)
+	}
+	if a.transport.dialTimeout != time.Second || a.transport.keepAlive != 2*time.Second {
+		t.Errorf("dialer = %s/%s, want 1s/2s", a.transport.dialTimeout, a.transport.keepAlive)
+	}
+	proxy, err := tr.Proxy(&http.Request{URL: &url.URL{Scheme: "http", Host: "example.com"}})
+	if err != nil || proxy.Host != u.Host {
+		t.Errorf("proxy = %v, %v, want %s", proxy, err, u.Host)
+	}
+}
@@ -0,0 +1,137 @@
+package proxypool
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type URLProvider struct {
+	endpoint string
+	client   *http.Client
+	logger   Logger
+
+	mu           sync.Mutex
+	header       http.Header
+	etag         string
+	lastModified string
+	proxies      map[string]url.URL
+}
+
+var _ Provider = (*URLProvider)(nil)
+
+func NewURLProvider(endpoint string, client *http.Client, logger Logger) *URLProvider {
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	if logger == nil {
+		logger = StdLogger()
+	}
+	return &URLProvider{endpoint: endpoint, client: client, logger: logger, header: make(http.Header)}
+}
+
+func (u *URLProvider) SetHeader(key, value string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.header.Set(key, value)
+}
+
+func (u *URLProvider) Proxies(ctx context.Context) (map[string]url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.endpoint, nil)
+	if err != nil {
+		return nil, scrubError(err)
+	}
+	u.mu.Lock()
+	req.Header = u.header.Clone()
+	if u.proxies != nil {
+		if u.etag != "" {
+			req.Header.Set("If-None-Match", u.etag)
+		}
+		if u.lastModified != "" {
+			req.Header.Set("If-Modified-Since", u.lastModified)
+		}
+	}
+	u.mu.Unlock()
+	res, err := u.client.Do(req)
+	if err != nil {
+		return nil, scrubError(err)
+	}
+	defer res.Body.Close()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if res.StatusCode == http.StatusNotModified && u.proxies != nil {
+		return copyProxies(u.proxies), nil
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, fmt.Errorf("proxy list fetch failed: %s", res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy list: %w", err)
+	}
+	proxies, err := u.parse(body)
+	if err != nil {
+		return nil, err
+	}
+	u.proxies = proxies
+	u.etag = res.Header.Get("ETag")
+	u.lastModified = res.Header.Get("Last-Modified")
+	return copyProxies(proxies), nil
+}
+
+func (u *URLProvider) parse(body []byte) (map[string]url.URL, error) {
+	var lines []string
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &lines); err != nil {
+			return nil, fmt.Errorf("malformed proxy list: %w", err)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("malformed proxy list: %w", err)
+		}
+	}
+	proxies := make(map[string]url.URL, len(lines))
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p, err := url.Parse(line)
+		if err != nil || p.Host == "" {
+			u.logger.Warnf("proxy list entry %d: invalid proxy URL", i+1)
+			continue
+		}
+		proxies[proxyName(p)] = *p
+	}
+	if len(proxies) == 0 && len(lines) > 0 {
+		return nil, fmt.Errorf("proxy list has no valid entries")
+	}
+	return proxies, nil
+}
+
+func proxyName(u *url.URL) string {
+	if name := u.User.Username(); name != "" {
+		return name + "@" + u.Host
+	}
+	return u.Host
+}
+
+func copyProxies(m map[string]url.URL) map[string]url.URL {
+	r := make(map[string]url.URL, len(m))
+	for k, v := range m {
+		r[k] = v
+	}
+	return r
+}
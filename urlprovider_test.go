@@ -0,0 +1,114 @@
+package proxypool_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yozel/proxypool"
+)
+
+func proxyNames(t *testing.T, provider proxypool.Provider) []string {
+	t.Helper()
+	proxies, err := provider.Proxies(context.Background())
+	if err != nil {
+		t.Fatalf("Proxies: %v", err)
+	}
+	names := make([]string, 0, len(proxies))
+	for name := range proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestURLProviderFormats(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"plain text", "text/plain", "# allocated proxies\nhttp://u1:p@a.invalid:8080\n\nhttp://b.invalid:8080\nnot a url\n"},
+		{"json", "application/json", `["http://u1:p@a.invalid:8080", "http://b.invalid:8080", "not a url"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "Bearer token" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			provider := proxypool.NewURLProvider(srv.URL, nil, proxypool.NopLogger())
+			provider.SetHeader("Authorization", "Bearer token")
+			got := proxyNames(t, provider)
+			if len(got) != 2 || got[0] != "b.invalid:8080" || got[1] != "u1@a.invalid:8080" {
+				t.Errorf("names = %v", got)
+			}
+		})
+	}
+}
+
+func TestURLProviderNotModified(t *testing.T) {
+	var fetches, conditional int64
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt64(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte("http://a.invalid:8080\n"))
+	}))
+	defer srv.Close()
+	provider := proxypool.NewURLProvider(srv.URL, nil, proxypool.NopLogger())
+
+	first := proxyNames(t, provider)
+	second := proxyNames(t, provider)
+	if len(first) != 1 || len(second) != 1 || first[0] != second[0] {
+		t.Errorf("lists = %v and %v, want the cached list on 304", first, second)
+	}
+	if conditional != 1 {
+		t.Errorf("conditional requests = %d, want 1", conditional)
+	}
+
+	// A failed fetch surfaces an error; Sync then keeps the previous list.
+	fail.Store(true)
+	if _, err := provider.Proxies(context.Background()); err == nil {
+		t.Error("Proxies succeeded on a 503")
+	}
+	if fetches != 3 {
+		t.Errorf("fetches = %d, want 3", fetches)
+	}
+}
+
+func TestURLProviderErrorHidesPassword(t *testing.T) {
+	endpoint := refusedURL(t)
+	endpoint.User = url.UserPassword("user", "s3cret")
+	endpoint.Path = "/proxies.txt"
+	provider := proxypool.NewURLProvider(endpoint.String(), nil, proxypool.NopLogger())
+	_, err := provider.Proxies(context.Background())
+	if err == nil {
+		t.Fatal("Proxies succeeded against a closed port")
+	}
+	if strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error leaks the endpoint password: %v", err)
+	}
+	if !strings.Contains(err.Error(), "user:***@") {
+		t.Errorf("error = %v, want the redacted endpoint", err)
+	}
+}
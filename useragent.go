@@ -0,0 +1,25 @@
+package proxypool
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+func RoundRobinUserAgents(agents ...string) func() string {
+	var next uint64
+	return func() string {
+		if len(agents) == 0 {
+			return ""
+		}
+		return agents[(atomic.AddUint64(&next, 1)-1)%uint64(len(agents))]
+	}
+}
+
+func RandomUserAgents(agents ...string) func() string {
+	return func() string {
+		if len(agents) == 0 {
+			return ""
+		}
+		return agents[rand.Intn(len(agents))]
+	}
+}
@@ -1,8 +1,10 @@
 package proxypool
 
 import (
+	"io"
 	"math/rand"
 	"sort"
+	"sync"
 	"time"
 
 	"golang.org/x/exp/constraints"
@@ -50,6 +52,13 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
+func max[T constraints.Ordered](a, b T) T {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func filter[T any](f func(T) bool, xs []T) []T {
 	var ys []T
 	for _, x := range xs {
@@ -67,3 +76,31 @@ func values[K comparable, V any](m map[K]V) []V {
 	}
 	return xs
 }
+
+func contains[T comparable](xs []T, x T) bool {
+	for _, y := range xs {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
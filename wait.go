@@ -0,0 +1,46 @@
+package proxypool
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+var ErrPoolClosed = fmt.Errorf("pool is closed")
+
+const waitForHealthyFallback = time.Second
+
+func (p *Pool) WaitForHealthy(ctx context.Context, n int, states ...State) error {
+	if len(states) == 0 {
+		states = []State{Ok}
+	}
+	events, unsubscribe := p.Subscribe()
+	defer unsubscribe()
+	// Agents that don't implement StateNotifier only surface changes when
+	// polled, so re-check periodically in addition to reacting to events.
+	ticker := time.NewTicker(waitForHealthyFallback)
+	defer ticker.Stop()
+	for {
+		if p.countInState(states) >= n {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.done:
+			return ErrPoolClosed
+		case <-events:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pool) countInState(states []State) int {
+	n := 0
+	for _, m := range p.members() {
+		if contains(states, m.State().State) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,76 @@
+package proxypool_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/yozel/proxypool"
+	"github.com/yozel/proxypool/testutil"
+)
+
+func unknownAgents(t *testing.T, p *proxypool.Pool, n int) []*testutil.MockAgent {
+	t.Helper()
+	return addAgents(t, p, n, func(name string) *testutil.MockAgent {
+		a := statusAgent(name, http.StatusOK)
+		a.SetState(proxypool.Unknown, "")
+		return a
+	})
+}
+
+func TestWaitForHealthyUnblocksAtThreshold(t *testing.T) {
+	p := newTestPool(t, nil)
+	agents := unknownAgents(t, p, 5)
+
+	done := make(chan error, 1)
+	go func() { done <- p.WaitForHealthy(context.Background(), 3) }()
+
+	for i, a := range agents[:3] {
+		select {
+		case err := <-done:
+			t.Fatalf("WaitForHealthy returned %v with %d healthy agents", err, i)
+		case <-time.After(20 * time.Millisecond):
+		}
+		a.SetState(proxypool.Ok, "")
+	}
+	// The state change wakes the waiter well before its fallback poll.
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("WaitForHealthy: %v", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("WaitForHealthy did not return once 3 agents were healthy")
+	}
+}
+
+func TestWaitForHealthyCountsGivenStates(t *testing.T) {
+	p := newTestPool(t, nil)
+	agents := unknownAgents(t, p, 2)
+	agents[0].SetState(proxypool.Ok, "")
+	agents[1].SetState(proxypool.OutOfDate, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitForHealthy(ctx, 2, proxypool.Ok, proxypool.OutOfDate); err != nil {
+		t.Errorf("WaitForHealthy with OutOfDate counted: %v", err)
+	}
+}
+
+func TestWaitForHealthyTimeout(t *testing.T) {
+	p := newTestPool(t, nil)
+	unknownAgents(t, p, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := p.WaitForHealthy(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+
+	time.AfterFunc(20*time.Millisecond, p.Close)
+	if err := p.WaitForHealthy(context.Background(), 1); !errors.Is(err, proxypool.ErrPoolClosed) {
+		t.Errorf("err = %v, want ErrPoolClosed", err)
+	}
+}